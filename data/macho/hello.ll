@@ -0,0 +1,27 @@
+; The Mach-O fixtures used by tests/inject_test.go were produced from this file with:
+;
+;   llc -mtriple=x86_64-apple-macosx10.15 -filetype=obj hello.ll -o hello_x86_64.o
+;   llc -mtriple=arm64-apple-macosx11.0 -filetype=obj hello.ll -o hello_arm64.o
+;   llc -mtriple=i386-apple-macosx10.6 -filetype=obj hello.ll -o hello_i386.o
+
+@.str = private unnamed_addr constant [13 x i8] c"hello world\0A\00", align 1
+@counter = global i32 0, align 4
+@table = global [4 x i32] [i32 1, i32 2, i32 3, i32 4], align 16
+
+declare i32 @printf(i8*, ...)
+
+define i32 @bump(i32 %x) {
+  %c = load i32, i32* @counter
+  %n = add i32 %c, %x
+  store i32 %n, i32* @counter
+  ret i32 %n
+}
+
+define i32 @main() {
+  %r = call i32 (i8*, ...) @printf(i8* getelementptr ([13 x i8], [13 x i8]* @.str, i32 0, i32 0))
+  %b = call i32 @bump(i32 %r)
+  %p = getelementptr [4 x i32], [4 x i32]* @table, i32 0, i32 2
+  %t = load i32, i32* %p
+  %s = add i32 %b, %t
+  ret i32 %s
+}
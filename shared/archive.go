@@ -0,0 +1,228 @@
+//
+// OCCAM
+//
+// Copyright (c) 2017, SRI International
+//
+//  All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// * Neither the name of SRI International nor the names of its contributors may
+//   be used to endorse or promote products derived from this software without
+//   specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+//
+
+package shared
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const (
+	arMagic      = "!<arch>\n"
+	thinArMagic  = "!<thin>\n"
+	arHeaderSize = 60
+)
+
+// ArchiveMember describes a member of an ar archive. Archives may contain
+// several members with the same name, these are told apart by their Instance,
+// which counts from 1 in archive order.
+type ArchiveMember struct {
+	Name     string
+	Instance int
+	Size     int64
+	// Path is where the member of a thin archive actually lives, it is empty
+	// for members that are stored in the archive itself.
+	Path   string
+	offset int64
+}
+
+// Archive is a GNU, BSD or SysV ar archive, or a GNU thin archive, read
+// without any help from the system's ar.
+type Archive struct {
+	Path    string
+	Thin    bool
+	Members []ArchiveMember
+	file    *os.File
+}
+
+// OpenArchive reads the table of contents of the archive at path.
+func OpenArchive(path string) (archive *Archive, err error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return
+	}
+	archive = &Archive{Path: path, file: file}
+	if err = archive.readMembers(); err != nil {
+		CheckDefer(func() error { return file.Close() })
+		archive = nil
+	}
+	return
+}
+
+// Close releases the archive's file.
+func (a *Archive) Close() error {
+	return a.file.Close()
+}
+
+// WithMember calls fn with a reader over the contents of the member m. The
+// contents are never written to disk, and it is safe to call WithMember from
+// several goroutines at once.
+func (a *Archive) WithMember(m ArchiveMember, fn func(io.ReaderAt) error) (err error) {
+	if m.Path == "" {
+		return fn(io.NewSectionReader(a.file, m.offset, m.Size))
+	}
+	file, err := os.Open(m.Path)
+	if err != nil {
+		return
+	}
+	defer CheckDefer(func() error { return file.Close() })
+	return fn(file)
+}
+
+// MemberLabel names the member in the usual archive(member) fashion, for use in messages.
+func (a *Archive) MemberLabel(m ArchiveMember) string {
+	if m.Instance > 1 {
+		return fmt.Sprintf("%s(%s #%d)", a.Path, m.Name, m.Instance)
+	}
+	return fmt.Sprintf("%s(%s)", a.Path, m.Name)
+}
+
+func (a *Archive) readMembers() (err error) {
+	magic := make([]byte, len(arMagic))
+	if _, err = a.file.ReadAt(magic, 0); err != nil {
+		return fmt.Errorf("%s is not an archive: %v", a.Path, err)
+	}
+	switch string(magic) {
+	case arMagic:
+	case thinArMagic:
+		a.Thin = true
+	default:
+		return fmt.Errorf("%s is not an archive", a.Path)
+	}
+	info, err := a.file.Stat()
+	if err != nil {
+		return
+	}
+	end := info.Size()
+
+	var longNames []byte
+	instances := make(map[string]int)
+	header := make([]byte, arHeaderSize)
+
+	offset := int64(len(arMagic))
+	for offset+arHeaderSize <= end {
+		if _, err = a.file.ReadAt(header, offset); err != nil {
+			return fmt.Errorf("%s: reading the member header at offset %d failed: %v", a.Path, offset, err)
+		}
+		if string(header[58:60]) != "`\n" {
+			return fmt.Errorf("%s: malformed member header at offset %d", a.Path, offset)
+		}
+		var size int64
+		size, err = strconv.ParseInt(strings.TrimSpace(string(header[48:58])), 10, 64)
+		if err != nil || size < 0 {
+			return fmt.Errorf("%s: malformed member size at offset %d", a.Path, offset)
+		}
+		dataOffset := offset + arHeaderSize
+		dataSize := size
+		name := strings.TrimRight(string(header[0:16]), " ")
+
+		// the data of the symbol and long name tables is present even in thin archives.
+		stored := !a.Thin || name == "/" || name == "//" || name == "/SYM64/"
+
+		switch {
+		case name == "//":
+			// GNU and SysV long name table
+			longNames = make([]byte, size)
+			if _, err = a.file.ReadAt(longNames, dataOffset); err != nil {
+				return fmt.Errorf("%s: reading the long name table failed: %v", a.Path, err)
+			}
+			name = ""
+		case name == "/" || name == "/SYM64/":
+			// GNU and SysV symbol tables
+			name = ""
+		case strings.HasPrefix(name, "#1/"):
+			// BSD long names are stored at the front of the member's data
+			var length int
+			length, err = strconv.Atoi(name[3:])
+			if err != nil || length < 0 || int64(length) > size {
+				return fmt.Errorf("%s: malformed BSD name %q at offset %d", a.Path, name, offset)
+			}
+			buf := make([]byte, length)
+			if _, err = a.file.ReadAt(buf, dataOffset); err != nil {
+				return fmt.Errorf("%s: reading the BSD name at offset %d failed: %v", a.Path, offset, err)
+			}
+			name = strings.TrimRight(string(buf), "\x00")
+			dataOffset += int64(length)
+			dataSize -= int64(length)
+		case len(name) > 1 && name[0] == '/':
+			// GNU and SysV long names are references into the long name table
+			var index int
+			index, err = strconv.Atoi(name[1:])
+			if err != nil || index < 0 || index >= len(longNames) {
+				return fmt.Errorf("%s: bad long name reference %q at offset %d", a.Path, name, offset)
+			}
+			name = string(longNames[index:])
+			if newline := strings.IndexByte(name, '\n'); newline >= 0 {
+				name = name[:newline]
+			}
+			name = strings.TrimSuffix(name, "/")
+		default:
+			name = strings.TrimSuffix(name, "/")
+		}
+
+		// BSD symbol tables come in a few flavors
+		if strings.HasPrefix(name, "__.SYMDEF") {
+			name = ""
+		}
+
+		if name != "" {
+			instances[name]++
+			member := ArchiveMember{
+				Name:     name,
+				Instance: instances[name],
+				Size:     dataSize,
+				offset:   dataOffset,
+			}
+			if a.Thin {
+				member.Path = name
+				if !filepath.IsAbs(name) {
+					member.Path = filepath.Join(filepath.Dir(a.Path), name)
+				}
+			}
+			a.Members = append(a.Members, member)
+		}
+
+		if stored {
+			// members are aligned on even boundaries
+			offset = dataOffset + dataSize + (size % 2)
+		} else {
+			offset = dataOffset
+		}
+	}
+	return nil
+}
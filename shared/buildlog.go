@@ -0,0 +1,390 @@
+//
+// OCCAM
+//
+// Copyright (c) 2017, SRI International
+//
+//  All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// * Neither the name of SRI International nor the names of its contributors may
+//   be used to endorse or promote products derived from this software without
+//   specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+//
+
+package shared
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+const (
+	buildRecordCompile = "compile"
+	buildRecordLink    = "link"
+)
+
+// BuildRecord is a compilation, or a link, as recorded in the build log (GLLVM_BUILD_LOG).
+// All the paths are absolute, so that the records of a whole build fit together.
+type BuildRecord struct {
+	Kind         string   `json:"kind"`      // "compile" or "link"
+	Directory    string   `json:"directory"` // where the compiler was called
+	Arguments    []string `json:"arguments"` // how it was called
+	Output       string   `json:"output"`    // the object file, or the linked binary
+	Source       string   `json:"source,omitempty"`
+	Bitcode      string   `json:"bitcode,omitempty"`
+	Objects      []string `json:"objects,omitempty"`      // the objects, archives and libraries linked by path
+	Libraries    []string `json:"libraries,omitempty"`    // the libraries linked with -l
+	LibraryPaths []string `json:"libraryPaths,omitempty"` // the directories given with -L
+}
+
+// WriteBuildRecord adds the record to the build log in the directory.
+func WriteBuildRecord(dir string, record BuildRecord) (err error) {
+	contents, err := json.MarshalIndent(record, "", "  ")
+	if err != nil {
+		return
+	}
+	return writeNewFile(dir, record.Kind, ".json", append(contents, '\n'))
+}
+
+// ReadBuildLog returns the records in the build log in the directory.
+func ReadBuildLog(dir string) (records []BuildRecord, err error) {
+	files, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return
+	}
+	sortByModTime(files)
+	for _, file := range files {
+		var contents []byte
+		if contents, err = os.ReadFile(file); err != nil {
+			return
+		}
+		var record BuildRecord
+		if err = json.Unmarshal(contents, &record); err != nil {
+			err = fmt.Errorf("%v is not a build record: %v", file, err)
+			return
+		}
+		records = append(records, record)
+	}
+	return
+}
+
+// logBuild adds the record to the build log, if the user asked for one.
+func logBuild(record BuildRecord) {
+	if LLVMBuildLog == "" {
+		return
+	}
+	if err := WriteBuildRecord(LLVMBuildLog, record); err != nil {
+		LogWarning("Adding to the build log %v failed because %v\n", LLVMBuildLog, err)
+	}
+}
+
+// compileRecords returns the build records of the objects compiled by the compiler.
+func compileRecords(compilerExecName string, args []string, links []bitcodeToObjectLink) (records []BuildRecord) {
+	directory, err := os.Getwd()
+	if err != nil {
+		LogWarning("compileRecords: %v\n", err)
+		return
+	}
+	for _, link := range links {
+		records = append(records, BuildRecord{
+			Kind:      buildRecordCompile,
+			Directory: directory,
+			Arguments: append([]string{compilerExecName}, args...),
+			Output:    absolutePath(directory, link.objPath),
+			Source:    absolutePath(directory, link.srcPath),
+			Bitcode:   absolutePath(directory, link.bcPath),
+		})
+	}
+	return
+}
+
+// linkRecord returns the build record of the binary linked by the compiler from the objects.
+func linkRecord(compilerExecName string, args []string, pr ParserResult, objects []string) (record BuildRecord, ok bool) {
+	directory, err := os.Getwd()
+	if err != nil {
+		LogWarning("linkRecord: %v\n", err)
+		return
+	}
+	output := pr.OutputFilename
+	if output == "" {
+		output = "a.out"
+	}
+	record = BuildRecord{
+		Kind:      buildRecordLink,
+		Directory: directory,
+		Arguments: append([]string{compilerExecName}, args...),
+		Output:    absolutePath(directory, output),
+	}
+	for _, object := range objects {
+		record.Objects = append(record.Objects, absolutePath(directory, object))
+	}
+	for i := 0; i < len(pr.LinkArgs); i++ {
+		arg := pr.LinkArgs[i]
+		switch {
+		case (arg == "-l" || arg == "-L") && i+1 < len(pr.LinkArgs):
+			i++
+			if arg == "-l" {
+				record.Libraries = append(record.Libraries, pr.LinkArgs[i])
+			} else {
+				record.LibraryPaths = append(record.LibraryPaths, absolutePath(directory, pr.LinkArgs[i]))
+			}
+		case strings.HasPrefix(arg, "-l") && len(arg) > 2:
+			record.Libraries = append(record.Libraries, arg[2:])
+		case strings.HasPrefix(arg, "-L") && len(arg) > 2:
+			record.LibraryPaths = append(record.LibraryPaths, absolutePath(directory, arg[2:]))
+		}
+	}
+	ok = true
+	return
+}
+
+func absolutePath(directory string, path string) string {
+	if filepath.IsAbs(path) {
+		return filepath.Clean(path)
+	}
+	return filepath.Join(directory, path)
+}
+
+// BuildNode is a file in the build graph.
+type BuildNode struct {
+	ID   string `json:"id"`   // the absolute path of the file, or -lname for libraries we could not find
+	Kind string `json:"kind"` // executable, library, archive, object, source, bitcode, or external
+}
+
+// BuildEdge connects a file in the build graph to one it was built from.
+type BuildEdge struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+	Kind string `json:"kind"` // links, compiles, or bitcode
+}
+
+// BuildGraph is the whole build, from the binaries down to the source and bitcode files.
+type BuildGraph struct {
+	Nodes []BuildNode `json:"nodes"`
+	Edges []BuildEdge `json:"edges"`
+}
+
+// NewBuildGraph puts the records of a build log together into a graph. Archives are not built by the
+// compiler, so we look inside those we can find to see which of the objects they contain.
+func NewBuildGraph(records []BuildRecord) (graph BuildGraph) {
+	graph = BuildGraph{Nodes: []BuildNode{}, Edges: []BuildEdge{}}
+	kinds := make(map[string]string)
+	edges := make(map[BuildEdge]bool)
+	byBitcode := make(map[string]string)
+	var links []BuildRecord
+
+	for _, record := range records {
+		switch record.Kind {
+		case buildRecordCompile:
+			kinds[record.Output] = "object"
+			kinds[record.Source] = "source"
+			edges[BuildEdge{From: record.Output, To: record.Source, Kind: "compiles"}] = true
+			if record.Bitcode != "" {
+				kinds[record.Bitcode] = "bitcode"
+				edges[BuildEdge{From: record.Output, To: record.Bitcode, Kind: "bitcode"}] = true
+				byBitcode[record.Bitcode] = record.Output
+			}
+		case buildRecordLink:
+			kinds[record.Output] = binaryKind(record.Output)
+			links = append(links, record)
+		}
+	}
+
+	for _, record := range links {
+		var inputs []string
+		inputs = append(inputs, record.Objects...)
+		for _, library := range record.Libraries {
+			inputs = append(inputs, findLibrary(library, record, kinds))
+		}
+		for _, input := range inputs {
+			edges[BuildEdge{From: record.Output, To: input, Kind: "links"}] = true
+			if _, known := kinds[input]; known {
+				continue
+			}
+			kinds[input] = binaryKind(input)
+			if kinds[input] == "archive" {
+				archiveEdges(input, kinds, edges, byBitcode)
+			}
+		}
+	}
+
+	for id, kind := range kinds {
+		graph.Nodes = append(graph.Nodes, BuildNode{ID: id, Kind: kind})
+	}
+	for edge := range edges {
+		graph.Edges = append(graph.Edges, edge)
+	}
+	sort.Slice(graph.Nodes, func(i, j int) bool { return graph.Nodes[i].ID < graph.Nodes[j].ID })
+	sort.Slice(graph.Edges, func(i, j int) bool {
+		if graph.Edges[i].From != graph.Edges[j].From {
+			return graph.Edges[i].From < graph.Edges[j].From
+		}
+		return graph.Edges[i].To < graph.Edges[j].To
+	})
+	return
+}
+
+// binaryKind guesses what kind of binary the path is from its name.
+func binaryKind(path string) string {
+	base := filepath.Base(path)
+	switch {
+	case strings.HasPrefix(base, "-l"):
+		return "external"
+	case strings.HasSuffix(base, ".a"):
+		return "archive"
+	case strings.HasSuffix(base, ".so") || strings.Contains(base, ".so.") || strings.HasSuffix(base, ".dylib"):
+		return "library"
+	case strings.HasSuffix(base, ".o") || strings.HasSuffix(base, ".lo"):
+		return "object"
+	default:
+		return "executable"
+	}
+}
+
+// findLibrary looks for the library, preferring those the build produced, the way the linker would.
+func findLibrary(library string, record BuildRecord, kinds map[string]string) string {
+	for _, dir := range record.LibraryPaths {
+		for _, suffix := range []string{".so", ".dylib", ".a"} {
+			candidate := filepath.Join(dir, "lib"+library+suffix)
+			if _, built := kinds[candidate]; built {
+				return candidate
+			}
+			if _, err := os.Stat(candidate); err == nil {
+				return candidate
+			}
+		}
+	}
+	return "-l" + library
+}
+
+// archiveEdges connects the archive to the objects in it, which we recognize by their bitcode.
+func archiveEdges(archivePath string, kinds map[string]string, edges map[BuildEdge]bool, byBitcode map[string]string) {
+	file, err := os.Open(archivePath)
+	if err != nil {
+		LogDebug("archiveEdges: %v\n", err)
+		return
+	}
+	defer CheckDefer(func() error { return file.Close() })
+	records, err := recordsOf(file, archivePath)
+	if err != nil {
+		LogDebug("archiveEdges: %v\n", err)
+	}
+	for _, record := range records {
+		if object, ok := byBitcode[record.Path]; ok {
+			edges[BuildEdge{From: archivePath, To: object, Kind: "links"}] = true
+		} else {
+			kinds[record.Path] = "bitcode"
+			edges[BuildEdge{From: archivePath, To: record.Path, Kind: "bitcode"}] = true
+		}
+	}
+}
+
+// DOT renders the graph in graphviz's dot language.
+func (graph BuildGraph) DOT() string {
+	shapes := map[string]string{
+		"executable": "doubleoctagon",
+		"library":    "octagon",
+		"archive":    "folder",
+		"object":     "box",
+		"source":     "note",
+		"bitcode":    "component",
+		"external":   "plaintext",
+	}
+	var sb strings.Builder
+	sb.WriteString("digraph build {\n\trankdir=LR;\n")
+	for _, node := range graph.Nodes {
+		fmt.Fprintf(&sb, "\t%q [label=%q, shape=%s];\n", node.ID, filepath.Base(node.ID), shapes[node.Kind])
+	}
+	for _, edge := range graph.Edges {
+		style := "solid"
+		if edge.Kind == "bitcode" {
+			style = "dashed"
+		}
+		fmt.Fprintf(&sb, "\t%q -> %q [style=%s];\n", edge.From, edge.To, style)
+	}
+	sb.WriteString("}\n")
+	return sb.String()
+}
+
+// GraphTool implements the gllvm-graph command, which renders the build log as a graph.
+func GraphTool(args []string) (exitCode int) {
+	exitCode = 1
+
+	flagSet := flag.NewFlagSet(args[0], flag.ContinueOnError)
+	format := flagSet.String("format", "dot", "the format of the graph: dot or json")
+	output := flagSet.String("o", "", "the file to write the graph to (defaults to the standard output)")
+	flagSet.Usage = func() {
+		fmt.Fprintf(flagSet.Output(), "Usage: %s [-format dot|json] [-o output] [build log directory]\n", args[0])
+		flagSet.PrintDefaults()
+	}
+	if err := flagSet.Parse(args[1:]); err != nil {
+		return
+	}
+	buildLog := LLVMBuildLog
+	if flagSet.NArg() > 0 {
+		buildLog = flagSet.Arg(0)
+	}
+	if buildLog == "" {
+		flagSet.Usage()
+		return
+	}
+
+	records, err := ReadBuildLog(buildLog)
+	if err != nil {
+		LogError("Failed to read the build log %s because: %v.\n", buildLog, err)
+		return
+	}
+	graph := NewBuildGraph(records)
+
+	var contents []byte
+	switch *format {
+	case "dot":
+		contents = []byte(graph.DOT())
+	case "json":
+		if contents, err = json.MarshalIndent(graph, "", "  "); err != nil {
+			LogError("Failed to encode the graph because: %v.\n", err)
+			return
+		}
+		contents = append(contents, '\n')
+	default:
+		LogError("Unknown format %s.\n", *format)
+		return
+	}
+
+	if *output == "" {
+		_, err = os.Stdout.Write(contents)
+	} else {
+		err = os.WriteFile(*output, contents, 0644)
+	}
+	if err != nil {
+		LogError("Failed to write the graph because: %v.\n", err)
+		return
+	}
+	exitCode = 0
+	return
+}
@@ -0,0 +1,307 @@
+//
+// OCCAM
+//
+// Copyright (c) 2017, SRI International
+//
+//  All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// * Neither the name of SRI International nor the names of its contributors may
+//   be used to endorse or promote products derived from this software without
+//   specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+//
+
+package shared
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// CompileCommand is an entry of a compilation database (compile_commands.json), along with the
+// bitcode file we built for it.
+type CompileCommand struct {
+	Directory string   `json:"directory"`
+	File      string   `json:"file"`
+	Arguments []string `json:"arguments"`
+	Output    string   `json:"output,omitempty"`
+	Bitcode   string   `json:"bitcode,omitempty"`
+}
+
+// AppendCompileCommands adds the commands to the compilation database (GLLVM_COMPILE_COMMANDS). If the database is
+// a directory, the commands are written into a fragment of their own, for gllvm-compdb to merge later. Otherwise
+// the database is a JSON file, that we update while holding a lock on it, so that parallel jobs do not lose each
+// other's updates.
+func AppendCompileCommands(database string, commands []CompileCommand) (err error) {
+	if len(commands) == 0 {
+		return
+	}
+	if info, statErr := os.Stat(database); statErr == nil && info.IsDir() {
+		return writeCompileCommandsFragment(database, commands)
+	}
+
+	unlock, err := lockPath(database+".lock", true)
+	if err != nil {
+		return
+	}
+	defer unlock()
+
+	var existing []CompileCommand
+	if _, statErr := os.Stat(database); statErr == nil {
+		if existing, err = ReadCompileCommands(database); err != nil {
+			return
+		}
+	}
+	return writeCompileCommands(database, mergeCompileCommands(existing, commands))
+}
+
+func writeCompileCommandsFragment(dir string, commands []CompileCommand) (err error) {
+	contents, err := json.MarshalIndent(commands, "", "  ")
+	if err != nil {
+		return
+	}
+	return writeNewFile(dir, "fragment", ".json", append(contents, '\n'))
+}
+
+func writeCompileCommands(database string, commands []CompileCommand) (err error) {
+	contents, err := json.MarshalIndent(commands, "", "  ")
+	if err != nil {
+		return
+	}
+	return writeFileAtomically(database, append(contents, '\n'), 0644)
+}
+
+// ReadCompileCommands reads a compilation database, or a fragment of one.
+func ReadCompileCommands(path string) (commands []CompileCommand, err error) {
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		return
+	}
+	if err = json.Unmarshal(contents, &commands); err != nil {
+		err = fmt.Errorf("%v is not a compilation database: %v", path, err)
+	}
+	return
+}
+
+// MergeCompileCommands reads the compilation databases, and the directories of fragments, and merges them. A later
+// command for the same file and output replaces an earlier one.
+func MergeCompileCommands(inputs []string) (commands []CompileCommand, err error) {
+	files, _, err := compileDatabaseFiles(inputs)
+	if err != nil {
+		return
+	}
+	return mergeCompileDatabaseFiles(files)
+}
+
+func mergeCompileDatabaseFiles(files []string) (commands []CompileCommand, err error) {
+	for _, file := range files {
+		var more []CompileCommand
+		if more, err = ReadCompileCommands(file); err != nil {
+			return
+		}
+		commands = mergeCompileCommands(commands, more)
+	}
+	return
+}
+
+// compileDatabaseFiles lists the compilation databases among the inputs, and the fragments in the directories
+// among them, oldest first.
+func compileDatabaseFiles(inputs []string) (files []string, fragments []string, err error) {
+	for _, input := range inputs {
+		if info, statErr := os.Stat(input); statErr == nil && info.IsDir() {
+			var found []string
+			if found, err = filepath.Glob(filepath.Join(input, "*.json")); err != nil {
+				return
+			}
+			sortByModTime(found)
+			files = append(files, found...)
+			fragments = append(fragments, found...)
+		} else {
+			files = append(files, input)
+		}
+	}
+	return
+}
+
+// mergeCompileCommands adds the newer commands to the older ones, replacing those for the same file and output.
+func mergeCompileCommands(older []CompileCommand, newer []CompileCommand) (merged []CompileCommand) {
+	key := func(command CompileCommand) string {
+		return command.Directory + "\x00" + command.File + "\x00" + command.Output
+	}
+	replaced := make(map[string]bool)
+	for _, command := range newer {
+		replaced[key(command)] = true
+	}
+	for _, command := range older {
+		if !replaced[key(command)] {
+			merged = append(merged, command)
+		}
+	}
+	return append(merged, newer...)
+}
+
+// sortByModTime sorts the files, oldest first, so that merging them keeps the latest commands.
+func sortByModTime(files []string) {
+	modTimes := make(map[string]int64)
+	for _, file := range files {
+		if info, err := os.Stat(file); err == nil {
+			modTimes[file] = info.ModTime().UnixNano()
+		}
+	}
+	sort.SliceStable(files, func(i, j int) bool { return modTimes[files[i]] < modTimes[files[j]] })
+}
+
+// compileCommands returns the compilation database entries of the compilation, one for each source file,
+// with the arguments that compile just that file to its object. When the compiler links as well, the objects
+// are temporaries of ours, so the entries have the object that compiling the file on its own makes instead.
+func compileCommands(compilerExecName string, pr ParserResult, links []bitcodeToObjectLink) (commands []CompileCommand) {
+	directory, err := os.Getwd()
+	if err != nil {
+		LogWarning("compileCommands: %v\n", err)
+		return
+	}
+	for _, link := range links {
+		object := link.objPath
+		if !pr.IsCompileOnly {
+			object, _ = getArtifactNames(pr, link.srcIndex, false)
+		}
+		command := compileCommand(directory, compilerExecName, pr, link.srcIndex, []string{"-c"}, object)
+		command.Bitcode, _ = filepath.Abs(link.bcPath)
+		commands = append(commands, command)
+	}
+	return
+}
+
+// skippedCompileCommands returns the compilation database entries of a compilation that we build no bitcode for,
+// of assembly files, or with -S, -emit-llvm or -flto, say. Only compiling counts, not preprocessing, computing
+// the dependencies, or linking.
+func skippedCompileCommands(compilerExecName string, pr ParserResult) (commands []CompileCommand) {
+	compiling := pr.IsCompileOnly || pr.IsAssembleOnly
+	if !compiling || pr.IsPreprocessOnly || pr.IsPrintOnly {
+		return
+	}
+	directory, err := os.Getwd()
+	if err != nil {
+		LogWarning("skippedCompileCommands: %v\n", err)
+		return
+	}
+	// the flags that set the mode are not among the CompileArgs
+	var mode []string
+	for _, arg := range pr.InputList {
+		if strings.HasPrefix(arg, "-flto") {
+			mode = append(mode, arg)
+		}
+	}
+	extension := ".o"
+	if pr.IsEmitLLVM {
+		mode = append(mode, "-emit-llvm")
+		extension = ".bc"
+	}
+	if pr.IsAssembleOnly {
+		mode = append(mode, "-S")
+		extension = ".s"
+		if pr.IsEmitLLVM {
+			extension = ".ll"
+		}
+	} else {
+		mode = append(mode, "-c")
+	}
+	for i, srcFile := range pr.InputFiles {
+		output := pr.OutputFilename
+		if output == "" || len(pr.InputFiles) > 1 {
+			baseName := filepath.Base(srcFile)
+			output = strings.TrimSuffix(baseName, filepath.Ext(baseName)) + extension
+		}
+		commands = append(commands, compileCommand(directory, compilerExecName, pr, i, mode, output))
+	}
+	return
+}
+
+// compileCommand is the entry of the i-th input file, compiled on its own in the mode to the output.
+func compileCommand(directory string, compilerExecName string, pr ParserResult, srcIndex int, mode []string, output string) CompileCommand {
+	arguments := append([]string{compilerExecName}, pr.CompileArgs...)
+	arguments = append(arguments, mode...)
+	arguments = append(arguments, pr.inputFileArgs(srcIndex)...)
+	arguments = append(arguments, "-o", output)
+	return CompileCommand{
+		Directory: directory,
+		File:      pr.InputFiles[srcIndex],
+		Arguments: arguments,
+		Output:    output,
+	}
+}
+
+// CompileDatabaseTool implements the gllvm-compdb command, which merges compilation databases, and the fragments
+// that parallel jobs write into a directory, into a single compilation database.
+func CompileDatabaseTool(args []string) (exitCode int) {
+	exitCode = 1
+
+	flagSet := flag.NewFlagSet(args[0], flag.ContinueOnError)
+	output := flagSet.String("o", "compile_commands.json", "the compilation database to write")
+	clean := flagSet.Bool("rm", false, "remove the fragments once merged")
+	flagSet.Usage = func() {
+		fmt.Fprintf(flagSet.Output(), "Usage: %s [-o output] [-rm] <database or directory of fragments>...\n", args[0])
+		flagSet.PrintDefaults()
+	}
+	if err := flagSet.Parse(args[1:]); err != nil {
+		return
+	}
+	inputs := flagSet.Args()
+	if len(inputs) == 0 {
+		flagSet.Usage()
+		return
+	}
+
+	files, fragments, err := compileDatabaseFiles(inputs)
+	if err != nil {
+		LogError("Failed to list the compilation databases because: %v.\n", err)
+		return
+	}
+	commands, err := mergeCompileDatabaseFiles(files)
+	if err != nil {
+		LogError("Failed to merge the compilation databases because: %v.\n", err)
+		return
+	}
+	if commands == nil {
+		commands = []CompileCommand{}
+	}
+	if err = writeCompileCommands(*output, commands); err != nil {
+		LogError("Failed to write %s because: %v.\n", *output, err)
+		return
+	}
+	informUser("Wrote %d commands to %s.\n", len(commands), *output)
+
+	if *clean {
+		// only those we merged, more may have arrived since
+		for _, fragment := range fragments {
+			CheckDefer(func() error { return os.Remove(fragment) })
+		}
+	}
+	exitCode = 0
+	return
+}
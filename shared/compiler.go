@@ -34,9 +34,7 @@
 package shared
 
 import (
-	"io"
 	"os"
-	"path"
 	"path/filepath"
 	"runtime"
 	"strings"
@@ -44,8 +42,10 @@ import (
 )
 
 type bitcodeToObjectLink struct {
-	bcPath  string
-	objPath string
+	bcPath   string
+	objPath  string
+	srcPath  string
+	srcIndex int // of the source file in the InputFiles
 }
 
 // Compile wraps a call to the compiler with the given args.
@@ -73,6 +73,16 @@ func Compile(args []string, compiler string) (exitCode int) {
 
 		if !ok {
 			exitCode = 1
+		} else if LLVMConfigureOnly == "" && len(pr.InputFiles) == 0 && len(pr.LinkArgs) > 0 {
+			// a link of objects built earlier
+			if record, recorded := linkRecord(compilerExecName, args, pr, pr.ObjectFiles); recorded {
+				logBuild(record)
+			}
+		} else if LLVMCompileCommands != "" {
+			// the files are compiled all the same, assembly say, just without bitcode of ours
+			if err := AppendCompileCommands(LLVMCompileCommands, skippedCompileCommands(compilerExecName, pr)); err != nil {
+				LogWarning("Adding to the compilation database %v failed because %v\n", LLVMCompileCommands, err)
+			}
 		}
 
 		// Else try to build bitcode as well
@@ -101,10 +111,22 @@ func Compile(args []string, compiler string) (exitCode int) {
 			// When objects and bitcode are built we can attach bitcode paths
 			// to object files and link
 			for _, link := range bcObjLinks {
-				attachBitcodePathToObject(link.bcPath, link.objPath)
+				provenance := BitcodeRecord{Source: link.srcPath, Compiler: compilerExecName, Flags: pr.CompileArgs}
+				attachBitcodePathToObject(link.bcPath, link.objPath, provenance)
+			}
+			if LLVMCompileCommands != "" {
+				if err := AppendCompileCommands(LLVMCompileCommands, compileCommands(compilerExecName, pr, bcObjLinks)); err != nil {
+					LogWarning("Adding to the compilation database %v failed because %v\n", LLVMCompileCommands, err)
+				}
+			}
+			for _, record := range compileRecords(compilerExecName, args, bcObjLinks) {
+				logBuild(record)
 			}
 			if !pr.IsCompileOnly {
 				compileTimeLinkFiles(compilerExecName, pr, newObjectFiles)
+				if record, recorded := linkRecord(compilerExecName, args, pr, append(newObjectFiles, pr.ObjectFiles...)); recorded {
+					logBuild(record)
+				}
 			}
 		}
 	}
@@ -121,26 +143,28 @@ func buildAndAttachBitcode(compilerExecName string, pr ParserResult, bcObjLinks
 	if len(pr.InputFiles) == 1 && pr.IsCompileOnly {
 		var srcFile = pr.InputFiles[0]
 		objFile, bcFile := getArtifactNames(pr, 0, hidden)
-		buildBitcodeFile(compilerExecName, pr, srcFile, bcFile)
-		*bcObjLinks = append(*bcObjLinks, bitcodeToObjectLink{bcPath: bcFile, objPath: objFile})
+		buildBitcodeFile(compilerExecName, pr, 0, bcFile)
+		*bcObjLinks = append(*bcObjLinks, bitcodeToObjectLink{bcPath: bcFile, objPath: objFile, srcPath: srcFile})
 	} else {
 		for i, srcFile := range pr.InputFiles {
 			objFile, bcFile := getArtifactNames(pr, i, hidden)
 			if hidden {
-				buildObjectFile(compilerExecName, pr, srcFile, objFile)
+				buildObjectFile(compilerExecName, pr, i, objFile)
 				*newObjectFiles = append(*newObjectFiles, objFile)
 			}
-			if strings.HasSuffix(srcFile, ".bc") {
-				*bcObjLinks = append(*bcObjLinks, bitcodeToObjectLink{bcPath: srcFile, objPath: objFile})
+			// bitcode is already bitcode, unless -x says it is written in some other language
+			if language := pr.inputLanguage(i); strings.HasSuffix(srcFile, ".bc") && (language == "" || language == "ir") {
+				*bcObjLinks = append(*bcObjLinks, bitcodeToObjectLink{bcPath: srcFile, objPath: objFile, srcPath: srcFile, srcIndex: i})
 			} else {
-				buildBitcodeFile(compilerExecName, pr, srcFile, bcFile)
-				*bcObjLinks = append(*bcObjLinks, bitcodeToObjectLink{bcPath: bcFile, objPath: objFile})
+				buildBitcodeFile(compilerExecName, pr, i, bcFile)
+				*bcObjLinks = append(*bcObjLinks, bitcodeToObjectLink{bcPath: bcFile, objPath: objFile, srcPath: srcFile, srcIndex: i})
 			}
 		}
 	}
 }
 
-func attachBitcodePathToObject(bcFile, objFile string) (success bool) {
+// Records the bitcode file, along with its provenance, in the object file.
+func attachBitcodePathToObject(bcFile, objFile string, provenance BitcodeRecord) (success bool) {
 	success = false
 	// We can only attach a bitcode path to certain file types
 	// this is too fragile, we need to look into a better way to do this.
@@ -156,23 +180,23 @@ func attachBitcodePathToObject(bcFile, objFile string) (success bool) {
 		".nossppico", //iam: also FreeBSD, ".nossppico" denotes a position-independent relocatable object without stack smashing protection.
 		".po":        //iam: profiled object
 		LogDebug("attachBitcodePathToObject recognized %v as something it can inject into.\n", extension)
-		success = injectPath(extension, bcFile, objFile)
+		success = injectPath(extension, bcFile, objFile, provenance)
 		return
 	default:
 		//OK we have to work harder here
 		ok, err := injectableViaFileType(objFile)
 		LogDebug("attachBitcodePathToObject: injectableViaFileType returned  ok=%v  err=%v", ok, err)
 		if ok {
-			success = injectPath(extension, bcFile, objFile)
+			success = injectPath(extension, bcFile, objFile, provenance)
 			return
 		}
 		if err != nil {
-			// OK we have to work EVEN harder here (the file utility is not installed - probably)
+			// OK we have to work EVEN harder here (the file could not be read - probably)
 			// N.B. this will probably fail if we are cross compiling.
 			ok, err = injectableViaDebug(objFile)
 			LogDebug("attachBitcodePathToObject: injectableViaDebug returned  ok=%v  err=%v", ok, err)
 			if ok {
-				success = injectPath(extension, bcFile, objFile)
+				success = injectPath(extension, bcFile, objFile, provenance)
 				return
 			}
 			if err != nil {
@@ -185,18 +209,98 @@ func attachBitcodePathToObject(bcFile, objFile string) (success bool) {
 }
 
 // move this out to concentrate on the object path analysis above.
-func injectPath(extension, bcFile, objFile string) (success bool) {
+func injectPath(extension, bcFile, objFile string, record BitcodeRecord) (success bool) {
 	success = false
-	// Store bitcode path to temp file
+	// Store bitcode path, and what we know about it, in the section
 	var absBcPath, _ = filepath.Abs(bcFile)
-	tmpContent := []byte(absBcPath + "\n")
+	record.Path = absBcPath
+	if record.Source != "" {
+		record.Source, _ = filepath.Abs(record.Source)
+	}
+	hash, err := BitcodeHash(absBcPath)
+	if err != nil {
+		LogWarning("injectPath: hashing %v failed because %v\n", absBcPath, err)
+	}
+	record.Hash = hash
+	contents, err := EncodeBitcodeRecord(record)
+	if err != nil {
+		LogWarning("injectPath: encoding the record of %v failed because %v\n", absBcPath, err)
+		return
+	}
+	if !injectSection(objFile, ELFSectionName, DarwinSectionName, contents) {
+		return
+	}
+
+	// Store the bitcode itself too, if asked to
+	if LLVMEmbedBitcode != "" {
+		embedBitcode(absBcPath, objFile)
+	}
+
+	// Copy bitcode file to store, if necessary
+	if bcStorePath := LLVMBitcodeStorePath; bcStorePath != "" {
+		if _, err := StoreBitcodeFile(bcStorePath, absBcPath); err != nil {
+			LogWarning("Copying bc to bitcode archive %v failed because %v\n", bcStorePath, err)
+			return
+		}
+	}
+	success = true
+	return
+}
+
+// Embeds the compressed bitcode in its own section of the object file, so that get-bc can find it
+// even when the bitcode file itself is long gone. Failing to do so is not fatal, the path is still there.
+func embedBitcode(absBcPath, objFile string) {
+	bitcode, err := os.ReadFile(absBcPath)
+	if err != nil {
+		LogWarning("embedBitcode: reading %v failed because %v\n", absBcPath, err)
+		return
+	}
+	record, err := EncodeEmbeddedBitcode(absBcPath, bitcode)
+	if err != nil {
+		LogWarning("embedBitcode: compressing %v failed because %v\n", absBcPath, err)
+		return
+	}
+	if !injectSection(objFile, ELFBitcodeSectionName, DarwinBitcodeSectionName, record) {
+		LogWarning("embedBitcode: %v will only contain the path of %v\n", objFile, absBcPath)
+	}
+}
+
+// Writes the contents into the given section of the object file (the ELF or the Mach-O one, depending
+// on the platform). We do this ourselves, objcopy (or ld on OSX) is only used as a fallback, and only
+// if the user asked for it.
+func injectSection(objFile string, elfSection string, darwinSection string, contents []byte) (success bool) {
+	var err error
+	var section string
+	var tool string
+	if runtime.GOOS == osDARWIN {
+		section = DarwinSegmentName + "," + darwinSection
+		tool = "ld"
+		err = InjectMachOSection(objFile, DarwinSegmentName, darwinSection, contents)
+	} else {
+		section = elfSection
+		tool = "objcopy"
+		err = InjectELFSection(objFile, elfSection, contents)
+	}
+	if err == nil {
+		return true
+	}
+	if LLVMInjectionFallback == "" {
+		LogWarning("attachBitcodePathToObject: adding the %v section failed because %v\n", section, err)
+		return
+	}
+	LogInfo("attachBitcodePathToObject: adding the %v section failed because %v, falling back to %v\n", section, err, tool)
+	return injectSectionWithTool(objFile, elfSection, darwinSection, contents)
+}
+
+// Writes the contents into the given section of the object file using objcopy, or ld on OSX.
+func injectSectionWithTool(objFile string, elfSection string, darwinSection string, contents []byte) (success bool) {
 	tmpFile, err := os.CreateTemp("", "gllvm")
 	if err != nil {
 		LogError("attachBitcodePathToObject: %v\n", err)
 		return
 	}
 	defer CheckDefer(func() error { return os.Remove(tmpFile.Name()) })
-	if _, err := tmpFile.Write(tmpContent); err != nil {
+	if _, err := tmpFile.Write(contents); err != nil {
 		LogError("attachBitcodePathToObject: %v\n", err)
 		return
 	}
@@ -214,14 +318,14 @@ func injectPath(extension, bcFile, objFile string) (success bool) {
 		} else {
 			attachCmd = "ld"
 		}
-		attachCmdArgs = []string{"-r", "-keep_private_externs", objFile, "-sectcreate", DarwinSegmentName, DarwinSectionName, tmpFile.Name(), "-o", objFile}
+		attachCmdArgs = []string{"-r", "-keep_private_externs", objFile, "-sectcreate", DarwinSegmentName, darwinSection, tmpFile.Name(), "-o", objFile}
 	} else {
 		if len(LLVMObjcopy) > 0 {
 			attachCmd = LLVMObjcopy
 		} else {
 			attachCmd = "objcopy"
 		}
-		attachCmdArgs = []string{"--add-section", ELFSectionName + "=" + tmpFile.Name(), objFile}
+		attachCmdArgs = []string{"--add-section", elfSection + "=" + tmpFile.Name(), objFile}
 	}
 
 	// Run the attach command and ignore errors
@@ -230,26 +334,6 @@ func injectPath(extension, bcFile, objFile string) (success bool) {
 		LogWarning("attachBitcodePathToObject: %v %v failed because %v\n", attachCmd, attachCmdArgs, nerr)
 		return
 	}
-
-	// Copy bitcode file to store, if necessary
-	if bcStorePath := LLVMBitcodeStorePath; bcStorePath != "" {
-		destFilePath := path.Join(bcStorePath, getHashedPath(absBcPath))
-		in, _ := os.Open(absBcPath)
-		defer CheckDefer(func() error { return in.Close() })
-		out, _ := os.Create(destFilePath)
-		defer CheckDefer(func() error { return out.Close() })
-		_, err := io.Copy(out, in)
-		if err != nil {
-			LogWarning("Copying bc to bitcode archive %v failed because %v\n", destFilePath, err)
-			return
-		}
-		err = out.Sync()
-		if err != nil {
-			LogWarning("Syncing bitcode archive %v failed because %v\n", destFilePath, err)
-			return
-		}
-
-	}
 	success = true
 	return
 }
@@ -276,9 +360,11 @@ func compileTimeLinkFiles(compilerExecName string, pr ParserResult, objFiles []s
 }
 
 // Tries to build the specified source file to object
-func buildObjectFile(compilerExecName string, pr ParserResult, srcFile string, objFile string) (success bool) {
+func buildObjectFile(compilerExecName string, pr ParserResult, srcIndex int, objFile string) (success bool) {
+	srcFile := pr.InputFiles[srcIndex]
 	args := pr.CompileArgs[:]
-	args = append(args, srcFile, "-c", "-o", objFile)
+	args = append(args, pr.inputFileArgs(srcIndex)...)
+	args = append(args, "-c", "-o", objFile)
 	LogDebug("buildObjectFile: %v", args)
 	success, err := execCmd(compilerExecName, args, "")
 	if !success {
@@ -290,11 +376,14 @@ func buildObjectFile(compilerExecName string, pr ParserResult, srcFile string, o
 }
 
 // Tries to build the specified source file to bitcode
-func buildBitcodeFile(compilerExecName string, pr ParserResult, srcFile string, bcFile string) (success bool) {
+func buildBitcodeFile(compilerExecName string, pr ParserResult, srcIndex int, bcFile string) (success bool) {
+	srcFile := pr.InputFiles[srcIndex]
 	args := pr.CompileArgs[:]
 	//iam: 03/24/2020 extend with the LLVM_BITCODE_GENERATION_FLAGS if any.
 	args = append(args, LLVMbcGen...)
-	args = append(args, "-emit-llvm", "-c", srcFile, "-o", bcFile)
+	args = append(args, "-emit-llvm", "-c")
+	args = append(args, pr.inputFileArgs(srcIndex)...)
+	args = append(args, "-o", bcFile)
 	success, err := execCmd(compilerExecName, args, "")
 	if !success {
 		LogError("Failed to build bitcode file for %s because: %v\n", srcFile, err)
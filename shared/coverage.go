@@ -0,0 +1,148 @@
+//
+// OCCAM
+//
+// Copyright (c) 2017, SRI International
+//
+//  All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// * Neither the name of SRI International nor the names of its contributors may
+//   be used to endorse or promote products derived from this software without
+//   specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+//
+
+package shared
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// CoverageEntry says what became of the bitcode of an object, or archive member, during extraction.
+// An object without a bitcode section gets an entry with just its name.
+type CoverageEntry struct {
+	Object   string `json:"object"`             // the object, archive member, or binary the bitcode was recorded in
+	Section  bool   `json:"section"`            // whether it had a bitcode section at all
+	Bitcode  string `json:"bitcode,omitempty"`  // the recorded path of the bitcode file
+	Found    bool   `json:"found"`              // whether the bitcode file was found
+	Location string `json:"location,omitempty"` // where it was found, the recorded path, the store, or embedded
+}
+
+// CoverageReport is the coverage of the extracted module: how much of the bitcode made it in.
+type CoverageReport struct {
+	Entries  []CoverageEntry `json:"entries"`
+	Found    int             `json:"found"`
+	Total    int             `json:"total"`
+	Coverage float64         `json:"coverage"` // the percentage of the entries whose bitcode was found
+}
+
+// coverageRecorder collects the coverage entries over the course of an extraction.
+type coverageRecorder struct {
+	entries []CoverageEntry
+}
+
+func (cr *coverageRecorder) noSection(object string) {
+	if cr == nil {
+		return
+	}
+	cr.entries = append(cr.entries, CoverageEntry{Object: object})
+}
+
+func (cr *coverageRecorder) bitcode(object string, record BitcodeRecord, location string, embedded bool) {
+	if cr == nil {
+		return
+	}
+	entry := CoverageEntry{Object: object, Section: true, Bitcode: record.Path, Found: location != ""}
+	if embedded {
+		entry.Location = "embedded"
+	} else {
+		entry.Location = location
+	}
+	cr.entries = append(cr.entries, entry)
+}
+
+func (cr *coverageRecorder) report() (report CoverageReport) {
+	report.Entries = cr.entries
+	report.Total = len(cr.entries)
+	for _, entry := range cr.entries {
+		if entry.Found {
+			report.Found++
+		}
+	}
+	if report.Total > 0 {
+		report.Coverage = 100 * float64(report.Found) / float64(report.Total)
+	}
+	return
+}
+
+// Text renders the report one entry per line, followed by the overall coverage.
+func (report CoverageReport) Text() string {
+	var sb strings.Builder
+	for _, entry := range report.Entries {
+		switch {
+		case !entry.Section:
+			fmt.Fprintf(&sb, "%s: no bitcode section\n", entry.Object)
+		case !entry.Found:
+			fmt.Fprintf(&sb, "%s: %s missing\n", entry.Object, entry.Bitcode)
+		case entry.Location == entry.Bitcode:
+			fmt.Fprintf(&sb, "%s: %s found\n", entry.Object, entry.Bitcode)
+		default:
+			fmt.Fprintf(&sb, "%s: %s found (%s)\n", entry.Object, entry.Bitcode, entry.Location)
+		}
+	}
+	fmt.Fprintf(&sb, "Coverage: %d of %d (%.1f%%)\n", report.Found, report.Total, report.Coverage)
+	return sb.String()
+}
+
+// writeCoverage writes the coverage report, as JSON if the file name ends in .json, and checks it
+// against the minimum coverage.
+func writeCoverage(ea ExtractionArgs) (success bool) {
+	report := ea.coverage.report()
+	if ea.CoverageFile != "" {
+		var contents []byte
+		if strings.HasSuffix(ea.CoverageFile, ".json") {
+			var err error
+			if contents, err = json.MarshalIndent(report, "", "  "); err != nil {
+				LogError("Could not encode the coverage report: %v\n", err)
+				return
+			}
+			contents = append(contents, '\n')
+		} else {
+			contents = []byte(report.Text())
+		}
+		if err := os.WriteFile(ea.CoverageFile, contents, 0644); err != nil {
+			LogError("There was an error while writing the coverage report: %v\n", err)
+			return
+		}
+		informUser("Coverage report written to %s.\n", ea.CoverageFile)
+	}
+	informUser("Bitcode coverage: %d of %d (%.1f%%).\n", report.Found, report.Total, report.Coverage)
+	if report.Coverage < ea.MinCoverage {
+		LogError("The bitcode coverage %.1f%% is below the minimum of %.1f%%.\n", report.Coverage, ea.MinCoverage)
+		return
+	}
+	success = true
+	return
+}
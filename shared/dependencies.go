@@ -0,0 +1,298 @@
+//
+// OCCAM
+//
+// Copyright (c) 2017, SRI International
+//
+//  All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// * Neither the name of SRI International nor the names of its contributors may
+//   be used to endorse or promote products derived from this software without
+//   specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+//
+
+package shared
+
+import (
+	"debug/elf"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// The directories the dynamic linker searches last.
+var defaultLibraryDirs = []string{"/lib", "/usr/lib", "/lib64", "/usr/lib64", "/usr/local/lib"}
+
+// The configuration of the directories the dynamic linker searches, by way of its cache, before the default ones.
+const ldSoConf = "/etc/ld.so.conf"
+
+// multiarchTriplets are the Debian multiarch names of the machines, and so of their library directories.
+var multiarchTriplets = map[elf.Machine]map[elf.Class][]string{
+	elf.EM_X86_64:  {elf.ELFCLASS64: {"x86_64-linux-gnu"}, elf.ELFCLASS32: {"x86_64-linux-gnux32"}},
+	elf.EM_386:     {elf.ELFCLASS32: {"i386-linux-gnu"}},
+	elf.EM_AARCH64: {elf.ELFCLASS64: {"aarch64-linux-gnu"}},
+	elf.EM_ARM:     {elf.ELFCLASS32: {"arm-linux-gnueabihf", "arm-linux-gnueabi"}},
+	elf.EM_PPC64:   {elf.ELFCLASS64: {"powerpc64le-linux-gnu", "powerpc64-linux-gnu"}},
+	elf.EM_S390:    {elf.ELFCLASS64: {"s390x-linux-gnu"}},
+	elf.EM_RISCV:   {elf.ELFCLASS64: {"riscv64-linux-gnu"}},
+	elf.EM_MIPS:    {elf.ELFCLASS32: {"mipsel-linux-gnu", "mips-linux-gnu"}, elf.ELFCLASS64: {"mips64el-linux-gnuabi64"}},
+}
+
+// handleDependencies extracts the bitcode of an ELF executable, or shared library, along with that of the shared
+// libraries it depends on that have some. Either it all goes into the one module, or each library gets a module
+// of its own, and a manifest says which is which.
+func handleDependencies(ea ExtractionArgs) (success bool) {
+	dependencies, err := elfDependencies(ea.InputFile)
+	if err != nil {
+		LogError("Failed to find the shared libraries %s depends on because: %v.\n", ea.InputFile, err)
+		return
+	}
+	var withBitcode []string
+	for _, dependency := range dependencies {
+		if hasELFSection(dependency, ELFSectionName) || hasELFSection(dependency, ELFBitcodeSectionName) {
+			withBitcode = append(withBitcode, dependency)
+		} else {
+			LogInfo("handleDependencies: %s has no bitcode\n", dependency)
+		}
+	}
+	LogInfo("handleDependencies: %s depends on %v, of which %v have bitcode\n", ea.InputFile, dependencies, withBitcode)
+
+	if !ea.SplitDependencies {
+		ea.dependencies = withBitcode
+		return handleExecutable(ea)
+	}
+
+	if !handleExecutable(ea) {
+		return
+	}
+	manifest := []string{ea.InputFile + "\t" + ea.OutputFile}
+	for _, dependency := range withBitcode {
+		dependencyArgs := ea
+		dependencyArgs.InputFile = dependency
+		dependencyArgs.OutputFile = filepath.Join(filepath.Dir(ea.OutputFile), filepath.Base(dependency)+".bc")
+		dependencyArgs.WriteManifest = false
+		dependencyArgs.archives = nil
+		if !handleExecutable(dependencyArgs) {
+			LogError("Failed to extract the bitcode of %s.\n", dependency)
+			return
+		}
+		manifest = append(manifest, dependency+"\t"+dependencyArgs.OutputFile)
+	}
+	manifestFile := ea.OutputFile + ".deps.manifest"
+	if err = os.WriteFile(manifestFile, []byte(strings.Join(manifest, "\n")+"\n"), 0644); err != nil {
+		LogError("There was an error while writing the manifest file: %v", err)
+		return
+	}
+	informUser("Manifest of the modules written to %s.\n", manifestFile)
+	success = true
+	return
+}
+
+func hasELFSection(path string, name string) bool {
+	elfFile, err := elf.Open(path)
+	if err != nil {
+		return false
+	}
+	defer CheckDefer(func() error { return elfFile.Close() })
+	return elfFile.Section(name) != nil
+}
+
+// elfDependencies returns the shared libraries the ELF file depends on, directly or not, as the dynamic
+// linker would find them: by the DT_RPATH, LD_LIBRARY_PATH, DT_RUNPATH, the directories of ld.so.conf, the multiarch
+// directories, and the default directories.
+func elfDependencies(path string) (dependencies []string, err error) {
+	root, err := elf.Open(path)
+	if err != nil {
+		return
+	}
+	class, machine := root.Class, root.Machine
+	// the executable's DT_RPATH also applies to the libraries without a DT_RUNPATH of their own
+	rootRpath, _ := root.DynString(elf.DT_RPATH)
+	rootRunpath, _ := root.DynString(elf.DT_RUNPATH)
+	CheckDefer(func() error { return root.Close() })
+	if len(rootRunpath) > 0 {
+		rootRpath = nil
+	}
+	rootRpath = expandOrigin(rootRpath, path)
+
+	realPath, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return
+	}
+	// the dynamic linker's cache holds the libraries of the directories in ld.so.conf, and the multiarch ones
+	systemDirs := ldSoConfDirs(ldSoConf, make(map[string]bool))
+	for _, triplet := range multiarchTriplets[machine][class] {
+		systemDirs = append(systemDirs, filepath.Join("/lib", triplet), filepath.Join("/usr/lib", triplet))
+	}
+	systemDirs = append(systemDirs, defaultLibraryDirs...)
+
+	seen := map[string]bool{realPath: true}
+	queue := []string{realPath}
+	for len(queue) > 0 {
+		current := queue[0]
+		queue = queue[1:]
+		needed, rpath, runpath, dynErr := dynamicEntries(current)
+		if dynErr != nil {
+			LogWarning("Could not read the dynamic section of %s: %v.\n", current, dynErr)
+			continue
+		}
+		var searchPath []string
+		if len(runpath) == 0 {
+			searchPath = append(searchPath, expandOrigin(rpath, current)...)
+			searchPath = append(searchPath, rootRpath...)
+		}
+		searchPath = append(searchPath, filepath.SplitList(os.Getenv("LD_LIBRARY_PATH"))...)
+		searchPath = append(searchPath, expandOrigin(runpath, current)...)
+		searchPath = append(searchPath, systemDirs...)
+
+		for _, name := range needed {
+			library := findSharedLibrary(name, current, searchPath, class, machine)
+			if library == "" {
+				LogWarning("Could not find %s, needed by %s, so its bitcode is not followed.\n", name, current)
+				continue
+			}
+			if seen[library] {
+				continue
+			}
+			seen[library] = true
+			dependencies = append(dependencies, library)
+			queue = append(queue, library)
+		}
+	}
+	return
+}
+
+// ldSoConfDirs returns the directories listed in the ld.so.conf file, and in the files it includes.
+func ldSoConfDirs(conf string, visited map[string]bool) (dirs []string) {
+	if visited[conf] {
+		return
+	}
+	visited[conf] = true
+	contents, err := os.ReadFile(conf)
+	if err != nil {
+		LogDebug("ldSoConfDirs: %v\n", err)
+		return
+	}
+	for _, line := range strings.Split(string(contents), "\n") {
+		if comment := strings.IndexByte(line, '#'); comment >= 0 {
+			line = line[:comment]
+		}
+		fields := strings.FieldsFunc(line, func(r rune) bool { return r == ' ' || r == '\t' || r == ',' || r == ':' })
+		if len(fields) == 0 {
+			continue
+		}
+		if fields[0] == "include" {
+			for _, pattern := range fields[1:] {
+				if !filepath.IsAbs(pattern) {
+					pattern = filepath.Join(filepath.Dir(conf), pattern)
+				}
+				included, _ := filepath.Glob(pattern)
+				for _, file := range included {
+					dirs = append(dirs, ldSoConfDirs(file, visited)...)
+				}
+			}
+			continue
+		}
+		if fields[0] == "hwcap" {
+			continue
+		}
+		for _, dir := range fields {
+			// libc5 era entries may carry a library type, dir=TYPE
+			if equals := strings.IndexByte(dir, '='); equals >= 0 {
+				dir = dir[:equals]
+			}
+			dirs = append(dirs, dir)
+		}
+	}
+	return
+}
+
+// dynamicEntries returns the DT_NEEDED entries of the ELF file, and its search paths.
+func dynamicEntries(path string) (needed []string, rpath []string, runpath []string, err error) {
+	elfFile, err := elf.Open(path)
+	if err != nil {
+		return
+	}
+	defer CheckDefer(func() error { return elfFile.Close() })
+	if needed, err = elfFile.DynString(elf.DT_NEEDED); err != nil {
+		return
+	}
+	if rpath, err = elfFile.DynString(elf.DT_RPATH); err != nil {
+		return
+	}
+	runpath, err = elfFile.DynString(elf.DT_RUNPATH)
+	return
+}
+
+// expandOrigin splits the search path entries, and replaces $ORIGIN with the directory of the file they belong to.
+func expandOrigin(entries []string, path string) (dirs []string) {
+	origin := filepath.Dir(path)
+	for _, entry := range entries {
+		for _, dir := range filepath.SplitList(entry) {
+			dir = strings.Replace(dir, "${ORIGIN}", origin, -1)
+			dir = strings.Replace(dir, "$ORIGIN", origin, -1)
+			dirs = append(dirs, dir)
+		}
+	}
+	return
+}
+
+// findSharedLibrary returns the real path of the first library of the right class and machine on the search path.
+func findSharedLibrary(name string, neededBy string, searchPath []string, class elf.Class, machine elf.Machine) string {
+	var candidates []string
+	if strings.Contains(name, "/") {
+		if !filepath.IsAbs(name) {
+			name = filepath.Join(filepath.Dir(neededBy), name)
+		}
+		candidates = []string{name}
+	} else {
+		for _, dir := range searchPath {
+			if dir != "" {
+				candidates = append(candidates, filepath.Join(dir, name))
+			}
+		}
+	}
+	for _, candidate := range candidates {
+		if err := compatibleELF(candidate, class, machine); err != nil {
+			LogDebug("findSharedLibrary: skipping %s: %v\n", candidate, err)
+			continue
+		}
+		if realPath, err := filepath.EvalSymlinks(candidate); err == nil {
+			return realPath
+		}
+	}
+	return ""
+}
+
+func compatibleELF(path string, class elf.Class, machine elf.Machine) error {
+	elfFile, err := elf.Open(path)
+	if err != nil {
+		return err
+	}
+	defer CheckDefer(func() error { return elfFile.Close() })
+	if elfFile.Class != class || elfFile.Machine != machine {
+		return fmt.Errorf("it is a %v %v library", elfFile.Class, elfFile.Machine)
+	}
+	return nil
+}
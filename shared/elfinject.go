@@ -0,0 +1,351 @@
+//
+// OCCAM
+//
+// Copyright (c) 2017, SRI International
+//
+//  All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// * Neither the name of SRI International nor the names of its contributors may
+//   be used to endorse or promote products derived from this software without
+//   specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+//
+
+package shared
+
+import (
+	"bytes"
+	"debug/elf"
+	"encoding/binary"
+	"fmt"
+	"os"
+)
+
+// InjectELFSection adds a section with the given name and contents to the
+// relocatable ELF object objFile, which is rewritten in place. If the object
+// already has a section with that name the contents are appended to it, much
+// as the linker would do. Both classes and both byte orders are supported, so
+// this works when cross compiling too.
+func InjectELFSection(objFile string, sectionName string, contents []byte) (err error) {
+	info, err := os.Stat(objFile)
+	if err != nil {
+		return
+	}
+	data, err := os.ReadFile(objFile)
+	if err != nil {
+		return
+	}
+	injected, err := injectELFSection(data, sectionName, contents)
+	if err != nil {
+		return fmt.Errorf("%s: %v", objFile, err)
+	}
+	return writeFileAtomically(objFile, injected, info.Mode().Perm())
+}
+
+// elfImage is the section header table of an ELF file, with the 32 bit
+// flavor widened to 64 bits.
+type elfImage struct {
+	class    elf.Class
+	order    binary.ByteOrder
+	header   elf.Header64
+	sections []elf.Section64
+	shstrndx uint32
+}
+
+func injectELFSection(data []byte, sectionName string, contents []byte) (injected []byte, err error) {
+	image, err := readELFImage(data)
+	if err != nil {
+		return
+	}
+	if elf.Type(image.header.Type) != elf.ET_REL {
+		err = fmt.Errorf("not a relocatable object (type %v)", elf.Type(image.header.Type))
+		return
+	}
+	if image.shstrndx >= uint32(len(image.sections)) {
+		err = fmt.Errorf("bad section name table index %v", image.shstrndx)
+		return
+	}
+	shstrtab := image.sections[image.shstrndx]
+	if shstrtab.Off+shstrtab.Size > uint64(len(data)) {
+		err = fmt.Errorf("section name table is out of bounds")
+		return
+	}
+	names := data[shstrtab.Off : shstrtab.Off+shstrtab.Size]
+
+	// the old contents are left where they are, we just append the new ones
+	// (and if need be a new section name table) and a new section header table.
+	var out bytes.Buffer
+	out.Write(data)
+
+	existing := -1
+	for i, section := range image.sections {
+		if elfString(names, section.Name) == sectionName && section.Type != uint32(elf.SHT_NOBITS) {
+			existing = i
+			break
+		}
+	}
+
+	if existing >= 0 {
+		old := image.sections[existing]
+		if old.Off+old.Size > uint64(len(data)) {
+			err = fmt.Errorf("section %v is out of bounds", sectionName)
+			return
+		}
+		image.sections[existing].Off = uint64(out.Len())
+		image.sections[existing].Size = old.Size + uint64(len(contents))
+		out.Write(data[old.Off : old.Off+old.Size])
+		out.Write(contents)
+	} else {
+		section := elf.Section64{
+			Type:      uint32(elf.SHT_PROGBITS),
+			Off:       uint64(out.Len()),
+			Size:      uint64(len(contents)),
+			Addralign: 1,
+		}
+		out.Write(contents)
+
+		newNames := make([]byte, 0, len(names)+len(sectionName)+1)
+		newNames = append(newNames, names...)
+		section.Name = uint32(len(newNames))
+		newNames = append(newNames, sectionName...)
+		newNames = append(newNames, 0)
+		image.sections[image.shstrndx].Off = uint64(out.Len())
+		image.sections[image.shstrndx].Size = uint64(len(newNames))
+		out.Write(newNames)
+
+		image.sections = append(image.sections, section)
+	}
+
+	align := 8
+	if image.class == elf.ELFCLASS32 {
+		align = 4
+	}
+	for out.Len()%align != 0 {
+		out.WriteByte(0)
+	}
+	image.header.Shoff = uint64(out.Len())
+	if err = image.writeSections(&out); err != nil {
+		return
+	}
+	injected = out.Bytes()
+	if err = image.writeHeader(injected); err != nil {
+		return
+	}
+	return
+}
+
+func elfString(table []byte, offset uint32) string {
+	if offset >= uint32(len(table)) {
+		return ""
+	}
+	end := bytes.IndexByte(table[offset:], 0)
+	if end < 0 {
+		return ""
+	}
+	return string(table[offset : offset+uint32(end)])
+}
+
+func readELFImage(data []byte) (image elfImage, err error) {
+	if len(data) < elf.EI_NIDENT || !bytes.HasPrefix(data, []byte(elf.ELFMAG)) {
+		err = fmt.Errorf("not an ELF file")
+		return
+	}
+	image.class = elf.Class(data[elf.EI_CLASS])
+	switch elf.Data(data[elf.EI_DATA]) {
+	case elf.ELFDATA2LSB:
+		image.order = binary.LittleEndian
+	case elf.ELFDATA2MSB:
+		image.order = binary.BigEndian
+	default:
+		err = fmt.Errorf("unknown ELF data encoding %v", data[elf.EI_DATA])
+		return
+	}
+	reader := bytes.NewReader(data)
+	var shentsize int
+	switch image.class {
+	case elf.ELFCLASS64:
+		if err = binary.Read(reader, image.order, &image.header); err != nil {
+			return
+		}
+		shentsize = binary.Size(elf.Section64{})
+	case elf.ELFCLASS32:
+		var header elf.Header32
+		if err = binary.Read(reader, image.order, &header); err != nil {
+			return
+		}
+		image.header = elf.Header64{
+			Ident:     header.Ident,
+			Type:      header.Type,
+			Machine:   header.Machine,
+			Version:   header.Version,
+			Entry:     uint64(header.Entry),
+			Phoff:     uint64(header.Phoff),
+			Shoff:     uint64(header.Shoff),
+			Flags:     header.Flags,
+			Ehsize:    header.Ehsize,
+			Phentsize: header.Phentsize,
+			Phnum:     header.Phnum,
+			Shentsize: header.Shentsize,
+			Shnum:     header.Shnum,
+			Shstrndx:  header.Shstrndx,
+		}
+		shentsize = binary.Size(elf.Section32{})
+	default:
+		err = fmt.Errorf("unknown ELF class %v", image.class)
+		return
+	}
+	if image.header.Shoff == 0 {
+		err = fmt.Errorf("no section header table")
+		return
+	}
+	if int(image.header.Shentsize) != shentsize {
+		err = fmt.Errorf("unexpected section header size %v", image.header.Shentsize)
+		return
+	}
+
+	first, err := image.readSection(data, 0)
+	if err != nil {
+		return
+	}
+	// extended numbering: the real values live in the first section header.
+	count := uint64(image.header.Shnum)
+	if count == 0 {
+		count = first.Size
+	}
+	image.shstrndx = uint32(image.header.Shstrndx)
+	if image.header.Shstrndx == uint16(elf.SHN_XINDEX) {
+		image.shstrndx = first.Link
+	}
+	if image.header.Shoff+count*uint64(shentsize) > uint64(len(data)) {
+		err = fmt.Errorf("section header table is out of bounds")
+		return
+	}
+	image.sections = make([]elf.Section64, count)
+	for i := range image.sections {
+		if image.sections[i], err = image.readSection(data, i); err != nil {
+			return
+		}
+	}
+	return
+}
+
+func (image *elfImage) readSection(data []byte, index int) (section elf.Section64, err error) {
+	offset := int64(image.header.Shoff) + int64(index)*int64(image.header.Shentsize)
+	if offset < 0 || offset+int64(image.header.Shentsize) > int64(len(data)) {
+		err = fmt.Errorf("section header %v is out of bounds", index)
+		return
+	}
+	reader := bytes.NewReader(data[offset:])
+	if image.class == elf.ELFCLASS64 {
+		err = binary.Read(reader, image.order, &section)
+		return
+	}
+	var section32 elf.Section32
+	if err = binary.Read(reader, image.order, &section32); err != nil {
+		return
+	}
+	section = elf.Section64{
+		Name:      section32.Name,
+		Type:      section32.Type,
+		Flags:     uint64(section32.Flags),
+		Addr:      uint64(section32.Addr),
+		Off:       uint64(section32.Off),
+		Size:      uint64(section32.Size),
+		Link:      section32.Link,
+		Info:      section32.Info,
+		Addralign: uint64(section32.Addralign),
+		Entsize:   uint64(section32.Entsize),
+	}
+	return
+}
+
+func (image *elfImage) writeSections(out *bytes.Buffer) (err error) {
+	sections := image.sections
+	// extended numbering kicks in once the counts no longer fit.
+	if len(sections) >= int(elf.SHN_LORESERVE) {
+		image.header.Shnum = 0
+		sections[0].Size = uint64(len(sections))
+	} else {
+		image.header.Shnum = uint16(len(sections))
+	}
+	if image.shstrndx >= uint32(elf.SHN_LORESERVE) {
+		image.header.Shstrndx = uint16(elf.SHN_XINDEX)
+		sections[0].Link = image.shstrndx
+	} else {
+		image.header.Shstrndx = uint16(image.shstrndx)
+	}
+	for _, section := range sections {
+		if image.class == elf.ELFCLASS64 {
+			err = binary.Write(out, image.order, section)
+		} else {
+			err = binary.Write(out, image.order, elf.Section32{
+				Name:      section.Name,
+				Type:      section.Type,
+				Flags:     uint32(section.Flags),
+				Addr:      uint32(section.Addr),
+				Off:       uint32(section.Off),
+				Size:      uint32(section.Size),
+				Link:      section.Link,
+				Info:      section.Info,
+				Addralign: uint32(section.Addralign),
+				Entsize:   uint32(section.Entsize),
+			})
+		}
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+func (image *elfImage) writeHeader(data []byte) (err error) {
+	var header bytes.Buffer
+	if image.class == elf.ELFCLASS64 {
+		err = binary.Write(&header, image.order, image.header)
+	} else {
+		if image.header.Shoff > 0xffffffff {
+			return fmt.Errorf("the object is too large for a 32 bit ELF file")
+		}
+		err = binary.Write(&header, image.order, elf.Header32{
+			Ident:     image.header.Ident,
+			Type:      image.header.Type,
+			Machine:   image.header.Machine,
+			Version:   image.header.Version,
+			Entry:     uint32(image.header.Entry),
+			Phoff:     uint32(image.header.Phoff),
+			Shoff:     uint32(image.header.Shoff),
+			Flags:     image.header.Flags,
+			Ehsize:    image.header.Ehsize,
+			Phentsize: image.header.Phentsize,
+			Phnum:     image.header.Phnum,
+			Shentsize: image.header.Shentsize,
+			Shnum:     image.header.Shnum,
+			Shstrndx:  image.header.Shstrndx,
+		})
+	}
+	if err != nil {
+		return
+	}
+	copy(data, header.Bytes())
+	return
+}
@@ -0,0 +1,120 @@
+//
+// OCCAM
+//
+// Copyright (c) 2017, SRI International
+//
+//  All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// * Neither the name of SRI International nor the names of its contributors may
+//   be used to endorse or promote products derived from this software without
+//   specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+//
+
+package shared
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// The layout of an embedded bitcode record is:
+//
+//	magic (4 bytes) | path length (uint32) | data length (uint64) | path | zlib compressed bitcode
+//
+// all integers being little endian. Records are simply concatenated, which is what the linker does
+// when it merges the sections of the objects, perhaps with some zero padding in between.
+const embeddedMagic = "GLBC"
+
+const embeddedHeaderSize = 4 + 4 + 8
+
+// EmbeddedBitcode is a bitcode file carried inside the object it was compiled alongside.
+type EmbeddedBitcode struct {
+	Path    string // the path the bitcode file had when it was embedded
+	Bitcode []byte // the uncompressed contents of the bitcode file
+}
+
+// EncodeEmbeddedBitcode returns the record that embeds the bitcode, originally found at path, in an object.
+func EncodeEmbeddedBitcode(path string, bitcode []byte) (record []byte, err error) {
+	var compressed bytes.Buffer
+	writer := zlib.NewWriter(&compressed)
+	if _, err = writer.Write(bitcode); err != nil {
+		return
+	}
+	if err = writer.Close(); err != nil {
+		return
+	}
+	header := make([]byte, embeddedHeaderSize)
+	copy(header, embeddedMagic)
+	binary.LittleEndian.PutUint32(header[4:], uint32(len(path)))
+	binary.LittleEndian.PutUint64(header[8:], uint64(compressed.Len()))
+	record = append(header, path...)
+	record = append(record, compressed.Bytes()...)
+	return
+}
+
+// DecodeEmbeddedBitcode returns the bitcode files embedded in the contents of a section.
+func DecodeEmbeddedBitcode(data []byte) (modules []EmbeddedBitcode, err error) {
+	for offset := 0; offset < len(data); {
+		if data[offset] == 0 {
+			// padding between the sections of two objects
+			offset++
+			continue
+		}
+		if len(data)-offset < embeddedHeaderSize || string(data[offset:offset+4]) != embeddedMagic {
+			err = fmt.Errorf("no embedded bitcode record at offset %v", offset)
+			return
+		}
+		pathLength := uint64(binary.LittleEndian.Uint32(data[offset+4:]))
+		dataLength := binary.LittleEndian.Uint64(data[offset+8:])
+		start := uint64(offset + embeddedHeaderSize)
+		// the lengths are checked one at a time, their sum could overflow
+		remaining := uint64(len(data)) - start
+		if pathLength > remaining || dataLength > remaining-pathLength {
+			err = fmt.Errorf("truncated embedded bitcode record at offset %v", offset)
+			return
+		}
+		path := string(data[start : start+pathLength])
+		compressed := data[start+pathLength : start+pathLength+dataLength]
+		var bitcode []byte
+		if bitcode, err = inflate(compressed); err != nil {
+			err = fmt.Errorf("embedded bitcode of %v is corrupt: %v", path, err)
+			return
+		}
+		modules = append(modules, EmbeddedBitcode{Path: path, Bitcode: bitcode})
+		offset = int(start + pathLength + dataLength)
+	}
+	return
+}
+
+func inflate(compressed []byte) (data []byte, err error) {
+	reader, err := zlib.NewReader(bytes.NewReader(compressed))
+	if err != nil {
+		return
+	}
+	defer CheckDefer(func() error { return reader.Close() })
+	return io.ReadAll(reader)
+}
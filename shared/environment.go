@@ -48,6 +48,12 @@ const (
 
 	//DarwinSectionName is the name of our MACH-O section of "bitcode paths".
 	DarwinSectionName = "__llvm_bc"
+
+	//ELFBitcodeSectionName is the name of our ELF section of embedded bitcode.
+	ELFBitcodeSectionName = ".llvm_bc_data"
+
+	//DarwinBitcodeSectionName is the name of our MACH-O section of embedded bitcode (in the DarwinSegmentName segment).
+	DarwinBitcodeSectionName = "__llvm_bc_data"
 )
 
 // LLVMToolChainBinDir is the user configured directory holding the LLVM binary tools.
@@ -68,6 +74,9 @@ var LLVMARName string
 // LLVMLINKName is the user configured name of the llvm-link.
 var LLVMLINKName string
 
+// LLVMNMName is the user configured name of the llvm-nm.
+var LLVMNMName string
+
 // LLVMLINKFlags is the user configured list of flags to append to llvm-link.
 var LLVMLINKFlags []string
 
@@ -89,6 +98,28 @@ var LLVMObjcopy string
 // LLVMLd is the path to the ld executable used to attach the bitcode on OSX.
 var LLVMLd string
 
+// LLVMInjectionFallback is the user configured flag indicating that the external tools should be used
+// to attach the bitcode when we fail to do it ourselves.
+var LLVMInjectionFallback string
+
+// LLVMStoreLocking is the user configured flag indicating that writes into the bitcode store should
+// be serialized with file locks.
+var LLVMStoreLocking string
+
+// LLVMCompileCommands is the user configured compilation database (a JSON file), or directory of fragments of one,
+// that the compiler wrappers should add their commands to.
+var LLVMCompileCommands string
+
+// LLVMBuildLog is the user configured directory in which to record every compilation and link.
+var LLVMBuildLog string
+
+// LLVMFlagsFile is the user configured JSON file of compiler flags that extends, or replaces, the built-in ones.
+var LLVMFlagsFile string
+
+// LLVMEmbedBitcode is the user configured flag indicating that the bitcode itself, and not just its path,
+// should be embedded in the object files.
+var LLVMEmbedBitcode string
+
 // LLVMbcGen is the list of args to pass to clang during the bitcode generation step.
 var LLVMbcGen []string
 
@@ -103,12 +134,19 @@ const (
 	envar      = "LLVM_AR_NAME"
 	envlnk     = "LLVM_LINK_NAME"
 	envlnkflgs = "LLVM_LINK_FLAGS"
+	envnm      = "LLVM_NM_NAME"
 	envcfg     = "WLLVM_CONFIGURE_ONLY"
 	envbc      = "WLLVM_BC_STORE"
 	envlvl     = "WLLVM_OUTPUT_LEVEL"
 	envfile    = "WLLVM_OUTPUT_FILE"
 	envld      = "GLLVM_LD"      //iam: we are deviating from wllvm here.
 	envobjcopy = "GLLVM_OBJCOPY" //iam: we are deviating from wllvm here.
+	envinject  = "GLLVM_INJECTION_FALLBACK"
+	envembed   = "GLLVM_EMBED_BITCODE"
+	envlock    = "GLLVM_STORE_LOCK"
+	envcompdb  = "GLLVM_COMPILE_COMMANDS"
+	envblog    = "GLLVM_BUILD_LOG"
+	envflags   = "GLLVM_FLAGS_FILE"
 	//wllvm uses a BINUTILS_TARGET_PREFIX, which seems less general.
 	//iam: 03/24/2020 new feature to pass things like "-flto -fwhole-program-vtables"
 	// to clang during the bitcode generation step
@@ -124,7 +162,7 @@ func init() {
 
 // PrintEnvironment is used for printing the aspects of the environment that concern us
 func PrintEnvironment() {
-	vars := []string{envpath, envcc, envcxx, envf, envar, envlnk, envcfg, envbc, envlvl, envfile, envobjcopy, envld, envbcgen, envltolink}
+	vars := []string{envpath, envcc, envcxx, envf, envar, envlnk, envnm, envcfg, envbc, envlvl, envfile, envobjcopy, envld, envinject, envembed, envlock, envcompdb, envblog, envflags, envbcgen, envltolink}
 
 	informUser("\nLiving in this environment:\n\n")
 	for _, v := range vars {
@@ -146,6 +184,7 @@ func ResetEnvironment() {
 	LLVMFName = ""
 	LLVMARName = ""
 	LLVMLINKName = ""
+	LLVMNMName = ""
 	LLVMLINKFlags = []string{}
 	LLVMConfigureOnly = ""
 	LLVMBitcodeStorePath = ""
@@ -153,6 +192,12 @@ func ResetEnvironment() {
 	LLVMLoggingFile = ""
 	LLVMObjcopy = ""
 	LLVMLd = ""
+	LLVMInjectionFallback = ""
+	LLVMEmbedBitcode = ""
+	LLVMStoreLocking = ""
+	LLVMCompileCommands = ""
+	LLVMBuildLog = ""
+	LLVMFlagsFile = ""
 	LLVMbcGen = []string{}
 	LLVMLtoLDFLAGS = []string{}
 }
@@ -165,6 +210,7 @@ func FetchEnvironment() {
 	LLVMFName = os.Getenv(envf)
 	LLVMARName = os.Getenv(envar)
 	LLVMLINKName = os.Getenv(envlnk)
+	LLVMNMName = os.Getenv(envnm)
 	LLVMLINKFlags = strings.Fields(os.Getenv(envlnkflgs))
 
 	LLVMConfigureOnly = os.Getenv(envcfg)
@@ -175,6 +221,12 @@ func FetchEnvironment() {
 
 	LLVMObjcopy = os.Getenv(envobjcopy)
 	LLVMLd = os.Getenv(envld)
+	LLVMInjectionFallback = os.Getenv(envinject)
+	LLVMEmbedBitcode = os.Getenv(envembed)
+	LLVMStoreLocking = os.Getenv(envlock)
+	LLVMCompileCommands = os.Getenv(envcompdb)
+	LLVMBuildLog = os.Getenv(envblog)
+	LLVMFlagsFile = os.Getenv(envflags)
 
 	LLVMbcGen = strings.Fields(os.Getenv(envbcgen))
 	LLVMLtoLDFLAGS = strings.Fields(os.Getenv(envltolink))
@@ -39,6 +39,7 @@ import (
 	"debug/macho"
 	"flag"
 	"fmt"
+	"io"
 	"os"
 	"os/exec"
 	"path"
@@ -47,6 +48,7 @@ import (
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
 )
 
 // ExtractionArgs encapsulate the results of parsing the commandline options
@@ -65,9 +67,26 @@ type ExtractionArgs struct {
 	OutputFile          string
 	LlvmLinkerName      string
 	LlvmArchiverName    string
-	ArchiverName        string
-	ArArgs              []string
-	Extractor           func(string) ([]string, bool)
+	ArchiverName        string // no longer used, archives are read natively
+	Arch                string // the architecture to extract from a universal binary
+	FollowDependencies  bool   // extract the bitcode of the shared libraries the input depends on too
+	SplitDependencies   bool   // and put each library's bitcode in a module of its own
+	BuildLog            string // the build log to take the link of the input from
+	LibraryPaths        stringList
+	Libraries           stringList
+	CoverageFile        string  // where to write the coverage report
+	MinCoverage         float64 // fail if less than this percentage of the bitcode is found
+	ReportNative        bool    // report the functions in the input that are not in the module
+	ManifestFormats     string  // the formats to write the manifest in: text, json and csv
+	Jobs                int     // how many archive members to extract, and llvm-links to run, at once
+	Extractor           func(io.ReaderAt, string) ([]BitcodeRecord, bool)
+	EmbeddedExtractor   func(io.ReaderAt, string) ([]EmbeddedBitcode, bool)
+	embedded            *embeddedFiles
+	dependencies        []string // the shared libraries whose bitcode goes into the module too
+	archives            []string // the static libraries whose bitcode goes into the module too
+	coverage            *coverageRecorder
+	manifest            *manifestRecorder
+	manifestFormats     []string
 }
 
 // for printing out the parsed arguments, some have been skipped.
@@ -86,10 +105,22 @@ ea.LlvmArchiverName:   %v
 ea.LlvmLinkerName:     %v
 ea.ArchiverName:       %v
 ea.StrictExtract:      %v
+ea.Arch:               %v
+ea.FollowDependencies: %v
+ea.SplitDependencies:  %v
+ea.BuildLog:           %v
+ea.LibraryPaths:       %v
+ea.Libraries:          %v
+ea.CoverageFile:       %v
+ea.MinCoverage:        %v
+ea.ReportNative:       %v
+ea.ManifestFormats:    %v
+ea.Jobs:               %v
 `
 	return fmt.Sprintf(format, ea.Verbose, ea.WriteManifest, ea.SortBitcodeFiles, ea.BuildBitcodeModule,
 		ea.KeepTemp, ea.LinkArgSize, ea.InputFile, ea.OutputFile, ea.LlvmArchiverName,
-		ea.LlvmLinkerName, ea.ArchiverName, ea.StrictExtract)
+		ea.LlvmLinkerName, ea.ArchiverName, ea.StrictExtract, ea.Arch, ea.FollowDependencies, ea.SplitDependencies,
+		ea.BuildLog, ea.LibraryPaths, ea.Libraries, ea.CoverageFile, ea.MinCoverage, ea.ReportNative, ea.ManifestFormats, ea.Jobs)
 }
 
 // ParseSwitches parses the command line into an ExtractionArgs object.
@@ -103,11 +134,22 @@ func ParseSwitches(args []string) (ea ExtractionArgs) {
 	flagSet.BoolVar(&ea.BuildBitcodeModule, "b", false, "build a bitcode module")
 	flagSet.StringVar(&ea.OutputFile, "o", "", "the output file")
 	flagSet.StringVar(&ea.LlvmArchiverName, "a", "llvm-ar", "the llvm archiver (i.e. llvm-ar)")
-	flagSet.StringVar(&ea.ArchiverName, "r", "ar", "the system archiver (i.e. ar)")
+	flagSet.StringVar(&ea.ArchiverName, "r", "ar", "the system archiver (ignored, archives are read natively)")
 	flagSet.StringVar(&ea.LlvmLinkerName, "l", "llvm-link", "the llvm linker (i.e. llvm-link)")
 	flagSet.IntVar(&ea.LinkArgSize, "n", 0, "maximum llvm-link command line size (in bytes)")
 	flagSet.BoolVar(&ea.KeepTemp, "t", false, "keep temporary linking folder")
-	flagSet.BoolVar(&ea.StrictExtract, "S", false, "exit with an error if extraction fails")
+	flagSet.BoolVar(&ea.StrictExtract, "S", false, "exit with an error if extraction fails, or a bitcode file has changed since it was compiled")
+	flagSet.BoolVar(&ea.FollowDependencies, "d", false, "follow the shared library dependencies (ELF only), and link their bitcode in too")
+	flagSet.BoolVar(&ea.SplitDependencies, "D", false, "follow the shared library dependencies (ELF only), extracting a module for each, and a manifest")
+	flagSet.StringVar(&ea.BuildLog, "log", "", "the build log (GLLVM_BUILD_LOG) to find the static libraries the input was linked against in (ELF only)")
+	flagSet.Var(&ea.LibraryPaths, "L", "a directory to look for the static libraries in (may be repeated, ELF only)")
+	flagSet.Var(&ea.Libraries, "lib", "a static library the input was linked against, whose bitcode goes in too (may be repeated, ELF only)")
+	flagSet.StringVar(&ea.CoverageFile, "coverage", "", "write a report of the bitcode found, and not, to the file (as JSON if it ends in .json)")
+	flagSet.Float64Var(&ea.MinCoverage, "min-coverage", 0, "fail if less than this percentage of the bitcode is found")
+	flagSet.BoolVar(&ea.ReportNative, "native", false, "report the functions in the input that have no bitcode, by comparing the symbols with llvm-nm's")
+	flagSet.StringVar(&ea.ManifestFormats, "manifest-format", "", "write the manifest in these formats (a comma separated list of text, json and csv)")
+	flagSet.IntVar(&ea.Jobs, "j", 1, "how many archive members to extract, and llvm-links to run, at once (0 for one per CPU)")
+	flagSet.StringVar(&ea.Arch, "arch", "", "the architecture to extract from a universal binary (by default each one gets its own module)")
 
 	err := flagSet.Parse(args[1:])
 
@@ -116,6 +158,18 @@ func ParseSwitches(args []string) (ea ExtractionArgs) {
 		return
 	}
 
+	if ea.manifestFormats, err = parseManifestFormats(ea.ManifestFormats); err != nil {
+		LogError("%v\n", err)
+		ea.Failure = true
+		return
+	}
+	if ea.ManifestFormats != "" {
+		ea.WriteManifest = true
+	}
+	if ea.Jobs < 1 {
+		ea.Jobs = runtime.NumCPU()
+	}
+
 	ea.LlvmArchiverName = resolveTool("llvm-ar", LLVMARName, ea.LlvmArchiverName)
 	ea.LlvmLinkerName = resolveTool("llvm-link", LLVMLINKName, ea.LlvmLinkerName)
 	inputFiles := flagSet.Args()
@@ -164,24 +218,51 @@ func Extract(args []string) (exitCode int) {
 	// Create output filename if not given
 	setOutputFile(&ea)
 
+	// Somewhere to put any bitcode we find embedded in the input
+	ea.embedded = &embeddedFiles{}
+	defer ea.embedded.cleanup(ea.KeepTemp)
+
+	if ea.CoverageFile != "" || ea.MinCoverage > 0 {
+		ea.coverage = &coverageRecorder{}
+	}
+
+	staticLibraries := ea.BuildLog != "" || len(ea.LibraryPaths) > 0 || len(ea.Libraries) > 0
+	if staticLibraries && ea.InputType != fileTypeELFEXECUTABLE && ea.InputType != fileTypeELFSHARED {
+		LogWarning("The -log, -L and -lib switches are for ELF executables and shared libraries only, they are ignored for the %v %v.\n",
+			fileTypeNames[ea.InputType], ea.InputFile)
+	}
+
 	switch ea.InputType {
 	case fileTypeELFEXECUTABLE,
-		fileTypeELFSHARED,
-		fileTypeELFOBJECT,
-		fileTypeMACHEXECUTABLE,
+		fileTypeELFSHARED:
+		if ea.BuildLog != "" || len(ea.Libraries) > 0 {
+			if ea.archives, success = linkedArchives(ea); !success {
+				return
+			}
+		}
+		if ea.FollowDependencies || ea.SplitDependencies {
+			success = handleDependencies(ea)
+		} else {
+			success = handleExecutable(ea)
+		}
+	case fileTypeELFOBJECT:
+		success = handleExecutable(ea)
+	case fileTypeMACHEXECUTABLE,
 		fileTypeMACHSHARED,
 		fileTypeMACHOBJECT:
-		success = handleExecutable(ea)
-	case fileTypeARCHIVE:
+		success = handleMachO(ea)
+	case fileTypeARCHIVE, fileTypeTHINARCHIVE:
 		success = handleArchive(ea)
-	case fileTypeTHINARCHIVE:
-		success = handleThinArchive(ea)
 	case fileTypeERROR:
 	default:
-		LogError("Incorrect input file type %v.", ea.InputType)
+		LogError("Incorrect input file type %v.", fileTypeNames[ea.InputType])
 		return
 	}
 
+	if ea.coverage != nil && !writeCoverage(ea) {
+		success = false
+	}
+
 	if success {
 		exitCode = 0
 	}
@@ -194,19 +275,11 @@ func setPlatform(ea *ExtractionArgs) (success bool) {
 	switch platform := runtime.GOOS; platform {
 	case osFREEBSD, osLINUX:
 		ea.Extractor = extractSectionUnix
-		if ea.Verbose {
-			ea.ArArgs = append(ea.ArArgs, "xv")
-		} else {
-			ea.ArArgs = append(ea.ArArgs, "x")
-		}
+		ea.EmbeddedExtractor = extractEmbeddedUnix
 		ea.ObjectTypeInArchive = fileTypeELFOBJECT
 		success = true
 	case osDARWIN:
-		ea.Extractor = extractSectionDarwin
-		ea.ArArgs = append(ea.ArArgs, "-x")
-		if ea.Verbose {
-			ea.ArArgs = append(ea.ArArgs, "-v")
-		}
+		setDarwinExtractors(ea, ea.Arch)
 		ea.ObjectTypeInArchive = fileTypeMACHOBJECT
 		success = true
 	default:
@@ -257,14 +330,70 @@ func resolveTool(defaultPath string, envPath string, usrPath string) (path strin
 	return
 }
 
+// handleMachO extracts the bitcode from a Mach-O file, whatever platform we are on. Universal binaries
+// are handled one architecture at a time, each into its own module, unless a particular one was asked for.
+func handleMachO(ea ExtractionArgs) (success bool) {
+	archs, err := fatArchitectures(ea.InputFile)
+	if err != nil {
+		LogError("Mach-O file %s could not be read because: %v.", ea.InputFile, err)
+		return
+	}
+	if len(archs) == 0 || ea.Arch != "" {
+		setDarwinExtractors(&ea, ea.Arch)
+		return handleExecutable(ea)
+	}
+	LogInfo("handleMachO: %s is a universal binary with the architectures %v\n", ea.InputFile, archs)
+	success = true
+	for _, arch := range archs {
+		sliceArgs := ea
+		sliceArgs.Arch = arch
+		sliceArgs.OutputFile = archOutputFile(ea.OutputFile, arch)
+		setDarwinExtractors(&sliceArgs, arch)
+		if !handleExecutable(sliceArgs) {
+			LogError("Failed to extract the %s architecture of %s.\n", arch, ea.InputFile)
+			success = false
+		}
+	}
+	return
+}
+
+// archOutputFile names the module of one architecture of a universal binary, foo.bc becomes foo.arm64.bc.
+func archOutputFile(outputFile string, arch string) string {
+	if strings.HasSuffix(outputFile, ".bc") {
+		return strings.TrimSuffix(outputFile, ".bc") + "." + arch + ".bc"
+	}
+	return outputFile + "." + arch
+}
+
 func handleExecutable(ea ExtractionArgs) (success bool) {
+	if ea.WriteManifest {
+		ea.manifest = &manifestRecorder{}
+	}
 	// get the list of bitcode paths
-	var artifactPaths []string
-	artifactPaths, success = ea.Extractor(ea.InputFile)
+	var records []BitcodeRecord
+	var filesToLink []string
+	records, filesToLink, success = extractFromFile(ea, ea.InputFile)
 	if !success && ea.StrictExtract {
 		return
 	}
+	for _, dependency := range ea.dependencies {
+		dependencyRecords, dependencyFiles, ok := extractFromFile(ea, dependency)
+		if !ok && ea.StrictExtract {
+			success = false
+			return
+		}
+		records = append(records, dependencyRecords...)
+		filesToLink = append(filesToLink, dependencyFiles...)
+	}
+	if len(ea.archives) > 0 {
+		var ok bool
+		if records, filesToLink, ok = addArchiveBitcode(ea, records, filesToLink); !ok {
+			success = false
+			return
+		}
+	}
 
+	artifactPaths := recordPaths(records)
 	if len(artifactPaths) < 20 {
 		// naert: to avoid saturating the log when dealing with big file lists
 		LogInfo("handleExecutable: artifactPaths = %v\n", artifactPaths)
@@ -273,10 +402,6 @@ func handleExecutable(ea ExtractionArgs) (success bool) {
 	if len(artifactPaths) == 0 {
 		return
 	}
-	filesToLink := make([]string, len(artifactPaths))
-	for i, artPath := range artifactPaths {
-		filesToLink[i] = resolveBitcodePath(artPath)
-	}
 
 	// Sort the bitcode files
 	if ea.SortBitcodeFiles {
@@ -296,144 +421,136 @@ func handleExecutable(ea ExtractionArgs) (success bool) {
 	}
 
 	success = linkBitcodeFiles(ea, filesToLink)
+	if success && ea.ReportNative {
+		success = reportNativeFunctions(ea)
+	}
 	return
 }
 
-func handleThinArchive(ea ExtractionArgs) (success bool) {
-	// List bitcode files to link
-	var artifactFiles []string
-
-	var objectFiles []string
-	var bcFiles []string
-
-	objectFiles = listArchiveFiles(ea, ea.InputFile)
-
-	LogInfo("handleThinArchive: ExtractionArgs = %v\nobjectFiles = %v\n", ea, objectFiles)
+// extractFromFile runs the platform's section extractors over the file at path.
+func extractFromFile(ea ExtractionArgs, path string) (records []BitcodeRecord, bcFiles []string, success bool) {
+	file, err := os.Open(path)
+	if err != nil {
+		LogError("Could not open %s because: %v.\n", path, err)
+		return
+	}
+	defer CheckDefer(func() error { return file.Close() })
+	return extractFromReader(ea, file, fileSource(path))
+}
 
-	for index, obj := range objectFiles {
-		LogInfo("obj = '%v'\n", obj)
-		if len(obj) > 0 {
-			var artifacts []string
-			artifacts, success = ea.Extractor(obj)
-			if !success && ea.StrictExtract {
-				return
+// extractFromReader returns the bitcode records found in the object, executable or library read by r,
+// together with the bitcode files they resolve to (an empty string when there is none). Bitcode
+// embedded in the input is preferred over whatever is, or is not, at the recorded path.
+func extractFromReader(ea ExtractionArgs, r io.ReaderAt, source bitcodeSource) (records []BitcodeRecord, bcFiles []string, success bool) {
+	label := source.label
+	records, success = ea.Extractor(r, label)
+	if !success && len(records) == 0 {
+		ea.coverage.noSection(label)
+	}
+	embedded := make(map[string]string)
+	if ea.EmbeddedExtractor != nil && ea.embedded != nil {
+		modules, ok := ea.EmbeddedExtractor(r, label)
+		if !ok {
+			LogWarning("Ignoring the embedded bitcode of %v.\n", label)
+		}
+		for _, module := range modules {
+			if _, seen := embedded[module.Path]; seen {
+				continue
 			}
-			LogInfo("\t%v\n", artifacts)
-			artifactFiles = append(artifactFiles, artifacts...)
-			for _, bc := range artifacts {
-				bcPath := resolveBitcodePath(bc)
-				if bcPath != "" {
-					bcFiles = append(bcFiles, bcPath)
-				}
+			bcFile, err := ea.embedded.write(module)
+			if err != nil {
+				LogWarning("Could not write the embedded bitcode of %v because: %v.\n", module.Path, err)
+				continue
 			}
-		} else {
-			LogDebug("\tskipping empty entry at index %v\n", index)
+			LogDebug("extractFromReader: %v is embedded in %v, using %v\n", module.Path, label, bcFile)
+			embedded[module.Path] = bcFile
 		}
 	}
-
-	LogInfo("bcFiles: %v\n", bcFiles)
-	LogInfo("len(bcFiles) = %v\n", len(bcFiles))
-
-	if len(bcFiles) > 0 {
-
-		// Sort the bitcode files
-		if ea.SortBitcodeFiles {
-			LogWarning("Sorting bitcode files.")
-			sort.Strings(bcFiles)
-			sort.Strings(artifactFiles)
+	for _, record := range records {
+		if bcFile, ok := embedded[record.Path]; ok {
+			ea.coverage.bitcode(label, record, bcFile, true)
+			ea.manifest.bitcode(source, record, bcFile, true)
+			bcFiles = append(bcFiles, bcFile)
+			continue
 		}
-
-		// Build archive
-		if ea.BuildBitcodeModule {
-			success = linkBitcodeFiles(ea, bcFiles)
-		} else {
-			success = archiveBcFiles(ea, bcFiles)
-		}
-
-		if !success {
-			return
-		}
-
-		// Write manifest
-		if ea.WriteManifest {
-			success = writeManifest(ea, bcFiles, artifactFiles)
+		bcFile, ok := resolveBitcodePath(record, ea.StrictExtract)
+		if !ok {
+			success = false
 		}
-	} else {
-		LogError("No bitcode files found\n")
-		success = false
+		ea.coverage.bitcode(label, record, bcFile, false)
+		ea.manifest.bitcode(source, record, bcFile, false)
+		bcFiles = append(bcFiles, bcFile)
 	}
 	return
 }
 
-func listArchiveFiles(ea ExtractionArgs, inputFile string) (contents []string) {
-	var arArgs []string
-	arArgs = append(arArgs, "-t")
-	arArgs = append(arArgs, inputFile)
-	output, err := runCmd(ea.ArchiverName, arArgs)
-	if err != nil {
-		LogWarning("ar command: %v %v", ea.ArchiverName, arArgs)
-		LogError("Failed to extract contents from archive %s because: %v.\n", inputFile, err)
-		return
+// recordPaths returns the bitcode paths of the records.
+func recordPaths(records []BitcodeRecord) (paths []string) {
+	for _, record := range records {
+		paths = append(paths, record.Path)
 	}
-	contents = strings.Split(output, "\n")
 	return
 }
 
-func extractFile(ea ExtractionArgs, archive string, filename string, instance int) (success bool) {
-	var arArgs []string
-	if runtime.GOOS != osDARWIN {
-		arArgs = append(arArgs, "xN")
-		arArgs = append(arArgs, strconv.Itoa(instance))
-	} else {
-		if instance > 1 {
-			LogWarning("Cannot extract instance %v of %v from archive %s for instance > 1.\n", instance, filename, archive)
+// embeddedFiles is the temporary directory holding the bitcode we found embedded in the input.
+// Each module gets a directory of its own, since llvm-ar only keeps their base names.
+type embeddedFiles struct {
+	mu    sync.Mutex
+	dir   string
+	count int
+}
+
+func (ef *embeddedFiles) write(module EmbeddedBitcode) (bcFile string, err error) {
+	ef.mu.Lock()
+	defer ef.mu.Unlock()
+	if ef.dir == "" {
+		if ef.dir, err = os.MkdirTemp("", "gllvm-embedded"); err != nil {
 			return
 		}
-		arArgs = append(arArgs, "x")
 	}
-	arArgs = append(arArgs, archive)
-	arArgs = append(arArgs, filename)
-	_, err := runCmd(ea.ArchiverName, arArgs)
-	if err != nil {
-		LogWarning("The archiver %v failed to extract instance %v of %v from archive %s because: %v.\n", ea.ArchiverName, instance, filename, archive, err)
+	dir := filepath.Join(ef.dir, strconv.Itoa(ef.count))
+	ef.count++
+	if err = os.Mkdir(dir, 0755); err != nil {
 		return
 	}
-	success = true
+	bcFile = filepath.Join(dir, filepath.Base(module.Path))
+	err = os.WriteFile(bcFile, module.Bitcode, 0644)
 	return
 }
 
-func fetchTOC(ea ExtractionArgs, inputFile string) map[string]int {
-	toc := make(map[string]int)
-
-	contents := listArchiveFiles(ea, inputFile)
-
-	for _, item := range contents {
-		//iam: this is a hack to make get-bc work on libcurl.a
-		if item != "" && !strings.HasPrefix(item, "__.SYMDEF") {
-			toc[item]++
-		}
+func (ef *embeddedFiles) cleanup(keep bool) {
+	if ef.dir == "" {
+		return
 	}
-	return toc
+	if keep {
+		LogInfo("Keeping the embedded bitcode in %v\n", ef.dir)
+		return
+	}
+	CheckDefer(func() error { return os.RemoveAll(ef.dir) })
 }
 
-func extractFiles(ea ExtractionArgs, inputFile string, toc map[string]int) (success bool, artifactFiles []string, bcFiles []string) {
-	for obj, instance := range toc {
-		for i := 1; i <= instance; i++ {
-			if obj != "" && extractFile(ea, inputFile, obj, i) {
-				var artifacts []string
-				artifacts, success = ea.Extractor(obj)
-				if !success && ea.StrictExtract {
-					LogError("Failed to extract obj = %v occurrence = %v from %v", obj, i, inputFile)
-					return
-				}
-				LogInfo("\t%v\n", artifacts)
-				artifactFiles = append(artifactFiles, artifacts...)
-				for _, bc := range artifacts {
-					bcPath := resolveBitcodePath(bc)
-					if bcPath != "" {
-						bcFiles = append(bcFiles, bcPath)
-					}
-				}
+func extractFiles(ea ExtractionArgs, archive *Archive) (success bool, artifactFiles []string, bcFiles []string) {
+	results := extractMembers(ea, archive, func(ea ExtractionArgs, r io.ReaderAt, member ArchiveMember) (result memberExtraction) {
+		result.records, result.bcFiles, result.success = extractFromReader(ea, r, memberSource(archive, member))
+		return
+	})
+	for i, member := range archive.Members {
+		label := archive.MemberLabel(member)
+		result := results[i]
+		if result.err != nil {
+			LogWarning("Could not read %v because: %v.\n", label, result.err)
+			result.success = false
+		}
+		if !result.success && ea.StrictExtract {
+			LogError("Failed to extract %v", label)
+			return
+		}
+		artifacts := recordPaths(result.records)
+		LogInfo("\t%v\n", artifacts)
+		artifactFiles = append(artifactFiles, artifacts...)
+		for _, bcPath := range result.bcFiles {
+			if bcPath != "" {
+				bcFiles = append(bcFiles, bcPath)
 			}
 		}
 	}
@@ -442,15 +559,16 @@ func extractFiles(ea ExtractionArgs, inputFile string, toc map[string]int) (succ
 	return
 }
 
-// handleArchive processes an archive, and creates either a bitcode archive, or a module, depending on the flags used.
+// handleArchive processes an archive, or a thin archive, and creates either a bitcode archive, or a module,
+// depending on the flags used.
 //
 //	Archives are strange beasts. handleArchive processes the archive by:
 //
-//	  1. first creating a table of contents of the archive, which maps file names (in the archive) to the number of
-//	times a file with that name is stored in the archive.
+//	  1. first reading the table of contents of the archive, where each member is identified by its name and
+//	the number of times a file with that name has occurred so far (its instance).
 //
-//	  2. for each OCCURRENCE of a file (name and count) it extracts the section from the object file, and adds the
-//	bitcode paths to the bitcode list.
+//	  2. for each member it extracts the section from the member's contents, without writing them to disk,
+//	and adds the bitcode paths to the bitcode list.
 //
 //	  3. it then either links all these bitcode files together using llvm-link,  or else is creates a bitcode
 //	archive using llvm-ar
@@ -461,50 +579,30 @@ func handleArchive(ea ExtractionArgs) (success bool) {
 	var bcFiles []string
 	var artifactFiles []string
 
-	inputFile, _ := filepath.Abs(ea.InputFile)
-
 	LogInfo("handleArchive: ExtractionArgs = %v\n", ea)
 
-	// Create tmp dir
-	tmpDirName, err := os.MkdirTemp("", "gllvm")
-	if err != nil {
-		LogError("The temporary directory in which to extract object files could not be created.")
-		return
-	}
-
-	defer CheckDefer(func() error { return os.RemoveAll(tmpDirName) })
-
-	homeDir, err := os.Getwd()
-	if err != nil {
-		LogError("Could not ascertain our whereabouts: %v", err)
-		return
+	if ea.WriteManifest {
+		ea.manifest = &manifestRecorder{}
 	}
 
-	err = os.Chdir(tmpDirName)
+	//1. fetch the Table of Contents (TOC)
+	archive, err := OpenArchive(ea.InputFile)
 	if err != nil {
-		LogError("Could not cd to %v because: %v", tmpDirName, err)
+		LogError("Failed to read the archive %s because: %v.\n", ea.InputFile, err)
 		return
 	}
+	defer CheckDefer(func() error { return archive.Close() })
 
-	//1. fetch the Table of Contents (TOC)
-	toc := fetchTOC(ea, inputFile)
-
-	LogDebug("Table of Contents of %v:\n%v\n", inputFile, toc)
+	LogDebug("Table of Contents of %v:\n%v\n", ea.InputFile, archive.Members)
 
-	//2. extract the files from the TOC
-	success, artifactFiles, bcFiles = extractFiles(ea, inputFile, toc)
+	//2. extract the sections of the members
+	success, artifactFiles, bcFiles = extractFiles(ea, archive)
 	//extractFiles has already complained
 	if !success {
 		return
 	}
 
-	err = os.Chdir(homeDir)
-	if err != nil {
-		LogError("Could not cd to %v because: %v", homeDir, err)
-		return
-	}
-
-	LogDebug("handleArchive: walked %v\nartifactFiles:\n%v\nbcFiles:\n%v\n", tmpDirName, artifactFiles, bcFiles)
+	LogDebug("handleArchive: artifactFiles:\n%v\nbcFiles:\n%v\n", artifactFiles, bcFiles)
 
 	//3. link or archive those puppies
 	if len(bcFiles) > 0 {
@@ -534,6 +632,7 @@ func handleArchive(ea ExtractionArgs) (success bool) {
 		}
 	} else {
 		LogError("No bitcode files found\n")
+		success = false
 		return
 	}
 	return
@@ -551,12 +650,21 @@ func archiveBcFiles(ea ExtractionArgs, bcFiles []string) (success bool) {
 
 	// Call llvm-ar from each directory
 	absOutputFile, _ := filepath.Abs(ea.OutputFile)
+	argMax := fetchArgMax(ea)
 	for dir, bcFilesInDir := range dirToBcMap {
 		var args []string
 		var err error
 		args = append(args, "rs", absOutputFile)
-		args = append(args, bcFilesInDir...)
-		success, err = execCmd(ea.LlvmArchiverName, args, dir)
+		if getsize(bcFilesInDir) > argMax {
+			// llvm-ar reads the files from a response file, failing that we add them a chunk at a time.
+			if success, err = execCmdWithResponseFile(ea.LlvmArchiverName, args, bcFilesInDir, dir); !success {
+				LogWarning("Archiving with a response file failed because %v, archiving incrementally instead.\n", err)
+				success, err = archiveIncrementally(ea, args, bcFilesInDir, argMax, dir)
+			}
+		} else {
+			args = append(args, bcFilesInDir...)
+			success, err = execCmd(ea.LlvmArchiverName, args, dir)
+		}
 		LogInfo("ea.LlvmArchiverName = %s, args = %v, dir = %s\n", ea.LlvmArchiverName, args, dir)
 		if !success {
 			LogError("There was an error creating the bitcode archive: %v.\n", err)
@@ -568,6 +676,22 @@ func archiveBcFiles(ea ExtractionArgs, bcFiles []string) (success bool) {
 	return
 }
 
+// archiveIncrementally adds the files to the archive a command line's worth at a time.
+func archiveIncrementally(ea ExtractionArgs, args []string, files []string, argMax int, dir string) (success bool, err error) {
+	for len(files) > 0 {
+		chunk := 1
+		for size := len(files[0]); chunk < len(files) && size+len(files[chunk]) <= argMax; chunk++ {
+			size += len(files[chunk])
+		}
+		if success, err = execCmd(ea.LlvmArchiverName, append(append([]string{}, args...), files[:chunk]...), dir); !success {
+			return
+		}
+		files = files[chunk:]
+	}
+	success = true
+	return
+}
+
 func getsize(stringslice []string) (totalLength int) {
 	totalLength = 0
 	for _, s := range stringslice {
@@ -627,8 +751,10 @@ func linkBitcodeFilesIncrementally(ea ExtractionArgs, filesToLink []string, argM
 	linkArgs = append(linkArgs, "-o", tmpFile.Name())
 
 	LogInfo("llvm-link argument size : %d", getsize(filesToLink))
+	pending := 0 // the files in the current chunk
 	for _, file := range filesToLink {
 		linkArgs = append(linkArgs, file)
+		pending++
 		if getsize(linkArgs) > argMax {
 			LogInfo("Linking command size exceeding system capacity : splitting the command")
 			success, err = execCmd(ea.LlvmLinkerName, linkArgs, "")
@@ -650,14 +776,20 @@ func linkBitcodeFilesIncrementally(ea ExtractionArgs, filesToLink []string, argM
 			}
 			tmpFileList = append(tmpFileList, tmpFile.Name())
 			linkArgs = append(linkArgs, "-o", tmpFile.Name())
+			pending = 0
 		}
 
 	}
-	success, err = execCmd(ea.LlvmLinkerName, linkArgs, "")
-	if !success || err != nil {
-		LogError("There was an error linking input files into %s because %v.\n", tmpFile.Name(), err)
-		success = false
-		return
+	if pending > 0 {
+		success, err = execCmd(ea.LlvmLinkerName, linkArgs, "")
+		if !success || err != nil {
+			LogError("There was an error linking input files into %s because %v.\n", tmpFile.Name(), err)
+			success = false
+			return
+		}
+	} else {
+		// the last file filled the previous chunk
+		tmpFileList = tmpFileList[:len(tmpFileList)-1]
 	}
 	linkArgs = nil
 	if ea.Verbose {
@@ -689,10 +821,21 @@ func linkBitcodeFiles(ea ExtractionArgs, filesToLink []string) (success bool) {
 		linkArgs = append(linkArgs, "-v")
 	}
 
+	if ea.Jobs > 1 && len(filesToLink) > 2 {
+		return linkBitcodeTree(ea, filesToLink, argMax)
+	}
+
+	var err error
 	if getsize(filesToLink) > argMax { //command line size too large for the OS (necessitated by chromium)
+		// llvm-link reads the files from a response file, failing that we link them a chunk at a time.
+		rspArgs := append(append(append([]string{}, linkArgs...), LLVMLINKFlags...), "-o", ea.OutputFile)
+		if success, err = execCmdWithResponseFile(ea.LlvmLinkerName, rspArgs, filesToLink, ""); success {
+			informUser("Bitcode file extracted to: %s.\n", ea.OutputFile)
+			return
+		}
+		LogWarning("Linking with a response file failed because %v, linking incrementally instead.\n", err)
 		return linkBitcodeFilesIncrementally(ea, filesToLink, argMax, linkArgs)
 	}
-	var err error
 
 	// Append any custom llvm-link flags requested by the user.
 	// N.B. that we do this specially for the incremental link case.
@@ -709,12 +852,31 @@ func linkBitcodeFiles(ea ExtractionArgs, filesToLink []string) (success bool) {
 	return
 }
 
-func extractSectionDarwin(inputFile string) (contents []string, success bool) {
-	machoFile, err := macho.Open(inputFile)
-	if err != nil {
-		LogError("Mach-O file %s could not be read.", inputFile)
+// setDarwinExtractors uses the Mach-O extractors for the given architecture of universal binaries.
+func setDarwinExtractors(ea *ExtractionArgs, arch string) {
+	ea.Extractor = func(r io.ReaderAt, inputFile string) ([]BitcodeRecord, bool) {
+		return extractSectionDarwin(r, inputFile, arch)
+	}
+	ea.EmbeddedExtractor = func(r io.ReaderAt, inputFile string) ([]EmbeddedBitcode, bool) {
+		return extractEmbeddedDarwin(r, inputFile, arch)
+	}
+}
+
+func extractSectionDarwin(r io.ReaderAt, inputFile string, arch string) (contents []BitcodeRecord, success bool) {
+	machoFile, fat := openMachOSlice(r, arch)
+	if machoFile == nil {
+		if fat {
+			LogError("Mach-O file %s does not contain the architecture %s.", inputFile, arch)
+		} else {
+			LogError("Mach-O file %s could not be read.", inputFile)
+		}
 		return
 	}
+	if fat && arch == "" {
+		LogWarning("No architecture requested, using the first one (%s).", machoArchName(machoFile.Cpu, machoFile.SubCpu))
+	} else if !fat && arch != "" && machoArchName(machoFile.Cpu, machoFile.SubCpu) != arch {
+		LogWarning("Mach-O file %s is not a universal binary, ignoring the requested architecture %s.", inputFile, arch)
+	}
 	section := machoFile.Section(DarwinSectionName)
 	if section == nil {
 		LogError("The %s section of %s is missing!\n", DarwinSectionName, inputFile)
@@ -725,13 +887,89 @@ func extractSectionDarwin(inputFile string) (contents []string, success bool) {
 		LogError("Error reading the %s section of Mach-O file %s.", DarwinSectionName, inputFile)
 		return
 	}
-	contents = strings.Split(strings.TrimSuffix(string(sectionContents), "\n"), "\n")
+	contents, errContents = DecodeBitcodeRecords(sectionContents)
+	if errContents != nil {
+		LogError("Error decoding the %s section of Mach-O file %s: %v.", DarwinSectionName, inputFile, errContents)
+		return
+	}
+	success = true
+	return
+}
+
+// extractEmbeddedDarwin returns the bitcode embedded in a Mach-O file, if any.
+func extractEmbeddedDarwin(r io.ReaderAt, inputFile string, arch string) (modules []EmbeddedBitcode, success bool) {
+	machoFile, _ := openMachOSlice(r, arch)
+	if machoFile == nil {
+		return
+	}
+	section := machoFile.Section(DarwinBitcodeSectionName)
+	if section == nil {
+		success = true
+		return
+	}
+	return decodeEmbeddedSection(section.Data, inputFile)
+}
+
+// extractEmbeddedUnix returns the bitcode embedded in an ELF file, if any.
+func extractEmbeddedUnix(r io.ReaderAt, inputFile string) (modules []EmbeddedBitcode, success bool) {
+	elfFile, err := elf.NewFile(r)
+	if err != nil {
+		return
+	}
+	section := elfFile.Section(ELFBitcodeSectionName)
+	if section == nil {
+		success = true
+		return
+	}
+	return decodeEmbeddedSection(section.Data, inputFile)
+}
+
+func decodeEmbeddedSection(data func() ([]byte, error), inputFile string) (modules []EmbeddedBitcode, success bool) {
+	sectionContents, err := data()
+	if err != nil {
+		LogWarning("Error reading the embedded bitcode section of %s: %v.", inputFile, err)
+		return
+	}
+	modules, err = DecodeEmbeddedBitcode(sectionContents)
+	if err != nil {
+		LogWarning("Error decoding the embedded bitcode of %s: %v.", inputFile, err)
+		return
+	}
 	success = true
 	return
 }
 
-func extractSectionUnix(inputFile string) (contents []string, success bool) {
-	elfFile, err := elf.Open(inputFile)
+// openMachOSlice opens a Mach-O file, or the requested architecture of a universal binary (the first one
+// if none was requested). It returns nil if it cannot, fat tells whether the file was a universal binary.
+func openMachOSlice(r io.ReaderAt, arch string) (machoFile *macho.File, fat bool) {
+	machoFile, err := macho.NewFile(r)
+	if err == nil {
+		return
+	}
+	fatFile, err := macho.NewFatFile(r)
+	if err != nil {
+		return
+	}
+	fat = true
+	machoFile = fatSlice(fatFile, arch)
+	return
+}
+
+// fatSlice picks the requested architecture of a universal binary, or the first one if none was requested.
+func fatSlice(fatFile *macho.FatFile, arch string) *macho.File {
+	if arch == "" {
+		return fatFile.Arches[0].File
+	}
+	for _, slice := range fatFile.Arches {
+		if machoArchName(slice.Cpu, slice.SubCpu) == arch {
+			return slice.File
+		}
+	}
+	return nil
+}
+
+func extractSectionUnix(r io.ReaderAt, inputFile string) (contents []BitcodeRecord, success bool) {
+	elfFile, err := elf.NewFile(r)
 	if err != nil {
 		LogError("ELF file %s could not be read.", inputFile)
 		return
@@ -746,31 +984,82 @@ func extractSectionUnix(inputFile string) (contents []string, success bool) {
 		LogError("Error reading the %s section of ELF file %s.", ELFSectionName, inputFile)
 		return
 	}
-	contents = strings.Split(strings.TrimSuffix(string(sectionContents), "\n"), "\n")
+	contents, errContents = DecodeBitcodeRecords(sectionContents)
+	if errContents != nil {
+		LogError("Error decoding the %s section of ELF file %s: %v.", ELFSectionName, inputFile, errContents)
+		return
+	}
 	success = true
 	return
 }
 
-// Return the actual path to the bitcode file, or an empty string if it does not exist
-func resolveBitcodePath(bcPath string) string {
-	if _, err := os.Stat(bcPath); os.IsNotExist(err) {
-		// If the bitcode file does not exist, try to find it in the store
-		if LLVMBitcodeStorePath != "" {
-			// Compute absolute path hash
-			absBcPath, _ := filepath.Abs(bcPath)
-			storeBcPath := path.Join(LLVMBitcodeStorePath, getHashedPath(absBcPath))
-			if _, err := os.Stat(storeBcPath); os.IsNotExist(err) {
-				return ""
+// Return the actual path to the bitcode file of the record, or an empty string if it does not exist.
+// When the record has the hash of the bitcode file, the file must still match it, failing that we
+// use the copy in the store if that does. Failing that too, we make do with the file we have, unless
+// we are being strict, in which case ok is false.
+func resolveBitcodePath(record BitcodeRecord, strict bool) (bcPath string, ok bool) {
+	ok = true
+	bcPath = record.Path
+	_, err := os.Stat(bcPath)
+	exists := !os.IsNotExist(err)
+	if exists && matchesHash(bcPath, record.Hash) {
+		return
+	}
+	// If the bitcode file does not exist, or has changed, try to find it in the store
+	if LLVMBitcodeStorePath != "" {
+		for _, storeBcPath := range storeCandidates(LLVMBitcodeStorePath, record) {
+			if matchesHash(storeBcPath, record.Hash) {
+				if exists {
+					LogWarning("The file %v has changed since it was compiled, using %v instead\n", bcPath, storeBcPath)
+				}
+				bcPath = storeBcPath
+				return
 			}
-			return storeBcPath
 		}
+	}
+	if !exists {
 		LogWarning("Failed to find the file %v\n", bcPath)
-		return ""
+		bcPath = ""
+		return
+	}
+	if strict {
+		LogError("The file %v has changed since it was compiled\n", bcPath)
+		bcPath = ""
+		ok = false
+		return
+	}
+	LogWarning("The file %v has changed since it was compiled, using it regardless\n", bcPath)
+	return
+}
+
+// matchesHash checks the contents of the file against the hash in its record, if there is one.
+func matchesHash(bcPath string, hash string) bool {
+	if hash == "" {
+		return true
 	}
-	return bcPath
+	actual, err := BitcodeHash(bcPath)
+	if err != nil {
+		LogWarning("Failed to hash the file %v because %v\n", bcPath, err)
+		return false
+	}
+	return actual == hash
 }
 
 func writeManifest(ea ExtractionArgs, bcFiles []string, artifactFiles []string) (success bool) {
+	for _, format := range ea.manifestFormats {
+		if format == manifestText {
+			success = writeTextManifest(ea, bcFiles, artifactFiles)
+		} else {
+			success = writeStructuredManifest(ea, format)
+		}
+		if !success {
+			return
+		}
+	}
+	return
+}
+
+func writeTextManifest(ea ExtractionArgs, bcFiles []string, artifactFiles []string) (success bool) {
 	manifestFilename := ea.OutputFile + ".llvm.manifest"
 	//only go into the gory details if we have a store around.
 	if LLVMBitcodeStorePath != "" {
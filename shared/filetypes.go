@@ -34,18 +34,20 @@
 package shared
 
 import (
+	"bytes"
 	"debug/elf"
 	"debug/macho"
+	"encoding/binary"
+	"fmt"
+	"io"
 	"os"
-	"os/exec"
 	"runtime"
-	"strings"
 )
 
 // BinaryType is the 'intersection' of elf.Type and macho.Type and partitions
 // the binary world into categories we are most interested in. Missing is
-// ARCHIVE but that is because it is not an elf format, so we cannot entirely
-// eliminate the use of the 'file' utility (cf getFileType below).
+// ARCHIVE but that is because it is not an elf format, archives are
+// recognized by their magic bytes instead (cf getFileType below).
 type BinaryType uint32
 
 const (
@@ -184,17 +186,82 @@ func ElfFileType(objectFile string) (code BinaryType, err error) {
 	return
 }
 
-// MachoFileType returns the macho.Type of the given file name
+// MachoFileType returns the macho.Type of the given file name, universal binaries are
+// classified by their first architecture (they all have the same type).
 func MachoFileType(objectFile string) (code BinaryType, err error) {
 	var dbinFile *macho.File
 	dbinFile, err = macho.Open(objectFile)
 	if err != nil {
+		var fatFile *macho.FatFile
+		var fatErr error
+		fatFile, fatErr = macho.OpenFat(objectFile)
+		if fatErr != nil {
+			return
+		}
+		defer CheckDefer(func() error { return fatFile.Close() })
+		err = nil
+		code = machoType2BinaryType(fatFile.Arches[0].Type)
 		return
 	}
+	defer CheckDefer(func() error { return dbinFile.Close() })
 	code = machoType2BinaryType(dbinFile.FileHeader.Type)
 	return
 }
 
+// fatArchitectures lists the architectures of a universal binary, using the names clang's -arch flag
+// uses, if the file is not a universal binary the list is empty.
+func fatArchitectures(path string) (archs []string, err error) {
+	fatFile, err := macho.OpenFat(path)
+	if err == macho.ErrNotFat {
+		err = nil
+		return
+	}
+	if err != nil {
+		return
+	}
+	defer CheckDefer(func() error { return fatFile.Close() })
+	for _, arch := range fatFile.Arches {
+		archs = append(archs, machoArchName(arch.Cpu, arch.SubCpu))
+	}
+	return
+}
+
+// machoArchName returns the name that clang's -arch flag uses for the cpu.
+func machoArchName(cpu macho.Cpu, subCpu uint32) string {
+	subtype := subCpu & 0xff
+	switch cpu {
+	case macho.Cpu386:
+		return "i386"
+	case macho.CpuAmd64:
+		if subtype == 8 {
+			return "x86_64h"
+		}
+		return "x86_64"
+	case macho.CpuArm:
+		switch subtype {
+		case 6:
+			return "armv6"
+		case 9:
+			return "armv7"
+		case 11:
+			return "armv7s"
+		case 12:
+			return "armv7k"
+		}
+		return "arm"
+	case macho.CpuArm64:
+		if subtype == 2 {
+			return "arm64e"
+		}
+		return "arm64"
+	case macho.CpuPpc:
+		return "ppc"
+	case macho.CpuPpc64:
+		return "ppc64"
+	}
+	return fmt.Sprintf("cpu%d", uint32(cpu))
+}
+
 // IsObjectFileForOS returns true if the given file is an object file for the given OS, using the debug/elf and debug/macho packages.
 func IsObjectFileForOS(objectFile string, operatingSys string) (ok bool, err error) {
 	plain := IsPlainFile(objectFile)
@@ -215,7 +282,7 @@ func IsObjectFileForOS(objectFile string, operatingSys string) (ok bool, err err
 	return
 }
 
-// file types via the unix 'file' utility
+// file types as determined by getFileType
 const (
 	// File types
 	fileTypeUNDEFINED = iota
@@ -231,49 +298,158 @@ const (
 	fileTypeERROR
 )
 
-// iam: this is not that robust, because it depends on the file utility "file" which is
-// often missing on docker images (the klee docker file had this problem)
+// iam: this used to depend on the file utility "file" which is often missing on docker
+// images (the klee docker file had this problem), now we just look at the magic bytes.
 // this is only used in extraction, not in compilation.
 func getFileType(realPath string) (fileType int, err error) {
-	// We need the file command to guess the file type
 	fileType = fileTypeERROR
-	cmd := exec.Command("file", realPath)
-	out, err := cmd.Output()
+	file, err := os.Open(realPath)
 	if err != nil {
-		LogError("There was an error getting the type of %s. Make sure that the 'file' command is installed.", realPath)
+		LogError("There was an error getting the type of %s: %v.", realPath, err)
 		return
 	}
-	fo := string(out)
-	if strings.Contains(fo, "ELF") {
-
-		if strings.Contains(fo, "executable") {
-			fileType = fileTypeELFEXECUTABLE
-		} else if strings.Contains(fo, "shared") {
-			fileType = fileTypeELFSHARED
-		} else if strings.Contains(fo, "relocatable") {
-			fileType = fileTypeELFOBJECT
-		} else {
-			fileType = fileTypeUNDEFINED
-		}
+	defer CheckDefer(func() error { return file.Close() })
+	fileType, err = fileTypeOf(file)
+	if err != nil {
+		LogError("There was an error getting the type of %s: %v.", realPath, err)
+	}
+	return
+}
 
-	} else if strings.Contains(fo, "Mach-O") {
+// fileTypeNames are the descriptions of the file types, for the messages to the user.
+var fileTypeNames = map[int]string{
+	fileTypeUNDEFINED:      "unknown",
+	fileTypeELFEXECUTABLE:  "ELF executable",
+	fileTypeELFOBJECT:      "ELF object",
+	fileTypeELFSHARED:      "ELF shared object",
+	fileTypeMACHEXECUTABLE: "Mach-O executable",
+	fileTypeMACHOBJECT:     "Mach-O object",
+	fileTypeMACHSHARED:     "Mach-O shared object",
+	fileTypeARCHIVE:        "archive",
+	fileTypeTHINARCHIVE:    "thin archive",
+	fileTypeERROR:          "error",
+}
 
-		if strings.Contains(fo, "executable") {
-			fileType = fileTypeMACHEXECUTABLE
-		} else if strings.Contains(fo, "dynamically linked shared") {
-			fileType = fileTypeMACHSHARED
-		} else if strings.Contains(fo, "object") {
-			fileType = fileTypeMACHOBJECT
-		} else {
-			fileType = fileTypeUNDEFINED
-		}
+// fileTypeOf reads the magic bytes of ELF, Mach-O (thin and fat), archive and thin archive files.
+// A file that is too short for the header its magic bytes promise is an error.
+func fileTypeOf(r io.ReaderAt) (fileType int, err error) {
+	fileType = fileTypeERROR
+	header := make([]byte, 32)
+	n, err := r.ReadAt(header, 0)
+	if err != nil && err != io.EOF {
+		return
+	}
+	err = nil
+	header = header[:n]
 
-	} else if strings.Contains(fo, "current ar archive") {
+	switch {
+	case n == 0:
+		err = fmt.Errorf("the file is empty")
+	case bytes.HasPrefix(header, []byte(arMagic)):
 		fileType = fileTypeARCHIVE
-	} else if strings.Contains(fo, "thin archive") {
+	case bytes.HasPrefix(header, []byte(thinArMagic)):
 		fileType = fileTypeTHINARCHIVE
-	} else {
-		fileType = fileTypeUNDEFINED
+	case bytes.HasPrefix(header, []byte(elf.ELFMAG)):
+		fileType, err = elfFileTypeOf(r, header)
+	case len(header) >= 4 && binary.BigEndian.Uint32(header) == macho.MagicFat:
+		fileType, err = fatFileTypeOf(r, header)
+	default:
+		fileType, err = machoFileTypeOf(header)
+	}
+	if err != nil {
+		fileType = fileTypeERROR
+	}
+	return
+}
+
+func elfFileTypeOf(r io.ReaderAt, header []byte) (fileType int, err error) {
+	fileType = fileTypeUNDEFINED
+	if len(header) < 18 {
+		err = fmt.Errorf("the ELF header is truncated")
+		return
+	}
+	var order binary.ByteOrder
+	switch elf.Data(header[elf.EI_DATA]) {
+	case elf.ELFDATA2LSB:
+		order = binary.LittleEndian
+	case elf.ELFDATA2MSB:
+		order = binary.BigEndian
+	default:
+		return
+	}
+	switch elf.Type(order.Uint16(header[16:18])) {
+	case elf.ET_REL:
+		fileType = fileTypeELFOBJECT
+	case elf.ET_EXEC:
+		fileType = fileTypeELFEXECUTABLE
+	case elf.ET_DYN:
+		// position independent executables are ET_DYN too, they are the ones with an interpreter.
+		var elfFile *elf.File
+		if elfFile, err = elf.NewFile(r); err != nil {
+			return
+		}
+		fileType = fileTypeELFSHARED
+		for _, prog := range elfFile.Progs {
+			if prog.Type == elf.PT_INTERP {
+				fileType = fileTypeELFEXECUTABLE
+				break
+			}
+		}
+	}
+	return
+}
+
+func machoFileTypeOf(header []byte) (fileType int, err error) {
+	fileType = fileTypeUNDEFINED
+	if len(header) < 4 {
+		return
+	}
+	var order binary.ByteOrder
+	switch magic := binary.BigEndian.Uint32(header); {
+	case magic == macho.Magic32 || magic == macho.Magic64:
+		order = binary.BigEndian
+	case binary.LittleEndian.Uint32(header) == macho.Magic32 || binary.LittleEndian.Uint32(header) == macho.Magic64:
+		order = binary.LittleEndian
+	default:
+		return
+	}
+	if len(header) < 16 {
+		err = fmt.Errorf("the Mach-O header is truncated")
+		return
+	}
+	switch macho.Type(order.Uint32(header[12:16])) {
+	case macho.TypeObj:
+		fileType = fileTypeMACHOBJECT
+	case macho.TypeExec:
+		fileType = fileTypeMACHEXECUTABLE
+	case macho.TypeDylib:
+		fileType = fileTypeMACHSHARED
 	}
 	return
 }
+
+// fatFileTypeOf classifies a universal binary by its first slice, the slices all have the same type.
+func fatFileTypeOf(r io.ReaderAt, header []byte) (fileType int, err error) {
+	fileType = fileTypeUNDEFINED
+	if len(header) < 8 {
+		err = fmt.Errorf("the fat header is truncated")
+		return
+	}
+	// java class files share the fat magic, but their version number makes for a very large slice count.
+	narch := binary.BigEndian.Uint32(header[4:8])
+	if narch == 0 || narch > 32 {
+		return
+	}
+	if len(header) < 20 {
+		err = fmt.Errorf("the fat header is truncated")
+		return
+	}
+	// the first fat_arch follows the header: cputype, cpusubtype, offset, size, align.
+	offset := int64(binary.BigEndian.Uint32(header[16:20]))
+	slice := make([]byte, 16)
+	if _, err = r.ReadAt(slice, offset); err != nil {
+		err = fmt.Errorf("the first slice of the fat file is truncated: %v", err)
+		return
+	}
+	return machoFileTypeOf(slice)
+}
@@ -0,0 +1,111 @@
+package shared
+
+import (
+	"bytes"
+	"debug/elf"
+	"debug/macho"
+	"encoding/binary"
+	"testing"
+)
+
+// elfFile is an ELF header with one program header, of an interpreter or a loadable segment.
+func elfFile(class elf.Class, order binary.ByteOrder, fileType elf.Type, interp bool) []byte {
+	ident := [elf.EI_NIDENT]byte{0x7f, 'E', 'L', 'F', byte(class), byte(elf.ELFDATA2LSB), byte(elf.EV_CURRENT)}
+	if order == binary.BigEndian {
+		ident[elf.EI_DATA] = byte(elf.ELFDATA2MSB)
+	}
+	progType := elf.PT_LOAD
+	if interp {
+		progType = elf.PT_INTERP
+	}
+	var buffer bytes.Buffer
+	if class == elf.ELFCLASS64 {
+		header := elf.Header64{Ident: ident, Type: uint16(fileType), Machine: uint16(elf.EM_X86_64), Version: uint32(elf.EV_CURRENT),
+			Phoff: 64, Ehsize: 64, Phentsize: 56, Phnum: 1}
+		_ = binary.Write(&buffer, order, header)
+		_ = binary.Write(&buffer, order, elf.Prog64{Type: uint32(progType)})
+	} else {
+		header := elf.Header32{Ident: ident, Type: uint16(fileType), Machine: uint16(elf.EM_386), Version: uint32(elf.EV_CURRENT),
+			Phoff: 52, Ehsize: 52, Phentsize: 32, Phnum: 1}
+		_ = binary.Write(&buffer, order, header)
+		_ = binary.Write(&buffer, order, elf.Prog32{Type: uint32(progType)})
+	}
+	return buffer.Bytes()
+}
+
+// machoFile is a Mach-O header, as a fat file has at the start of its slices.
+func machoFile(order binary.ByteOrder, fileType macho.Type) []byte {
+	var buffer bytes.Buffer
+	_ = binary.Write(&buffer, order, macho.FileHeader{Magic: macho.Magic64, Cpu: macho.CpuAmd64, Type: fileType})
+	return buffer.Bytes()
+}
+
+// fatFile is a universal binary with a single slice.
+func fatFile(slice []byte) []byte {
+	var buffer bytes.Buffer
+	const offset = 32
+	_ = binary.Write(&buffer, binary.BigEndian, []uint32{macho.MagicFat, 1, uint32(macho.CpuAmd64), 3, offset, uint32(len(slice)), 0})
+	buffer.Write(make([]byte, offset-buffer.Len()))
+	buffer.Write(slice)
+	return buffer.Bytes()
+}
+
+func Test_file_types(t *testing.T) {
+	var orders = map[string]binary.ByteOrder{"lsb": binary.LittleEndian, "msb": binary.BigEndian}
+	var classes = map[string]elf.Class{"elf32": elf.ELFCLASS32, "elf64": elf.ELFCLASS64}
+	type fileType struct {
+		name     string
+		contents []byte
+		fileType int
+	}
+	var files []fileType
+	for orderName, order := range orders {
+		for className, class := range classes {
+			prefix := className + "-" + orderName + "-"
+			files = append(files,
+				fileType{prefix + "object", elfFile(class, order, elf.ET_REL, false), fileTypeELFOBJECT},
+				fileType{prefix + "executable", elfFile(class, order, elf.ET_EXEC, true), fileTypeELFEXECUTABLE},
+				fileType{prefix + "static", elfFile(class, order, elf.ET_EXEC, false), fileTypeELFEXECUTABLE},
+				fileType{prefix + "pie", elfFile(class, order, elf.ET_DYN, true), fileTypeELFEXECUTABLE},
+				fileType{prefix + "shared", elfFile(class, order, elf.ET_DYN, false), fileTypeELFSHARED},
+			)
+		}
+		files = append(files,
+			fileType{"macho-" + orderName + "-object", machoFile(order, macho.TypeObj), fileTypeMACHOBJECT},
+			fileType{"macho-" + orderName + "-dylib", machoFile(order, macho.TypeDylib), fileTypeMACHSHARED},
+		)
+	}
+	java := []byte{0xca, 0xfe, 0xba, 0xbe, 0x00, 0x00, 0x00, 0x37, 0x00, 0x1d, 0x0a, 0x00, 0x06, 0x00, 0x0f}
+	files = append(files,
+		fileType{"archive", []byte("!<arch>\nfoo.o/          0           0     0     644     0         `\n"), fileTypeARCHIVE},
+		fileType{"thin-archive", []byte("!<thin>\nfoo.o/          0           0     0     644     0         `\n"), fileTypeTHINARCHIVE},
+		fileType{"fat-executable", fatFile(machoFile(binary.LittleEndian, macho.TypeExec)), fileTypeMACHEXECUTABLE},
+		fileType{"fat-object", fatFile(machoFile(binary.LittleEndian, macho.TypeObj)), fileTypeMACHOBJECT},
+		fileType{"java-class", java, fileTypeUNDEFINED},
+		fileType{"text", []byte("int main() { return 0; }\n"), fileTypeUNDEFINED},
+	)
+	for _, file := range files {
+		fileType, err := fileTypeOf(bytes.NewReader(file.contents))
+		if err != nil || fileType != file.fileType {
+			t.Errorf("The %v file is a %v (err = %v), expected a %v\n", file.name, fileTypeNames[fileType], err, fileTypeNames[file.fileType])
+		}
+	}
+
+	// a file that is too short for the header its magic bytes promise is an error
+	pie := elfFile(elf.ELFCLASS64, binary.LittleEndian, elf.ET_DYN, true)
+	fat := fatFile(machoFile(binary.LittleEndian, macho.TypeExec))
+	truncated := map[string][]byte{
+		"empty":        {},
+		"elf-ident":    pie[:8],
+		"elf-pie":      pie[:64],
+		"macho-header": machoFile(binary.LittleEndian, macho.TypeObj)[:8],
+		"fat-header":   fat[:6],
+		"fat-arch":     fat[:12],
+		"fat-slice":    fat[:36],
+	}
+	for name, contents := range truncated {
+		if fileType, err := fileTypeOf(bytes.NewReader(contents)); err == nil {
+			t.Errorf("The truncated %v file is a %v, expected an error\n", name, fileTypeNames[fileType])
+		}
+	}
+}
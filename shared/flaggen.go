@@ -0,0 +1,436 @@
+//
+// OCCAM
+//
+// Copyright (c) 2017, SRI International
+//
+//  All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// * Neither the name of SRI International nor the names of its contributors may
+//   be used to endorse or promote products derived from this software without
+//   specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+//
+
+package shared
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// The kinds of clang options, as in llvm's OptParser.td.
+const (
+	optionFlag              = "flag"
+	optionJoined            = "joined"
+	optionSeparate          = "separate"
+	optionJoinedOrSeparate  = "joinedOrSeparate"
+	optionCommaJoined       = "commaJoined"
+	optionMultiArg          = "multiArg"
+	optionJoinedAndSeparate = "joinedAndSeparate"
+	optionOther             = "other"
+)
+
+// ClangOption is an option of the clang driver, as described by its --help output or by its option table.
+type ClangOption struct {
+	Spelling   string // the prefix and the name, e.g. -I, --sysroot= or -Wl,
+	Kind       string
+	NumArgs    int  // the number of arguments of a multiArg option
+	Link       bool // the option is for the linker
+	Dependency bool // the option is about the dependency files
+}
+
+// FlagProblem is a flag that the parser does not treat as clang does.
+type FlagProblem struct {
+	Flag     string
+	Problem  string
+	Current  string
+	Expected string
+}
+
+// the names of the options that --help shows as separate, but that can also be joined.
+var joinedOrSeparateHelp = regexp.MustCompile(`^-([A-Za-z]|M[A-Z]|include|isystem|idirafter|iquote|imacros|iprefix|isysroot)$`)
+
+// the options in --help: the spelling, then any joined and any separate arguments.
+var helpOption = regexp.MustCompile(`^ {1,4}(-[^\s<\[]+)(\[=<[^>]*>\])?(<[^>]*>)?((?: <[^>]*>)*)(?:\s+(.*))?$`)
+
+var linkerHelp = regexp.MustCompile(`(?i)\b(linker|link(ed|ing)?|librar(y|ies))\b`)
+
+// ParseClangHelp reads the options in the output of clang --help (or --help-hidden, or clang -cc1 --help).
+// The help does not say which options can be joined as well as separate, so that is guessed from their names.
+func ParseClangHelp(r io.Reader) (options []ClangOption) {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		match := helpOption.FindStringSubmatch(scanner.Text())
+		if match == nil {
+			continue
+		}
+		spelling, optional, joined, separate, help := match[1], match[2], match[3], match[4], match[5]
+		option := ClangOption{
+			Spelling:   spelling,
+			Link:       linkerHelp.MatchString(help) || strings.HasPrefix(spelling, "-Wl,"),
+			Dependency: strings.HasPrefix(spelling, "-M"),
+		}
+		separateArgs := strings.Count(separate, "<")
+		switch {
+		case optional != "":
+			// -fprofile-use[=<pathname>] is both a flag and a joined option
+			flagOption := option
+			flagOption.Kind = optionFlag
+			options = append(options, flagOption)
+			option.Spelling += "="
+			option.Kind = optionJoined
+		case joined != "" && separateArgs > 0:
+			option.Kind = optionJoinedAndSeparate
+		case joined != "" && strings.HasSuffix(spelling, ","):
+			option.Kind = optionCommaJoined
+		case joined != "":
+			option.Kind = optionJoined
+		case separateArgs == 1 && joinedOrSeparateHelp.MatchString(spelling):
+			option.Kind = optionJoinedOrSeparate
+		case separateArgs == 1:
+			option.Kind = optionSeparate
+		case separateArgs > 1:
+			option.Kind = optionMultiArg
+			option.NumArgs = separateArgs
+		default:
+			option.Kind = optionFlag
+		}
+		options = append(options, option)
+	}
+	return
+}
+
+// a reference to another record in the JSON dump of llvm-tblgen.
+type tblgenDef struct {
+	Def string `json:"def"`
+}
+
+// the fields of an option, or an option group, in the JSON dump of llvm-tblgen.
+type tblgenRecord struct {
+	Name       string      `json:"Name"`
+	Prefixes   []string    `json:"Prefixes"`
+	Kind       *tblgenDef  `json:"Kind"`
+	NumArgs    int         `json:"NumArgs"`
+	Group      *tblgenDef  `json:"Group"`
+	Flags      []tblgenDef `json:"Flags"`
+	Visibility []tblgenDef `json:"Visibility"`
+}
+
+var tblgenKinds = map[string]string{
+	"KIND_FLAG":                optionFlag,
+	"KIND_JOINED":              optionJoined,
+	"KIND_SEPARATE":            optionSeparate,
+	"KIND_JOINED_OR_SEPARATE":  optionJoinedOrSeparate,
+	"KIND_COMMAJOINED":         optionCommaJoined,
+	"KIND_MULTIARG":            optionMultiArg,
+	"KIND_JOINED_AND_SEPARATE": optionJoinedAndSeparate,
+}
+
+// ParseClangOptionTable reads the options of the clang driver from the JSON dump of its option table, i.e. the output of
+//
+//	llvm-tblgen -dump-json -I llvm/include clang/include/clang/Driver/Options.td
+func ParseClangOptionTable(contents []byte) (options []ClangOption, err error) {
+	var dump struct {
+		InstanceOf map[string][]string `json:"!instanceof"`
+	}
+	if err = json.Unmarshal(contents, &dump); err != nil {
+		return
+	}
+	var records map[string]json.RawMessage
+	if err = json.Unmarshal(contents, &records); err != nil {
+		return
+	}
+	record := func(name string) (r tblgenRecord, err error) {
+		raw, ok := records[name]
+		if !ok {
+			err = fmt.Errorf("the record %v is missing", name)
+			return
+		}
+		err = json.Unmarshal(raw, &r)
+		return
+	}
+	// inGroup says whether the group, or one of the groups it is in, is one of the given groups.
+	inGroup := func(group *tblgenDef, names ...string) bool {
+		for depth := 0; group != nil && depth < 32; depth++ {
+			for _, name := range names {
+				if group.Def == name {
+					return true
+				}
+			}
+			parent, err := record(group.Def)
+			if err != nil {
+				return false
+			}
+			group = parent.Group
+		}
+		return false
+	}
+	hasDef := func(defs []tblgenDef, names ...string) bool {
+		for _, def := range defs {
+			for _, name := range names {
+				if def.Def == name {
+					return true
+				}
+			}
+		}
+		return false
+	}
+
+	names := dump.InstanceOf["Option"]
+	if len(names) == 0 {
+		err = fmt.Errorf("there are no options in the table")
+		return
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		var r tblgenRecord
+		if r, err = record(name); err != nil {
+			return
+		}
+		// only the options of the driver concern us
+		if hasDef(r.Flags, "NoDriverOption") || (len(r.Visibility) > 0 && !hasDef(r.Visibility, "DefaultVis")) {
+			continue
+		}
+		kind := optionOther
+		if r.Kind != nil {
+			if k, ok := tblgenKinds[r.Kind.Def]; ok {
+				kind = k
+			}
+		}
+		for _, prefix := range r.Prefixes {
+			if prefix == "/" {
+				continue
+			}
+			options = append(options, ClangOption{
+				Spelling:   prefix + r.Name,
+				Kind:       kind,
+				NumArgs:    r.NumArgs,
+				Link:       hasDef(r.Flags, "LinkerInput", "LinkOption") || inGroup(r.Group, "Link_Group", "L_Group"),
+				Dependency: inGroup(r.Group, "M_Group"),
+			})
+		}
+	}
+	return
+}
+
+// the actions that only say where a flag goes, and not what it does.
+var placementActions = map[string]bool{flagCompile: true, flagLink: true, flagCompileLink: true, flagDependency: true}
+
+// GenerateFlagSpec makes the flag specification of clang's options, with the options that cannot be described in one
+// skipped, and listed. An option the parser already gives a particular meaning (e.g. -c, or -o) keeps it.
+func GenerateFlagSpec(options []ClangOption) (spec FlagSpec, skipped []FlagProblem) {
+	current := currentFlags()
+	seen := make(map[string]bool)
+	for _, option := range options {
+		if seen[option.Spelling] {
+			continue
+		}
+		seen[option.Spelling] = true
+
+		action := flagCompile
+		if option.Dependency {
+			action = flagDependency
+		} else if option.Link {
+			action = flagLink
+		}
+		exact := func(arity int, spellings ...string) {
+			exactAction := action
+			if entry, ok := current.exact[option.Spelling]; ok && !placementActions[entry.Action] && arityAllowed(entry.Action, arity) {
+				exactAction = entry.Action
+			}
+			spec.Exact = append(spec.Exact, FlagSpecEntry{Flag: option.Spelling, Arity: arity, Action: exactAction, Spellings: spellings})
+		}
+		separate, joined := option.Spelling+" "+spellingArg, option.Spelling+spellingArg
+		switch option.Kind {
+		case optionFlag:
+			exact(0)
+		case optionSeparate:
+			exact(1)
+		case optionJoinedOrSeparate:
+			exact(1, separate, joined)
+		case optionJoined, optionCommaJoined:
+			exact(1, joined)
+		case optionJoinedAndSeparate:
+			spec.Patterns = append(spec.Patterns, FlagSpecEntry{Pattern: "^" + regexp.QuoteMeta(option.Spelling) + ".+$", Arity: 1, Action: action})
+		case optionMultiArg:
+			if option.NumArgs <= 1 {
+				exact(option.NumArgs)
+			} else {
+				skipped = append(skipped, FlagProblem{option.Spelling, "skipped", "", fmt.Sprintf("it takes %v arguments", option.NumArgs)})
+			}
+		default:
+			skipped = append(skipped, FlagProblem{option.Spelling, "skipped", "", "its kind cannot be described"})
+		}
+	}
+	// the longer prefixes come first, so that -Xopenmp-target= is tried before -X
+	sort.SliceStable(spec.Patterns, func(i, j int) bool {
+		return len(spec.Patterns[i].Pattern) > len(spec.Patterns[j].Pattern)
+	})
+	return
+}
+
+var quotedChar = regexp.MustCompile(`\\(.)`)
+
+// MisclassifiedFlags lists the spellings of the flags of the (generated) specification that the parser does not
+// recognize, or gives a different arity, or passes to the compiler when they are for the linker (and vice versa).
+func MisclassifiedFlags(spec FlagSpec) (problems []FlagProblem) {
+	current := currentFlags()
+	check := func(spelling string, arg string, arity int, expected FlagSpecEntry) {
+		entry, currentArity, ok := current.lookup(arg)
+		if !ok {
+			problems = append(problems, FlagProblem{spelling, "unrecognized", "", expected.Action})
+			return
+		}
+		if currentArity != arity {
+			problems = append(problems, FlagProblem{spelling, "arity", fmt.Sprint(currentArity), fmt.Sprint(arity)})
+		}
+		if placementActions[entry.Action] && placementActions[expected.Action] && entry.Action != expected.Action {
+			// compileLink goes to both, and is right for either
+			if entry.Action != flagCompileLink || expected.Action == flagDependency {
+				problems = append(problems, FlagProblem{spelling, "action", entry.Action, expected.Action})
+			}
+		}
+	}
+	for _, entry := range spec.Exact {
+		for _, spelling := range entry.spellings() {
+			parsed, _ := parseSpelling(spelling)
+			if parsed.joined {
+				check(spelling, parsed.text+"value", 0, entry)
+			} else {
+				check(spelling, parsed.text, entry.Arity, entry)
+			}
+		}
+	}
+	for _, entry := range spec.Patterns {
+		// the pattern is the quoted spelling of a joined flag, that is followed by another argument
+		spelling := strings.TrimSuffix(strings.TrimPrefix(entry.Pattern, "^"), ".+$")
+		spelling = quotedChar.ReplaceAllString(spelling, "$1")
+		check(spelling+spellingArg+" "+spellingArg, spelling+"value", entry.Arity, entry)
+	}
+	return
+}
+
+// FlagsTool is the main of gllvm-flags, which makes the flag specification of clang's options, and
+// reports the flags the parser gets wrong.
+func FlagsTool(args []string) (exitCode int) {
+	exitCode = 1
+
+	flagSet := flag.NewFlagSet(args[0], flag.ContinueOnError)
+	format := flagSet.String("format", "auto", "the format of the input: help (clang --help), tblgen (llvm-tblgen -dump-json), or auto")
+	output := flagSet.String("o", "", "the file to write the flag specification to (defaults to the standard output)")
+	report := flagSet.String("report", "", "the file to write the report of the misclassified flags to (defaults to the standard error)")
+	flagSet.Usage = func() {
+		fmt.Fprintf(flagSet.Output(), "Usage: %s [-format auto|help|tblgen] [-o output] [-report report] <input>\n", args[0])
+		flagSet.PrintDefaults()
+	}
+	if err := flagSet.Parse(args[1:]); err != nil {
+		return
+	}
+	if flagSet.NArg() != 1 {
+		flagSet.Usage()
+		return
+	}
+
+	input := flagSet.Arg(0)
+	var contents []byte
+	var err error
+	if input == "-" {
+		contents, err = io.ReadAll(os.Stdin)
+	} else {
+		contents, err = os.ReadFile(input)
+	}
+	if err != nil {
+		LogError("Failed to read %s because: %v.\n", input, err)
+		return
+	}
+	if *format == "auto" {
+		*format = "help"
+		if trimmed := bytes.TrimSpace(contents); len(trimmed) > 0 && trimmed[0] == '{' {
+			*format = "tblgen"
+		}
+	}
+	var options []ClangOption
+	switch *format {
+	case "help":
+		options = ParseClangHelp(bytes.NewReader(contents))
+	case "tblgen":
+		if options, err = ParseClangOptionTable(contents); err != nil {
+			LogError("Failed to read the option table %s because: %v.\n", input, err)
+			return
+		}
+	default:
+		LogError("Unknown format %s.\n", *format)
+		return
+	}
+	if len(options) == 0 {
+		LogError("There are no options in %s.\n", input)
+		return
+	}
+
+	spec, skipped := GenerateFlagSpec(options)
+	if err = spec.Validate(); err != nil {
+		LogError("The generated flags are not valid: %v.\n", err)
+		return
+	}
+	specContents, err := json.MarshalIndent(spec, "", "  ")
+	if err != nil {
+		LogError("Failed to encode the flags because: %v.\n", err)
+		return
+	}
+	specContents = append(specContents, '\n')
+	if *output == "" {
+		_, err = os.Stdout.Write(specContents)
+	} else {
+		err = os.WriteFile(*output, specContents, 0644)
+	}
+	if err != nil {
+		LogError("Failed to write the flags because: %v.\n", err)
+		return
+	}
+
+	var lines bytes.Buffer
+	problems := MisclassifiedFlags(spec)
+	fmt.Fprintf(&lines, "%v options, %v misclassified by the parser, %v that cannot be described\n", len(options), len(problems), len(skipped))
+	for _, problem := range append(problems, skipped...) {
+		fmt.Fprintf(&lines, "%v\t%v\t%v\t%v\n", problem.Flag, problem.Problem, problem.Current, problem.Expected)
+	}
+	if *report == "" {
+		_, err = os.Stderr.Write(lines.Bytes())
+	} else {
+		err = os.WriteFile(*report, lines.Bytes(), 0644)
+	}
+	if err != nil {
+		LogError("Failed to write the report because: %v.\n", err)
+		return
+	}
+	exitCode = 0
+	return
+}
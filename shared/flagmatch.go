@@ -0,0 +1,187 @@
+//
+// OCCAM
+//
+// Copyright (c) 2017, SRI International
+//
+//  All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// * Neither the name of SRI International nor the names of its contributors may
+//   be used to endorse or promote products derived from this software without
+//   specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+//
+
+package shared
+
+import (
+	"regexp"
+	"regexp/syntax"
+	"sort"
+	"strings"
+)
+
+type flagPattern struct {
+	regexp *regexp.Regexp
+	entry  FlagSpecEntry
+	prefix string
+	// most patterns are a prefix followed by anything, -I.+ say, and are matched without the regexp
+	prefixOnly bool
+	minRest    int
+}
+
+func newFlagPattern(entry FlagSpecEntry) (pattern flagPattern) {
+	pattern.regexp = regexp.MustCompile(entry.Pattern)
+	pattern.entry = entry
+	pattern.prefix = patternPrefix(pattern.regexp)
+	switch entry.Pattern {
+	case "^" + regexp.QuoteMeta(pattern.prefix) + ".*$":
+		pattern.prefixOnly = true
+	case "^" + regexp.QuoteMeta(pattern.prefix) + ".+$":
+		pattern.prefixOnly, pattern.minRest = true, 1
+	}
+	return
+}
+
+// matches is the regexp's MatchString, for a flag that starts with the prefix of the pattern.
+func (pattern *flagPattern) matches(arg string) bool {
+	if pattern.prefixOnly {
+		rest := arg[len(pattern.prefix):]
+		return len(rest) >= pattern.minRest && strings.IndexByte(rest, '\n') < 0
+	}
+	return pattern.regexp.MatchString(arg)
+}
+
+// flagTrie indexes the patterns by the literal prefix that any flag they match starts with,
+// so that a flag is only matched against the few patterns that it could match.
+type flagTrie struct {
+	patterns []int // the indices of the patterns whose prefix ends here
+	children map[byte]*flagTrie
+}
+
+func (trie *flagTrie) insert(prefix string, index int) {
+	node := trie
+	for i := 0; i < len(prefix); i++ {
+		child, ok := node.children[prefix[i]]
+		if !ok {
+			if node.children == nil {
+				node.children = make(map[byte]*flagTrie)
+			}
+			child = &flagTrie{}
+			node.children[prefix[i]] = child
+		}
+		node = child
+	}
+	node.patterns = append(node.patterns, index)
+}
+
+// candidates appends the indices of the patterns whose prefix is a prefix of arg, in order.
+func (trie *flagTrie) candidates(arg string, indices []int) []int {
+	node := trie
+	indices = append(indices, node.patterns...)
+	for i := 0; i < len(arg); i++ {
+		if node = node.children[arg[i]]; node == nil {
+			break
+		}
+		indices = append(indices, node.patterns...)
+	}
+	sort.Ints(indices)
+	return indices
+}
+
+// longest returns the last index of those whose prefix is the longest proper prefix of arg.
+func (trie *flagTrie) longest(arg string) (index int, ok bool) {
+	node := trie
+	for i := 0; i < len(arg)-1; i++ {
+		if node = node.children[arg[i]]; node == nil {
+			break
+		}
+		if len(node.patterns) > 0 {
+			index, ok = node.patterns[len(node.patterns)-1], true
+		}
+	}
+	return
+}
+
+// patternPrefix is the literal prefix of the flags that the pattern matches; it is only
+// known when the pattern is anchored at the start of the flag.
+func patternPrefix(re *regexp.Regexp) string {
+	parsed, err := syntax.Parse(re.String(), syntax.Perl)
+	if err != nil {
+		return ""
+	}
+	parsed = parsed.Simplify()
+	if parsed.Op != syntax.OpConcat || len(parsed.Sub) == 0 || parsed.Sub[0].Op != syntax.OpBeginText {
+		return ""
+	}
+	prefix, _ := re.LiteralPrefix()
+	return prefix
+}
+
+// joinedFlag is a spelling of a flag with its argument joined to it, e.g. -o of -ofile.
+type joinedFlag struct {
+	prefix string
+	entry  FlagSpecEntry
+}
+
+// matchJoined finds the flag that arg is a spelling of, with its argument joined to it; when
+// several spellings are prefixes of arg, the longest is the one, as it is for clang. A pattern
+// with a longer prefix wins over the spelling, so -objcmt-.+ is not -o with bjcmt-... joined to it.
+func (flags *parserFlags) matchJoined(arg string) (entry FlagSpecEntry, value string, ok bool) {
+	index, ok := flags.joinedTrie.longest(arg)
+	if !ok {
+		return
+	}
+	joined := flags.joined[index]
+	var buffer [16]int
+	for _, index := range flags.trie.candidates(arg, buffer[:0]) {
+		pattern := &flags.patterns[index]
+		if len(pattern.prefix) > len(joined.prefix) && pattern.matches(arg) {
+			return entry, "", false
+		}
+	}
+	return joined.entry, arg[len(joined.prefix):], true
+}
+
+// matchPattern returns the entry of the first pattern that matches arg, and that accept agrees to.
+func (flags *parserFlags) matchPattern(arg string, accept func(FlagSpecEntry) bool) (entry FlagSpecEntry, ok bool) {
+	var buffer [16]int
+	for _, index := range flags.trie.candidates(arg, buffer[:0]) {
+		pattern := &flags.patterns[index]
+		if pattern.matches(arg) && accept(pattern.entry) {
+			return pattern.entry, true
+		}
+	}
+	return
+}
+
+// lookup finds the entry that the parser uses for arg, and the number of arguments that follow it.
+func (flags *parserFlags) lookup(arg string) (entry FlagSpecEntry, arity int, ok bool) {
+	if entry, ok = flags.exact[arg]; ok {
+		return entry, entry.Arity, true
+	}
+	if entry, _, ok = flags.matchJoined(arg); ok {
+		return entry, 0, true
+	}
+	entry, ok = flags.matchPattern(arg, func(FlagSpecEntry) bool { return true })
+	return entry, entry.Arity, ok
+}
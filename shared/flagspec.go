@@ -0,0 +1,398 @@
+//
+// OCCAM
+//
+// Copyright (c) 2017, SRI International
+//
+//  All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// * Neither the name of SRI International nor the names of its contributors may
+//   be used to endorse or promote products derived from this software without
+//   specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+//
+
+package shared
+
+import (
+	"bytes"
+	// the built-in flags are in flags.json
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// The actions a flag can have on the parse. The compile, link and compileLink actions
+// say where the flag (and its argument) is passed on to, the others are the modes and
+// files the flag sets.
+const (
+	flagInput          = "input"          // the flag is a source file
+	flagObject         = "object"         // the flag is an object file, or a library, to link
+	flagOutput         = "output"         // the argument of the flag is the output file
+	flagLanguage       = "language"       // the argument of the flag is the language of the inputs that follow
+	flagPrintOnly      = "printOnly"      // nothing is compiled
+	flagCompileOnly    = "compileOnly"    // nothing is linked
+	flagPreprocessOnly = "preprocessOnly" // nothing is compiled
+	flagAssembleOnly   = "assembleOnly"   // nothing is assembled
+	flagVerbose        = "verbose"
+	flagEmitLLVM       = "emitLLVM" // the compiler makes the bitcode itself
+	flagLTO            = "lto"      // the compiler makes the bitcode itself
+	flagDependency     = "dependency"
+	flagCompile        = "compile"
+	flagLink           = "link"
+	flagCompileLink    = "compileLink"
+	flagIgnore         = "ignore"
+	flagForbidden      = "forbidden" // the flag loses the bitcode, and so is dropped
+)
+
+// flagArities are the actions, and the arities a flag with that action can have.
+var flagArities = map[string][]int{
+	flagInput:          {0},
+	flagObject:         {0},
+	flagOutput:         {1},
+	flagLanguage:       {1},
+	flagPrintOnly:      {0},
+	flagCompileOnly:    {0},
+	flagPreprocessOnly: {0},
+	flagAssembleOnly:   {0},
+	flagVerbose:        {0},
+	flagEmitLLVM:       {0},
+	flagLTO:            {0},
+	flagDependency:     {0, 1},
+	flagCompile:        {0, 1},
+	flagLink:           {0, 1},
+	flagCompileLink:    {0, 1},
+	flagIgnore:         {0, 1},
+	flagForbidden:      {0},
+}
+
+//go:embed flags.json
+var builtinFlags []byte
+
+// FlagSpecEntry describes a compiler flag, or with a Pattern, the flags that match a regular expression.
+// The Spellings of a flag are the ways it can be written; "-o <arg>" is followed by its argument, while
+// "-o<arg>" and "--output=<arg>" have it joined to them. A flag without Spellings is written as it is,
+// followed by its argument if it has one.
+type FlagSpecEntry struct {
+	Flag      string   `json:"flag,omitempty"`
+	Pattern   string   `json:"pattern,omitempty"`
+	Arity     int      `json:"arity"`
+	Action    string   `json:"action"`
+	Spellings []string `json:"spellings,omitempty"`
+	Comment   string   `json:"comment,omitempty"`
+}
+
+// spellingArg stands for the argument of a flag in its spellings.
+const spellingArg = "<arg>"
+
+// flagSpelling is a spelling of a flag, with its argument (if any) removed.
+type flagSpelling struct {
+	text   string
+	hasArg bool
+	joined bool
+}
+
+func parseSpelling(spelling string) (parsed flagSpelling, ok bool) {
+	parsed.text = spelling
+	if strings.HasSuffix(spelling, " "+spellingArg) {
+		parsed.text, parsed.hasArg = strings.TrimSuffix(spelling, " "+spellingArg), true
+	} else if strings.HasSuffix(spelling, spellingArg) {
+		parsed.text, parsed.hasArg, parsed.joined = strings.TrimSuffix(spelling, spellingArg), true, true
+	}
+	ok = parsed.text != "" && !strings.ContainsAny(parsed.text, " <>")
+	return
+}
+
+// spellings are the ways of writing the flag of the entry.
+func (entry FlagSpecEntry) spellings() []string {
+	if len(entry.Spellings) > 0 {
+		return entry.Spellings
+	}
+	if entry.Arity > 0 {
+		return []string{entry.Flag + " " + spellingArg}
+	}
+	return []string{entry.Flag}
+}
+
+// FlagSpec is the table of compiler flags that the parser understands. A flag is first looked up
+// in the Exact entries, then in their spellings with a joined argument, then matched against the
+// Patterns in order; so a pattern must come before any other pattern that also matches and has a
+// conflicting action. When a user's FlagSpec is
+// loaded it extends the built-in one, unless Replace is set.
+type FlagSpec struct {
+	Replace  bool            `json:"replace,omitempty"`
+	Exact    []FlagSpecEntry `json:"exact"`
+	Patterns []FlagSpecEntry `json:"patterns"`
+}
+
+// BuiltinFlagSpec returns the flag specification that is bundled in the binary.
+func BuiltinFlagSpec() (spec FlagSpec, err error) {
+	if err = json.Unmarshal(builtinFlags, &spec); err != nil {
+		err = fmt.Errorf("the built-in flags are not valid JSON: %v", err)
+		return
+	}
+	err = spec.Validate()
+	return
+}
+
+// LoadFlagSpec reads, and validates, the flag specification in the JSON file path.
+func LoadFlagSpec(path string) (spec FlagSpec, err error) {
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		return
+	}
+	decoder := json.NewDecoder(bytes.NewReader(contents))
+	decoder.DisallowUnknownFields()
+	if err = decoder.Decode(&spec); err != nil {
+		err = fmt.Errorf("%v is not a valid flag specification: %v", path, err)
+		return
+	}
+	if err = spec.Validate(); err != nil {
+		err = fmt.Errorf("%v: %v", path, err)
+	}
+	return
+}
+
+// Validate checks that every entry of the specification has a known action, an arity that
+// the action allows, and a flag or a regular expression; that the spellings of a flag agree
+// with its arity; and that no flag, or spelling, is given twice.
+func (spec FlagSpec) Validate() error {
+	var problems []string
+	check := func(where string, entry FlagSpecEntry) {
+		arities, ok := flagArities[entry.Action]
+		if !ok {
+			problems = append(problems, fmt.Sprintf("%v has the unknown action %q", where, entry.Action))
+			return
+		}
+		if !arityAllowed(entry.Action, entry.Arity) {
+			problems = append(problems, fmt.Sprintf("%v has arity %v, but the action %v takes %v", where, entry.Arity, entry.Action, arities))
+		}
+	}
+	seen := make(map[string]bool)
+	seenSpellings := make(map[flagSpelling]bool)
+	for i, entry := range spec.Exact {
+		where := fmt.Sprintf("exact entry %v (%q)", i, entry.Flag)
+		if entry.Flag == "" || entry.Pattern != "" {
+			problems = append(problems, fmt.Sprintf("exact entry %v must have a flag, and no pattern", i))
+		} else if seen[entry.Flag] {
+			problems = append(problems, fmt.Sprintf("%v is a duplicate", where))
+		}
+		seen[entry.Flag] = true
+		check(where, entry)
+		for _, spelling := range entry.spellings() {
+			parsed, ok := parseSpelling(spelling)
+			if !ok || parsed.hasArg != (entry.Arity > 0) {
+				problems = append(problems, fmt.Sprintf("%v has the spelling %q, which does not fit its arity", where, spelling))
+			} else if seenSpellings[parsed] {
+				problems = append(problems, fmt.Sprintf("%v has the spelling %q, which is a duplicate", where, spelling))
+			}
+			seenSpellings[parsed] = true
+		}
+	}
+	for i, entry := range spec.Patterns {
+		where := fmt.Sprintf("pattern %v (%q)", i, entry.Pattern)
+		if entry.Pattern == "" || entry.Flag != "" || len(entry.Spellings) > 0 {
+			problems = append(problems, fmt.Sprintf("pattern %v must have a pattern, and no flag or spellings", i))
+		} else if _, err := regexp.Compile(entry.Pattern); err != nil {
+			problems = append(problems, fmt.Sprintf("%v is not a regular expression: %v", where, err))
+		}
+		check(where, entry)
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("%v", strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+func arityAllowed(action string, arity int) bool {
+	for _, allowed := range flagArities[action] {
+		if allowed == arity {
+			return true
+		}
+	}
+	return false
+}
+
+// extend returns the specification with the user's added to it: the user's exact entries
+// override the ones for the same flag, and the user's patterns are tried first.
+func (spec FlagSpec) extend(user FlagSpec) FlagSpec {
+	if user.Replace {
+		return FlagSpec{Exact: user.Exact, Patterns: user.Patterns}
+	}
+	overrides := make(map[string]FlagSpecEntry)
+	for _, entry := range user.Exact {
+		overrides[entry.Flag] = entry
+	}
+	var extended FlagSpec
+	for _, entry := range spec.Exact {
+		if override, ok := overrides[entry.Flag]; ok {
+			entry = override
+			delete(overrides, entry.Flag)
+		}
+		extended.Exact = append(extended.Exact, entry)
+	}
+	for _, entry := range user.Exact {
+		if _, ok := overrides[entry.Flag]; ok {
+			extended.Exact = append(extended.Exact, entry)
+		}
+	}
+	extended.Patterns = append(append(extended.Patterns, user.Patterns...), spec.Patterns...)
+	return extended
+}
+
+// parserFlags is a flag specification ready for the parser.
+type parserFlags struct {
+	exact      map[string]FlagSpecEntry // the flags, as they are or followed by their argument
+	joined     []joinedFlag
+	joinedTrie flagTrie
+	patterns   []flagPattern
+	trie       flagTrie
+}
+
+func compileFlagSpec(spec FlagSpec) *parserFlags {
+	flags := &parserFlags{exact: make(map[string]FlagSpecEntry)}
+	for _, entry := range spec.Exact {
+		for _, spelling := range entry.spellings() {
+			parsed, _ := parseSpelling(spelling)
+			if parsed.joined {
+				flags.joined = append(flags.joined, joinedFlag{parsed.text, entry})
+				flags.joinedTrie.insert(parsed.text, len(flags.joined)-1)
+			} else {
+				flags.exact[parsed.text] = entry
+			}
+		}
+	}
+	for i, entry := range spec.Patterns {
+		pattern := newFlagPattern(entry)
+		flags.patterns = append(flags.patterns, pattern)
+		flags.trie.insert(pattern.prefix, i)
+	}
+	return flags
+}
+
+// the parser's flags, for the flags file they were loaded with.
+var activeFlags struct {
+	sync.Mutex
+	file  string
+	flags *parserFlags
+}
+
+// currentFlags returns the flags the parser should use: the built-in ones, extended by
+// those in LLVMFlagsFile if there is one.
+func currentFlags() *parserFlags {
+	activeFlags.Lock()
+	defer activeFlags.Unlock()
+	if activeFlags.flags != nil && activeFlags.file == LLVMFlagsFile {
+		return activeFlags.flags
+	}
+	spec, err := BuiltinFlagSpec()
+	if err != nil {
+		LogError("%v\n", err)
+		spec = FlagSpec{}
+	}
+	if LLVMFlagsFile != "" {
+		user, err := LoadFlagSpec(LLVMFlagsFile)
+		if err != nil {
+			LogError("Ignoring the flags in %v=%v: %v\n", envflags, LLVMFlagsFile, err)
+		} else {
+			spec = spec.extend(user)
+		}
+	}
+	activeFlags.file = LLVMFlagsFile
+	activeFlags.flags = compileFlagSpec(spec)
+	return activeFlags.flags
+}
+
+// handleJoinedFlag carries out the action of a flag that has its argument joined to it, as in -ofile or
+// --param=value; the flag goes on to the compiler, or the linker, as it is. The output file and the
+// language of the inputs are taken from the value.
+func (pr *ParserResult) handleJoinedFlag(entry FlagSpecEntry, flag string, value string) {
+	switch entry.Action {
+	case flagOutput:
+		pr.outputFileCallback(flag, []string{value})
+	case flagLanguage:
+		pr.languageCallback(flag, []string{value})
+	default:
+		pr.handleFlag(FlagSpecEntry{Action: entry.Action}, flag, nil)
+	}
+}
+
+// handleFlag carries out the action of a flag, with its arguments.
+func (pr *ParserResult) handleFlag(entry FlagSpecEntry, flag string, args []string) {
+	binary := entry.Arity > 0
+	switch entry.Action {
+	case flagInput:
+		pr.inputFileCallback(flag, args)
+	case flagObject:
+		pr.objectFileCallback(flag, args)
+	case flagOutput:
+		pr.outputFileCallback(flag, args)
+	case flagLanguage:
+		pr.languageCallback(flag, args)
+	case flagPrintOnly:
+		pr.printOnlyCallback(flag, args)
+	case flagCompileOnly:
+		pr.compileOnlyCallback(flag, args)
+	case flagPreprocessOnly:
+		pr.preprocessOnlyCallback(flag, args)
+	case flagAssembleOnly:
+		pr.assembleOnlyCallback(flag, args)
+	case flagVerbose:
+		pr.verboseFlagCallback(flag, args)
+	case flagEmitLLVM:
+		pr.emitLLVMCallback(flag, args)
+	case flagLTO:
+		pr.linkTimeOptimizationCallback(flag, args)
+	case flagDependency:
+		if binary {
+			pr.dependencyBinaryCallback(flag, args)
+		} else {
+			pr.dependencyOnlyCallback(flag, args)
+		}
+	case flagCompile:
+		if binary {
+			pr.compileBinaryCallback(flag, args)
+		} else {
+			pr.compileUnaryCallback(flag, args)
+		}
+	case flagLink:
+		if binary {
+			pr.linkBinaryCallback(flag, args)
+		} else {
+			pr.linkUnaryCallback(flag, args)
+		}
+	case flagCompileLink:
+		if binary {
+			pr.compileLinkBinaryCallback(flag, args)
+		} else {
+			pr.compileLinkUnaryCallback(flag, args)
+		}
+	case flagForbidden:
+		pr.warningLinkUnaryCallback(flag, args)
+	default:
+		pr.defaultBinaryCallback(flag, args)
+	}
+}
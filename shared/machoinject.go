@@ -0,0 +1,448 @@
+//
+// OCCAM
+//
+// Copyright (c) 2017, SRI International
+//
+//  All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// * Neither the name of SRI International nor the names of its contributors may
+//   be used to endorse or promote products derived from this software without
+//   specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+//
+
+package shared
+
+import (
+	"debug/macho"
+	"encoding/binary"
+	"fmt"
+	"os"
+)
+
+// Mach-O load commands that we know how to relocate, beyond the segments
+// that debug/macho already names.
+const (
+	lcSymtab                   = 0x2
+	lcDysymtab                 = 0xb
+	lcUUID                     = 0x1b
+	lcCodeSignature            = 0x1d
+	lcSegmentSplitInfo         = 0x1e
+	lcVersionMinMacosx         = 0x24
+	lcVersionMinIphoneos       = 0x25
+	lcFunctionStarts           = 0x26
+	lcDataInCode               = 0x29
+	lcSourceVersion            = 0x2a
+	lcDylibCodeSignDrs         = 0x2b
+	lcLinkerOption             = 0x2d
+	lcLinkerOptimizationHint   = 0x2e
+	lcVersionMinTvos           = 0x2f
+	lcVersionMinWatchos        = 0x30
+	lcNote                     = 0x31
+	lcBuildVersion             = 0x32
+	lcAtomInfo                 = 0x36
+	lcDyldExportsTrie          = 0x80000033
+	lcDyldChainedFixups        = 0x80000034
+	machoSectionTypeMask       = 0xff
+	machoSectionZerofill       = 0x1
+	machoSectionGBZerofill     = 0xc
+	machoSectionThreadZerofill = 0x12
+)
+
+// InjectMachOSection adds the section segName,sectName with the given
+// contents to the Mach-O object file objFile, which is rewritten in place.
+// The section is appended to the object's segment, so the ordinals of the
+// existing sections, and hence the relocations and symbols, are unchanged.
+func InjectMachOSection(objFile string, segName string, sectName string, contents []byte) (err error) {
+	info, err := os.Stat(objFile)
+	if err != nil {
+		return
+	}
+	data, err := os.ReadFile(objFile)
+	if err != nil {
+		return
+	}
+	injected, err := injectMachOSection(data, segName, sectName, contents)
+	if err != nil {
+		return fmt.Errorf("%s: %v", objFile, err)
+	}
+	return writeFileAtomically(objFile, injected, info.Mode().Perm())
+}
+
+// machoLayout records where the parts of a Mach-O object that we have to
+// move around live, along with the sizes of its 32 or 64 bit structures.
+type machoLayout struct {
+	order         binary.ByteOrder
+	is64          bool
+	headerSize    int
+	segmentSize   int
+	sectionSize   int
+	commandsEnd   uint64
+	firstData     uint64 // where the contents following the load commands begin
+	segmentEnd    uint64 // where the contents of the segment end
+	maxAlign      uint64
+	segmentOffset int // offset of the (last) segment command
+	topAddress    uint64
+}
+
+func injectMachOSection(data []byte, segName string, sectName string, contents []byte) (injected []byte, err error) {
+	layout, err := readMachOLayout(data, segName, sectName)
+	if err != nil {
+		return
+	}
+	order := layout.order
+
+	// the new section header is squeezed in after the load commands, if there is
+	// no room for it there we have to move everything down, preserving alignment.
+	var headerShift uint64
+	if room := layout.firstData - layout.commandsEnd; room < uint64(layout.sectionSize) {
+		headerShift = roundUp(uint64(layout.sectionSize)-room, layout.maxAlign)
+	}
+	// the contents are added at the end of the segment, which moves the
+	// relocations, symbols, strings and friends down.
+	wordSize := uint64(4)
+	if layout.is64 {
+		wordSize = 8
+	}
+	dataShift := roundUp(uint64(len(contents)), wordSize)
+
+	shift := func(offset uint64) uint64 {
+		switch {
+		case offset == 0 || offset < layout.firstData:
+			return offset
+		case offset >= layout.segmentEnd:
+			return offset + headerShift + dataShift
+		default:
+			return offset + headerShift
+		}
+	}
+
+	injected = make([]byte, uint64(len(data))+headerShift+dataShift)
+	copy(injected, data[:layout.headerSize])
+	commands := make([]byte, 0, layout.commandsEnd-uint64(layout.headerSize)+uint64(layout.sectionSize))
+
+	ncmds := order.Uint32(data[16:20])
+	offset := layout.headerSize
+	for i := uint32(0); i < ncmds; i++ {
+		cmd := order.Uint32(data[offset:])
+		size := int(order.Uint32(data[offset+4:]))
+		command := make([]byte, size)
+		copy(command, data[offset:offset+size])
+		relocateMachOCommand(layout, command, cmd, shift)
+		if offset == layout.segmentOffset {
+			command = appendMachOSection(layout, command, segName, sectName, uint64(len(contents)), layout.segmentEnd+headerShift)
+		}
+		commands = append(commands, command...)
+		offset += size
+	}
+	order.PutUint32(injected[20:24], uint32(len(commands)))
+	copy(injected[layout.headerSize:], commands)
+
+	copy(injected[shift(layout.firstData):], data[layout.firstData:layout.segmentEnd])
+	copy(injected[layout.segmentEnd+headerShift:], contents)
+	copy(injected[shift(layout.segmentEnd):], data[layout.segmentEnd:])
+	return
+}
+
+func roundUp(value uint64, align uint64) uint64 {
+	return (value + align - 1) / align * align
+}
+
+func machoString(field []byte) string {
+	for i, b := range field {
+		if b == 0 {
+			return string(field[:i])
+		}
+	}
+	return string(field)
+}
+
+func isZerofill(flags uint32) bool {
+	switch flags & machoSectionTypeMask {
+	case machoSectionZerofill, machoSectionGBZerofill, machoSectionThreadZerofill:
+		return true
+	}
+	return false
+}
+
+func readMachOLayout(data []byte, segName string, sectName string) (layout machoLayout, err error) {
+	if len(data) < 28 {
+		err = fmt.Errorf("not a Mach-O file")
+		return
+	}
+	switch {
+	case binary.LittleEndian.Uint32(data) == macho.Magic64:
+		layout.order, layout.is64 = binary.LittleEndian, true
+	case binary.BigEndian.Uint32(data) == macho.Magic64:
+		layout.order, layout.is64 = binary.BigEndian, true
+	case binary.LittleEndian.Uint32(data) == macho.Magic32:
+		layout.order = binary.LittleEndian
+	case binary.BigEndian.Uint32(data) == macho.Magic32:
+		layout.order = binary.BigEndian
+	default:
+		err = fmt.Errorf("not a Mach-O file")
+		return
+	}
+	order := layout.order
+	if layout.is64 {
+		layout.headerSize, layout.segmentSize, layout.sectionSize = 32, 72, 80
+		layout.maxAlign = 8
+	} else {
+		layout.headerSize, layout.segmentSize, layout.sectionSize = 28, 56, 68
+		layout.maxAlign = 4
+	}
+	if fileType := macho.Type(order.Uint32(data[12:16])); fileType != macho.TypeObj {
+		err = fmt.Errorf("not an object file (type %v)", fileType)
+		return
+	}
+	ncmds := order.Uint32(data[16:20])
+	layout.commandsEnd = uint64(layout.headerSize) + uint64(order.Uint32(data[20:24]))
+	if layout.commandsEnd > uint64(len(data)) {
+		err = fmt.Errorf("load commands are out of bounds")
+		return
+	}
+	layout.firstData = uint64(len(data))
+	layout.segmentOffset = -1
+
+	// note the start of the file contents, wherever they are referred to from.
+	noteData := func(offset uint64, size uint64) error {
+		if size == 0 {
+			return nil
+		}
+		if offset < layout.commandsEnd || offset+size > uint64(len(data)) {
+			return fmt.Errorf("contents at offset %v are out of bounds", offset)
+		}
+		if offset < layout.firstData {
+			layout.firstData = offset
+		}
+		return nil
+	}
+
+	offset := layout.headerSize
+	for i := uint32(0); i < ncmds; i++ {
+		if uint64(offset+8) > layout.commandsEnd {
+			err = fmt.Errorf("load command %v is out of bounds", i)
+			return
+		}
+		cmd := order.Uint32(data[offset:])
+		size := int(order.Uint32(data[offset+4:]))
+		if size < 8 || uint64(offset+size) > layout.commandsEnd {
+			err = fmt.Errorf("load command %v has a bad size", i)
+			return
+		}
+		command := data[offset : offset+size]
+		switch cmd {
+		case uint32(macho.LoadCmdSegment), uint32(macho.LoadCmdSegment64):
+			if (cmd == uint32(macho.LoadCmdSegment64)) != layout.is64 || size < layout.segmentSize {
+				err = fmt.Errorf("unexpected segment command")
+				return
+			}
+			layout.segmentOffset = offset
+			var fileOffset, fileSize uint64
+			var nsects uint32
+			if layout.is64 {
+				fileOffset, fileSize = order.Uint64(command[40:]), order.Uint64(command[48:])
+				nsects = order.Uint32(command[64:])
+			} else {
+				fileOffset, fileSize = uint64(order.Uint32(command[32:])), uint64(order.Uint32(command[36:]))
+				nsects = order.Uint32(command[48:])
+			}
+			if err = noteData(fileOffset, fileSize); err != nil {
+				return
+			}
+			if fileOffset+fileSize > layout.segmentEnd {
+				layout.segmentEnd = fileOffset + fileSize
+			}
+			if layout.segmentSize+int(nsects)*layout.sectionSize > size {
+				err = fmt.Errorf("segment command is too small for its sections")
+				return
+			}
+			for j := 0; j < int(nsects); j++ {
+				section := command[layout.segmentSize+j*layout.sectionSize:]
+				if machoString(section[16:32]) == segName && machoString(section[0:16]) == sectName {
+					err = fmt.Errorf("there already is a %v,%v section", segName, sectName)
+					return
+				}
+				var addr, secSize uint64
+				var secOffset, align, reloff, nreloc, flags uint32
+				if layout.is64 {
+					addr, secSize = order.Uint64(section[32:]), order.Uint64(section[40:])
+					secOffset, align, reloff, nreloc, flags = order.Uint32(section[48:]), order.Uint32(section[52:]),
+						order.Uint32(section[56:]), order.Uint32(section[60:]), order.Uint32(section[64:])
+				} else {
+					addr, secSize = uint64(order.Uint32(section[32:])), uint64(order.Uint32(section[36:]))
+					secOffset, align, reloff, nreloc, flags = order.Uint32(section[40:]), order.Uint32(section[44:]),
+						order.Uint32(section[48:]), order.Uint32(section[52:]), order.Uint32(section[56:])
+				}
+				if addr+secSize > layout.topAddress {
+					layout.topAddress = addr + secSize
+				}
+				if align > 15 {
+					err = fmt.Errorf("unexpected section alignment 2^%v", align)
+					return
+				}
+				if uint64(1)<<align > layout.maxAlign {
+					layout.maxAlign = uint64(1) << align
+				}
+				if !isZerofill(flags) {
+					if err = noteData(uint64(secOffset), secSize); err != nil {
+						return
+					}
+					if uint64(secOffset)+secSize > layout.segmentEnd {
+						layout.segmentEnd = uint64(secOffset) + secSize
+					}
+				}
+				if err = noteData(uint64(reloff), uint64(nreloc)*8); err != nil {
+					return
+				}
+			}
+		case lcSymtab:
+			nlistSize := uint64(12)
+			if layout.is64 {
+				nlistSize = 16
+			}
+			if err = noteData(uint64(order.Uint32(command[8:])), uint64(order.Uint32(command[12:]))*nlistSize); err == nil {
+				err = noteData(uint64(order.Uint32(command[16:])), uint64(order.Uint32(command[20:])))
+			}
+		case lcDysymtab:
+			for _, field := range []int{32, 40, 48, 56, 64, 72} {
+				if err == nil {
+					err = noteData(uint64(order.Uint32(command[field:])), uint64(order.Uint32(command[field+4:])))
+				}
+			}
+		case lcCodeSignature, lcSegmentSplitInfo, lcFunctionStarts, lcDataInCode, lcDylibCodeSignDrs,
+			lcLinkerOptimizationHint, lcAtomInfo, lcDyldExportsTrie, lcDyldChainedFixups:
+			err = noteData(uint64(order.Uint32(command[8:])), uint64(order.Uint32(command[12:])))
+		case lcNote:
+			err = noteData(order.Uint64(command[24:]), order.Uint64(command[32:]))
+		case lcUUID, lcVersionMinMacosx, lcVersionMinIphoneos, lcVersionMinTvos, lcVersionMinWatchos,
+			lcSourceVersion, lcLinkerOption, lcBuildVersion:
+			// nothing to relocate
+		default:
+			err = fmt.Errorf("unsupported load command 0x%x", cmd)
+		}
+		if err != nil {
+			return
+		}
+		offset += size
+	}
+	if layout.segmentOffset < 0 {
+		err = fmt.Errorf("no segment to add the section to")
+		return
+	}
+	if layout.segmentEnd < layout.firstData {
+		layout.segmentEnd = layout.firstData
+	}
+	return
+}
+
+// relocateMachOCommand moves the file offsets in the load command along with the contents they refer to.
+func relocateMachOCommand(layout machoLayout, command []byte, cmd uint32, shift func(uint64) uint64) {
+	order := layout.order
+	shift32 := func(field int) {
+		order.PutUint32(command[field:], uint32(shift(uint64(order.Uint32(command[field:])))))
+	}
+	switch cmd {
+	case uint32(macho.LoadCmdSegment64):
+		order.PutUint64(command[40:], shift(order.Uint64(command[40:])))
+		nsects := int(order.Uint32(command[64:]))
+		for j := 0; j < nsects; j++ {
+			base := layout.segmentSize + j*layout.sectionSize
+			if !isZerofill(order.Uint32(command[base+64:])) {
+				shift32(base + 48)
+			}
+			if order.Uint32(command[base+60:]) > 0 {
+				shift32(base + 56)
+			}
+		}
+	case uint32(macho.LoadCmdSegment):
+		shift32(32)
+		nsects := int(order.Uint32(command[48:]))
+		for j := 0; j < nsects; j++ {
+			base := layout.segmentSize + j*layout.sectionSize
+			if !isZerofill(order.Uint32(command[base+56:])) {
+				shift32(base + 40)
+			}
+			if order.Uint32(command[base+52:]) > 0 {
+				shift32(base + 48)
+			}
+		}
+	case lcSymtab:
+		if order.Uint32(command[12:]) > 0 {
+			shift32(8)
+		}
+		if order.Uint32(command[20:]) > 0 {
+			shift32(16)
+		}
+	case lcDysymtab:
+		for _, field := range []int{32, 40, 48, 56, 64, 72} {
+			if order.Uint32(command[field+4:]) > 0 {
+				shift32(field)
+			}
+		}
+	case lcCodeSignature, lcSegmentSplitInfo, lcFunctionStarts, lcDataInCode, lcDylibCodeSignDrs,
+		lcLinkerOptimizationHint, lcAtomInfo, lcDyldExportsTrie, lcDyldChainedFixups:
+		if order.Uint32(command[12:]) > 0 {
+			shift32(8)
+		}
+	case lcNote:
+		if order.Uint64(command[32:]) > 0 {
+			order.PutUint64(command[24:], shift(order.Uint64(command[24:])))
+		}
+	}
+}
+
+// appendMachOSection adds our section header to the end of the segment command, and grows the segment to cover it.
+func appendMachOSection(layout machoLayout, command []byte, segName string, sectName string, size uint64, fileOffset uint64) []byte {
+	order := layout.order
+	section := make([]byte, layout.sectionSize)
+	copy(section[0:16], sectName)
+	copy(section[16:32], segName)
+	addr := layout.topAddress
+	if layout.is64 {
+		order.PutUint64(section[32:], addr)
+		order.PutUint64(section[40:], size)
+		order.PutUint32(section[48:], uint32(fileOffset))
+
+		vmaddr, fileoff := order.Uint64(command[24:]), order.Uint64(command[40:])
+		if addr+size-vmaddr > order.Uint64(command[32:]) {
+			order.PutUint64(command[32:], addr+size-vmaddr)
+		}
+		order.PutUint64(command[48:], fileOffset+size-fileoff)
+		order.PutUint32(command[64:], order.Uint32(command[64:])+1)
+	} else {
+		order.PutUint32(section[32:], uint32(addr))
+		order.PutUint32(section[36:], uint32(size))
+		order.PutUint32(section[40:], uint32(fileOffset))
+
+		vmaddr, fileoff := uint64(order.Uint32(command[24:])), uint64(order.Uint32(command[32:]))
+		if addr+size-vmaddr > uint64(order.Uint32(command[28:])) {
+			order.PutUint32(command[28:], uint32(addr+size-vmaddr))
+		}
+		order.PutUint32(command[36:], uint32(fileOffset+size-fileoff))
+		order.PutUint32(command[48:], order.Uint32(command[48:])+1)
+	}
+	command = append(command, section...)
+	order.PutUint32(command[4:], uint32(len(command)))
+	return command
+}
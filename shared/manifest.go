@@ -0,0 +1,200 @@
+//
+// OCCAM
+//
+// Copyright (c) 2017, SRI International
+//
+//  All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// * Neither the name of SRI International nor the names of its contributors may
+//   be used to endorse or promote products derived from this software without
+//   specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+//
+
+package shared
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// The formats the manifest can be written in.
+const (
+	manifestText = "text"
+	manifestJSON = "json"
+	manifestCSV  = "csv"
+)
+
+// The origins of the bitcode files in the manifest.
+const (
+	originRecorded = "recorded" // the file at the path recorded at build time
+	originStore    = "store"    // the copy in the bitcode store
+	originEmbedded = "embedded" // the copy embedded in the object
+	originMissing  = "missing"  // nowhere to be found
+)
+
+// ManifestEntry is a bitcode file in the machine readable manifest.
+type ManifestEntry struct {
+	Artifact string `json:"artifact"`           // the path of the bitcode file recorded at build time
+	Physical string `json:"physical,omitempty"` // the file the bitcode was actually read from
+	Object   string `json:"object"`             // the object, binary or archive the record was found in
+	Member   string `json:"member,omitempty"`   // the archive member the record was found in
+	Instance int    `json:"instance,omitempty"` // which of the archive members of that name it is
+	Hash     string `json:"hash,omitempty"`     // the sha256 of the bitcode
+	Size     int64  `json:"size"`               // the size of the bitcode
+	Origin   string `json:"origin"`             // recorded, store, embedded or missing
+}
+
+// Manifest is the machine readable manifest of the bitcode extracted from the input.
+type Manifest struct {
+	Input   string          `json:"input"`
+	Output  string          `json:"output"`
+	Entries []ManifestEntry `json:"entries"`
+}
+
+// manifestCSVHeader names the columns of the CSV manifest.
+var manifestCSVHeader = []string{"artifact", "physical", "object", "member", "instance", "hash", "size", "origin"}
+
+// bitcodeSource is where the bitcode records are read from: a file, or a member of an archive.
+type bitcodeSource struct {
+	label   string // for messages
+	archive string
+	member  ArchiveMember
+}
+
+func fileSource(path string) bitcodeSource {
+	return bitcodeSource{label: path}
+}
+
+func memberSource(archive *Archive, member ArchiveMember) bitcodeSource {
+	return bitcodeSource{label: archive.MemberLabel(member), archive: archive.Path, member: member}
+}
+
+// manifestRecorder collects the manifest entries over the course of an extraction.
+type manifestRecorder struct {
+	entries []ManifestEntry
+}
+
+func (mr *manifestRecorder) bitcode(source bitcodeSource, record BitcodeRecord, bcFile string, embedded bool) {
+	if mr == nil {
+		return
+	}
+	entry := ManifestEntry{Artifact: record.Path, Physical: bcFile, Object: source.label}
+	if source.archive != "" {
+		entry.Object, entry.Member, entry.Instance = source.archive, source.member.Name, source.member.Instance
+	}
+	switch {
+	case bcFile == "":
+		entry.Origin = originMissing
+	case embedded:
+		// the temporary copy does not outlive get-bc
+		entry.Origin, entry.Physical = originEmbedded, ""
+	case bcFile == record.Path:
+		entry.Origin = originRecorded
+	default:
+		entry.Origin = originStore
+	}
+	if bcFile != "" {
+		if info, err := os.Stat(bcFile); err == nil {
+			entry.Size = info.Size()
+		}
+		if hash, err := BitcodeHash(bcFile); err == nil {
+			entry.Hash = hash
+		}
+	}
+	mr.entries = append(mr.entries, entry)
+}
+
+// parseManifestFormats checks the comma separated list of manifest formats.
+func parseManifestFormats(formats string) (parsed []string, err error) {
+	if formats == "" {
+		return []string{manifestText}, nil
+	}
+	for _, format := range strings.Split(formats, ",") {
+		switch format = strings.TrimSpace(format); format {
+		case manifestText, manifestJSON, manifestCSV:
+			parsed = append(parsed, format)
+		default:
+			err = fmt.Errorf("unknown manifest format %q, expected text, json or csv", format)
+			return
+		}
+	}
+	return
+}
+
+// manifestContents renders the manifest in the format, which is either json or csv.
+func manifestContents(manifest Manifest, format string) (contents []byte, err error) {
+	if format == manifestJSON {
+		if contents, err = json.MarshalIndent(manifest, "", "  "); err == nil {
+			contents = append(contents, '\n')
+		}
+		return
+	}
+	var buf bytes.Buffer
+	writer := csv.NewWriter(&buf)
+	rows := [][]string{manifestCSVHeader}
+	for _, entry := range manifest.Entries {
+		instance := ""
+		if entry.Instance > 0 {
+			instance = strconv.Itoa(entry.Instance)
+		}
+		rows = append(rows, []string{entry.Artifact, entry.Physical, entry.Object, entry.Member, instance,
+			entry.Hash, strconv.FormatInt(entry.Size, 10), entry.Origin})
+	}
+	if err = writer.WriteAll(rows); err == nil {
+		contents = buf.Bytes()
+	}
+	return
+}
+
+// writeStructuredManifest writes the manifest the recorder collected in the json or csv format.
+func writeStructuredManifest(ea ExtractionArgs, format string) (success bool) {
+	manifest := Manifest{Input: ea.InputFile, Output: ea.OutputFile}
+	if ea.manifest != nil {
+		manifest.Entries = ea.manifest.entries
+	}
+	if ea.SortBitcodeFiles {
+		sort.SliceStable(manifest.Entries, func(i, j int) bool {
+			return manifest.Entries[i].Artifact < manifest.Entries[j].Artifact
+		})
+	}
+	contents, err := manifestContents(manifest, format)
+	if err != nil {
+		LogError("Could not encode the %s manifest: %v\n", format, err)
+		return
+	}
+	manifestFilename := ea.OutputFile + ".llvm.manifest." + format
+	if err = os.WriteFile(manifestFilename, contents, 0644); err != nil {
+		LogError("There was an error while writing the manifest file: %v\n", err)
+		return
+	}
+	informUser("Manifest file written to %s.\n", manifestFilename)
+	success = true
+	return
+}
@@ -0,0 +1,192 @@
+//
+// OCCAM
+//
+// Copyright (c) 2017, SRI International
+//
+//  All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// * Neither the name of SRI International nor the names of its contributors may
+//   be used to endorse or promote products derived from this software without
+//   specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+//
+
+package shared
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// forEachParallel calls fn with every index below n, on at most jobs goroutines at once.
+func forEachParallel(n int, jobs int, fn func(i int)) {
+	if jobs < 1 {
+		jobs = 1
+	}
+	indices := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < jobs && w < n; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indices {
+				fn(i)
+			}
+		}()
+	}
+	for i := 0; i < n; i++ {
+		indices <- i
+	}
+	close(indices)
+	wg.Wait()
+}
+
+// memberExtraction is what became of the extraction of an archive member.
+type memberExtraction struct {
+	records []BitcodeRecord
+	bcFiles []string
+	success bool
+	skipped bool // it is not an object file
+	err     error
+}
+
+// extractMembers calls extract on every member of the archive, ea.Jobs of them at a time. Each call gets
+// recorders of its own, which are merged back in archive order, so that neither the results, nor the
+// coverage report and manifest, depend on the scheduling.
+func extractMembers(ea ExtractionArgs, archive *Archive, extract func(ea ExtractionArgs, r io.ReaderAt, member ArchiveMember) memberExtraction) (results []memberExtraction) {
+	results = make([]memberExtraction, len(archive.Members))
+	coverages := make([]*coverageRecorder, len(archive.Members))
+	manifests := make([]*manifestRecorder, len(archive.Members))
+	forEachParallel(len(archive.Members), ea.Jobs, func(i int) {
+		memberArgs := ea
+		if ea.coverage != nil {
+			coverages[i] = &coverageRecorder{}
+			memberArgs.coverage = coverages[i]
+		}
+		if ea.manifest != nil {
+			manifests[i] = &manifestRecorder{}
+			memberArgs.manifest = manifests[i]
+		}
+		member := archive.Members[i]
+		results[i].err = archive.WithMember(member, func(r io.ReaderAt) error {
+			results[i] = extract(memberArgs, r, member)
+			return results[i].err
+		})
+	})
+	for i := range archive.Members {
+		if coverages[i] != nil {
+			ea.coverage.entries = append(ea.coverage.entries, coverages[i].entries...)
+		}
+		if manifests[i] != nil {
+			ea.manifest.entries = append(ea.manifest.entries, manifests[i].entries...)
+		}
+	}
+	return
+}
+
+// linkBitcodeTree links the bitcode files by reducing them, ea.Jobs llvm-links at a time: first chunks of
+// consecutive files are linked into temporary modules, which are then linked together, and so on,
+// until one link is left, which produces the output. The chunks, and the order of the files within them,
+// only depend on the files, so the output is the same however the links get scheduled.
+func linkBitcodeTree(ea ExtractionArgs, filesToLink []string, argMax int) (success bool) {
+	tmpDirName, err := os.MkdirTemp(".", "glinking")
+	if err != nil {
+		LogError("The temporary directory in which to put temporary linking files could not be created.")
+		return
+	}
+	if !ea.KeepTemp { // delete temporary folder after used unless told otherwise
+		LogInfo("Temporary folder will be deleted")
+		defer CheckDefer(func() error { return os.RemoveAll(tmpDirName) })
+	} else {
+		LogInfo("Keeping the temporary folder")
+	}
+
+	var verbose []string
+	if ea.Verbose {
+		verbose = []string{"-v"}
+	}
+	files := filesToLink
+	// at first, split the files evenly between the jobs, from then on only the command line size limits the chunks
+	chunkSize := (len(files) + ea.Jobs - 1) / ea.Jobs
+	for level := 0; ; level++ {
+		chunks := chunkFiles(files, chunkSize, argMax)
+		if len(chunks) == 1 {
+			// Append any custom llvm-link flags requested by the user.
+			// We only do this for the last llvm-link invocation.
+			linkArgs := append(append(verbose, LLVMLINKFlags...), "-o", ea.OutputFile)
+			success, err = execCmd(ea.LlvmLinkerName, append(linkArgs, chunks[0]...), "")
+			if !success {
+				LogError("There was an error linking input files into %s because %v.\n", ea.OutputFile, err)
+				return
+			}
+			informUser("Bitcode file extracted to: %s.\n", ea.OutputFile)
+			return
+		}
+		LogInfo("linkBitcodeTree: linking %v files in %v chunks at level %v\n", len(files), len(chunks), level)
+		outputs := make([]string, len(chunks))
+		failures := make([]error, len(chunks))
+		forEachParallel(len(chunks), ea.Jobs, func(i int) {
+			outputs[i] = filepath.Join(tmpDirName, fmt.Sprintf("level%d-%06d.bc", level, i))
+			linkArgs := append(append([]string{}, verbose...), "-o", outputs[i])
+			if ok, linkErr := execCmd(ea.LlvmLinkerName, append(linkArgs, chunks[i]...), ""); !ok {
+				failures[i] = fmt.Errorf("linking %v into %v failed: %v", chunks[i], outputs[i], linkErr)
+			}
+		})
+		for _, failure := range failures {
+			if failure != nil {
+				LogError("There was an error linking input files into %s because %v.\n", ea.OutputFile, failure)
+				return
+			}
+		}
+		files = outputs
+		chunkSize = len(files)
+	}
+}
+
+// chunkFiles splits the files into runs of at most chunkSize consecutive files, whose command line
+// fits within argMax. Each chunk has at least two files, so that every round of linking makes progress.
+func chunkFiles(files []string, chunkSize int, argMax int) (chunks [][]string) {
+	if chunkSize < 2 {
+		chunkSize = 2
+	}
+	var chunk []string
+	size := 0
+	for _, file := range files {
+		if len(chunk) >= 2 && (len(chunk) == chunkSize || size+len(file) > argMax) {
+			chunks = append(chunks, chunk)
+			chunk, size = nil, 0
+		}
+		chunk = append(chunk, file)
+		size += len(file)
+	}
+	if len(chunk) == 1 && len(chunks) > 0 {
+		// a lone file is better off with the chunk before it
+		chunks[len(chunks)-1] = append(chunks[len(chunks)-1], chunk[0])
+	} else if len(chunk) > 0 {
+		chunks = append(chunks, chunk)
+	}
+	return
+}
@@ -45,9 +45,12 @@ import (
 )
 
 // ParserResult is the result of parsing and partioning the command line arguments.
+// InputLanguages are the languages given by -x to the InputFiles, with "" for those
+// that the compiler knows by their extension.
 type ParserResult struct {
 	InputList        []string
 	InputFiles       []string
+	InputLanguages   []string
 	ObjectFiles      []string
 	OutputFilename   string
 	CompileArgs      []string
@@ -62,11 +65,15 @@ type ParserResult struct {
 	IsEmitLLVM       bool
 	IsLTO            bool
 	IsPrintOnly      bool
+
+	// the language named by the last -x, if it is not none
+	language string
 }
 
 const parserResultFormat = `
 InputList:         %v
 InputFiles:        %v
+InputLanguages:    %v
 ObjectFiles:       %v
 OutputFilename:    %v
 CompileArgs:       %v
@@ -87,6 +94,7 @@ func (pr *ParserResult) String() string {
 	return fmt.Sprintf(parserResultFormat,
 		pr.InputList,
 		pr.InputFiles,
+		pr.InputLanguages,
 		pr.ObjectFiles,
 		pr.OutputFilename,
 		pr.CompileArgs,
@@ -103,16 +111,6 @@ func (pr *ParserResult) String() string {
 		pr.IsPrintOnly)
 }
 
-type flagInfo struct {
-	arity   int
-	handler func(string, []string)
-}
-
-type argPattern struct {
-	pattern string
-	finfo   flagInfo
-}
-
 // SkipBitcodeGeneration indicates whether or not we should generate bitcode for these command line options.
 func (pr *ParserResult) SkipBitcodeGeneration() bool {
 	reason := "No particular reason"
@@ -160,259 +158,24 @@ func Parse(argList []string) ParserResult {
 	var pr = ParserResult{}
 	pr.InputList = argList
 
-	var argsExactMatches = map[string]flagInfo{
-
-		"/dev/null": {0, pr.inputFileCallback}, //iam: linux kernel
-
-		"-":  {0, pr.printOnlyCallback},
-		"-o": {1, pr.outputFileCallback},
-		"-c": {0, pr.compileOnlyCallback},
-		"-E": {0, pr.preprocessOnlyCallback},
-		"-S": {0, pr.assembleOnlyCallback},
-
-		"--verbose": {0, pr.verboseFlagCallback},
-		"--param":   {1, pr.defaultBinaryCallback},
-		"-aux-info": {1, pr.defaultBinaryCallback},
-
-		"-target": {1, pr.compileLinkBinaryCallback},
-
-		"--version": {0, pr.compileOnlyCallback},
-		"-v":        {0, pr.compileOnlyCallback},
-
-		"-w": {0, pr.compileUnaryCallback},
-		"-W": {0, pr.compileUnaryCallback},
-
-		"-emit-llvm": {0, pr.emitLLVMCallback},
-		"-flto":      {0, pr.linkTimeOptimizationCallback},
-
-		"-pipe":                  {0, pr.compileUnaryCallback},
-		"-undef":                 {0, pr.compileUnaryCallback},
-		"-nostdinc":              {0, pr.compileUnaryCallback},
-		"-nostdinc++":            {0, pr.compileUnaryCallback},
-		"-Qunused-arguments":     {0, pr.compileUnaryCallback},
-		"-no-integrated-as":      {0, pr.compileUnaryCallback},
-		"-integrated-as":         {0, pr.compileUnaryCallback},
-		"-no-canonical-prefixes": {0, pr.compileLinkUnaryCallback},
-
-		"--sysroot": {1, pr.compileLinkBinaryCallback}, //iam: musl stuff
-
-		//<archaic flags>
-		"-no-cpp-precomp": {0, pr.compileUnaryCallback},
-		//</archaic flags>
-
-		"-pthread":     {0, pr.linkUnaryCallback},
-		"-nostdlibinc": {0, pr.compileUnaryCallback},
-
-		"-mno-omit-leaf-frame-pointer": {0, pr.compileUnaryCallback},
-		"-maes":                        {0, pr.compileUnaryCallback},
-		"-mno-aes":                     {0, pr.compileUnaryCallback},
-		"-mavx":                        {0, pr.compileUnaryCallback},
-		"-mno-avx":                     {0, pr.compileUnaryCallback},
-		"-mavx2":                       {0, pr.compileUnaryCallback},
-		"-mno-avx2":                    {0, pr.compileUnaryCallback},
-		"-mno-red-zone":                {0, pr.compileUnaryCallback},
-		"-mmmx":                        {0, pr.compileUnaryCallback},
-		"-mbmi":                        {0, pr.compileUnaryCallback},
-		"-mbmi2":                       {0, pr.compileUnaryCallback},
-		"-mf161c":                      {0, pr.compileUnaryCallback},
-		"-mfma":                        {0, pr.compileUnaryCallback},
-		"-mno-mmx":                     {0, pr.compileUnaryCallback},
-		"-mno-global-merge":            {0, pr.compileUnaryCallback}, //iam: linux kernel stuff
-		"-mno-80387":                   {0, pr.compileUnaryCallback}, //iam: linux kernel stuff
-		"-msse":                        {0, pr.compileUnaryCallback},
-		"-mno-sse":                     {0, pr.compileUnaryCallback},
-		"-msse2":                       {0, pr.compileUnaryCallback},
-		"-mno-sse2":                    {0, pr.compileUnaryCallback},
-		"-msse3":                       {0, pr.compileUnaryCallback},
-		"-mno-sse3":                    {0, pr.compileUnaryCallback},
-		"-mssse3":                      {0, pr.compileUnaryCallback},
-		"-mno-ssse3":                   {0, pr.compileUnaryCallback},
-		"-msse4":                       {0, pr.compileUnaryCallback},
-		"-mno-sse4":                    {0, pr.compileUnaryCallback},
-		"-msse4.1":                     {0, pr.compileUnaryCallback},
-		"-mno-sse4.1":                  {0, pr.compileUnaryCallback},
-		"-msse4.2":                     {0, pr.compileUnaryCallback},
-		"-mno-sse4.2":                  {0, pr.compileUnaryCallback},
-		"-msoft-float":                 {0, pr.compileUnaryCallback},
-		"-m3dnow":                      {0, pr.compileUnaryCallback},
-		"-mno-3dnow":                   {0, pr.compileUnaryCallback},
-		"-m16":                         {0, pr.compileLinkUnaryCallback}, //iam: linux kernel stuff
-		"-m32":                         {0, pr.compileLinkUnaryCallback},
-		"-m64":                         {0, pr.compileLinkUnaryCallback},
-		"-mstackrealign":               {0, pr.compileUnaryCallback},
-		"-mretpoline-external-thunk":   {0, pr.compileUnaryCallback}, //iam: linux kernel stuff
-		"-mno-fp-ret-in-387":           {0, pr.compileUnaryCallback}, //iam: linux kernel stuff
-		"-mskip-rax-setup":             {0, pr.compileUnaryCallback}, //iam: linux kernel stuff
-		"-mindirect-branch-register":   {0, pr.compileUnaryCallback}, //iam: linux kernel stuff
-
-		"-mllvm": {1, pr.compileBinaryCallback}, //iam: chromium
-
-		"-A": {1, pr.compileBinaryCallback},
-		"-D": {1, pr.compileBinaryCallback},
-		"-U": {1, pr.compileBinaryCallback},
-
-		"-arch": {1, pr.compileBinaryCallback}, //iam: openssl
-
-		"-P": {1, pr.compileUnaryCallback}, //iam: linux kernel stuff (linker script stuff)
-		"-C": {1, pr.compileUnaryCallback}, //iam: linux kernel stuff (linker script stuff)
-
-		"-M":   {0, pr.dependencyOnlyCallback},
-		"-MM":  {0, pr.dependencyOnlyCallback},
-		"-MF":  {1, pr.dependencyBinaryCallback},
-		"-MJ":  {1, pr.dependencyBinaryCallback},
-		"-MG":  {0, pr.dependencyOnlyCallback},
-		"-MP":  {0, pr.dependencyOnlyCallback},
-		"-MT":  {1, pr.dependencyBinaryCallback},
-		"-MQ":  {1, pr.dependencyBinaryCallback},
-		"-MD":  {0, pr.dependencyOnlyCallback},
-		"-MV":  {0, pr.dependencyOnlyCallback},
-		"-MMD": {0, pr.dependencyOnlyCallback},
-
-		"-I":                 {1, pr.compileBinaryCallback},
-		"-idirafter":         {1, pr.compileBinaryCallback},
-		"-include":           {1, pr.compileBinaryCallback},
-		"-imacros":           {1, pr.compileBinaryCallback},
-		"-iprefix":           {1, pr.compileBinaryCallback},
-		"-iwithprefix":       {1, pr.compileBinaryCallback},
-		"-iwithprefixbefore": {1, pr.compileBinaryCallback},
-		"-isystem":           {1, pr.compileBinaryCallback},
-		"-isysroot":          {1, pr.compileBinaryCallback},
-		"-iquote":            {1, pr.compileBinaryCallback},
-		"-imultilib":         {1, pr.compileBinaryCallback},
-
-		"-ansi":     {0, pr.compileUnaryCallback},
-		"-pedantic": {0, pr.compileUnaryCallback},
-		"-x":        {1, pr.compileBinaryCallback},
-
-		"-g":                    {0, pr.compileUnaryCallback},
-		"-g0":                   {0, pr.compileUnaryCallback},
-		"-g1":                   {0, pr.compileUnaryCallback},
-		"-g2":                   {0, pr.compileUnaryCallback},
-		"-g3":                   {0, pr.compileUnaryCallback},
-		"-ggdb":                 {0, pr.compileUnaryCallback},
-		"-ggdb0":                {0, pr.compileUnaryCallback},
-		"-ggdb1":                {0, pr.compileUnaryCallback},
-		"-ggdb2":                {0, pr.compileUnaryCallback},
-		"-ggdb3":                {0, pr.compileUnaryCallback},
-		"-gdwarf":               {0, pr.compileUnaryCallback},
-		"-gdwarf-2":             {0, pr.compileUnaryCallback},
-		"-gdwarf-3":             {0, pr.compileUnaryCallback},
-		"-gdwarf-4":             {0, pr.compileUnaryCallback},
-		"-gline-tables-only":    {0, pr.compileUnaryCallback},
-		"-grecord-gcc-switches": {0, pr.compileUnaryCallback},
-		"-ggnu-pubnames":        {0, pr.compileUnaryCallback},
-
-		"-p":  {0, pr.compileUnaryCallback},
-		"-pg": {0, pr.compileUnaryCallback},
-
-		"-O":     {0, pr.compileUnaryCallback},
-		"-O0":    {0, pr.compileUnaryCallback},
-		"-O1":    {0, pr.compileUnaryCallback},
-		"-O2":    {0, pr.compileUnaryCallback},
-		"-O3":    {0, pr.compileUnaryCallback},
-		"-Os":    {0, pr.compileUnaryCallback},
-		"-Ofast": {0, pr.compileUnaryCallback},
-		"-Og":    {0, pr.compileUnaryCallback},
-		"-Oz":    {0, pr.compileUnaryCallback}, //iam: linux kernel
-
-		"-Xclang":        {1, pr.compileBinaryCallback},
-		"-Xpreprocessor": {1, pr.defaultBinaryCallback},
-		"-Xassembler":    {1, pr.defaultBinaryCallback},
-		"-Xlinker":       {1, pr.defaultBinaryCallback},
-
-		"-l":            {1, pr.linkBinaryCallback},
-		"-L":            {1, pr.linkBinaryCallback},
-		"-T":            {1, pr.linkBinaryCallback},
-		"-u":            {1, pr.linkBinaryCallback},
-		"-install_name": {1, pr.linkBinaryCallback},
-
-		"-e":     {1, pr.linkBinaryCallback},
-		"-rpath": {1, pr.linkBinaryCallback},
-
-		"-shared":        {0, pr.linkUnaryCallback},
-		"-static":        {0, pr.linkUnaryCallback},
-		"-static-libgcc": {0, pr.linkUnaryCallback}, //iam: musl stuff
-		"-pie":           {0, pr.linkUnaryCallback},
-		"-nostdlib":      {0, pr.linkUnaryCallback},
-		"-nodefaultlibs": {0, pr.linkUnaryCallback},
-		"-rdynamic":      {0, pr.linkUnaryCallback},
-
-		"-dynamiclib":            {0, pr.linkUnaryCallback},
-		"-current_version":       {1, pr.linkBinaryCallback},
-		"-compatibility_version": {1, pr.linkBinaryCallback},
-
-		"-print-multi-directory":  {0, pr.compileUnaryCallback},
-		"-print-multi-lib":        {0, pr.compileUnaryCallback},
-		"-print-libgcc-file-name": {0, pr.compileUnaryCallback},
-		"-print-search-dirs":      {0, pr.compileUnaryCallback},
-
-		"-fprofile-arcs": {0, pr.compileLinkUnaryCallback},
-		"-coverage":      {0, pr.compileLinkUnaryCallback},
-		"--coverage":     {0, pr.compileLinkUnaryCallback},
-		"-fopenmp":       {0, pr.compileLinkUnaryCallback},
-
-		"-Wl,-dead_strip": {0, pr.warningLinkUnaryCallback},
-		"-dead_strip":     {0, pr.warningLinkUnaryCallback}, //iam: tor does this. We lose the bitcode :-(
-	}
+	// the flags, and what they do, are in flags.json (and in the user's LLVMFlagsFile)
+	flags := currentFlags()
 
-	// iam: this is a list because matching needs to be done in order.
-	// if you add a NEW pattern; make sure it is before any existing pattern that also
-	// matches and has a conflicting flagInfo value. Also be careful with flags that can contain filenames, like
-	// linker info flags or dependency flags
-	var argPatterns = [...]argPattern{
-		// dependency file generation (comes first because it can conatin file names)
-		{`^-MF.*$`, flagInfo{0, pr.compileUnaryCallback}}, //Write depfile output from -MMD, -MD, -MM, or -M to <file>
-		{`^-MJ.*$`, flagInfo{0, pr.compileUnaryCallback}}, //Write a compilation database entry per input
-		{`^-MQ.*$`, flagInfo{0, pr.compileUnaryCallback}}, //Specify name of main file output to quote in depfile
-		{`^-MT.*$`, flagInfo{0, pr.compileUnaryCallback}}, //Specify name of main file output in depfile
-		//iam, need to be careful here, not mix up linker and warning flags.
-		{`^-Wl,.+$`, flagInfo{0, pr.linkUnaryCallback}},
-		{`^-W[^l].*$`, flagInfo{0, pr.compileUnaryCallback}},
-		{`^-W[l][^,].*$`, flagInfo{0, pr.compileUnaryCallback}}, //iam: tor has a few -Wl...
-		{`^-(l|L).+$`, flagInfo{0, pr.linkUnaryCallback}},
-		{`^-I.+$`, flagInfo{0, pr.compileUnaryCallback}},
-		{`^-D.+$`, flagInfo{0, pr.compileUnaryCallback}},
-		{`^-B.+$`, flagInfo{0, pr.compileLinkUnaryCallback}},
-		{`^-isystem.+$`, flagInfo{0, pr.compileLinkUnaryCallback}},
-		{`^-U.+$`, flagInfo{0, pr.compileUnaryCallback}},
-		{`^-fsanitize=.+$`, flagInfo{0, pr.compileLinkUnaryCallback}},
-		{`^-fuse-ld=.+$`, flagInfo{0, pr.linkUnaryCallback}},         //iam:  musl stuff
-		{`^-flto=.+$`, flagInfo{0, pr.linkTimeOptimizationCallback}}, //iam: new lto stuff
-		{`^-f.+$`, flagInfo{0, pr.compileUnaryCallback}},
-		{`^-rtlib=.+$`, flagInfo{0, pr.linkUnaryCallback}},
-		{`^-std=.+$`, flagInfo{0, pr.compileUnaryCallback}},
-		{`^-stdlib=.+$`, flagInfo{0, pr.compileLinkUnaryCallback}},
-		{`^-mtune=.+$`, flagInfo{0, pr.compileUnaryCallback}},
-		{`^--sysroot=.+$`, flagInfo{0, pr.compileLinkUnaryCallback}}, //both compile and link time
-		{`^-print-.*$`, flagInfo{0, pr.compileUnaryCallback}},        // generic catch all for the print commands
-		{`^-mmacosx-version-min=.+$`, flagInfo{0, pr.compileLinkUnaryCallback}},
-		{`^-mstack-alignment=.+$`, flagInfo{0, pr.compileUnaryCallback}},          //iam, linux kernel stuff
-		{`^-march=.+$`, flagInfo{0, pr.compileUnaryCallback}},                     //iam: linux kernel stuff
-		{`^-mregparm=.+$`, flagInfo{0, pr.compileUnaryCallback}},                  //iam: linux kernel stuff
-		{`^-mcmodel=.+$`, flagInfo{0, pr.compileUnaryCallback}},                   //iam: linux kernel stuff
-		{`^-mpreferred-stack-boundary=.+$`, flagInfo{0, pr.compileUnaryCallback}}, //iam: linux kernel stuff
-		{`^-mindirect-branch=.+$`, flagInfo{0, pr.compileUnaryCallback}},          //iam: linux kernel stuff
-		{`^--param=.+$`, flagInfo{0, pr.compileUnaryCallback}},                    //iam: linux kernel stuff
-		//the above come first because they are anchored at the start, and some can contain filenames.
-		{`^.+\.(c|cc|cpp|C|cxx|i|s|S|bc)$`, flagInfo{0, pr.inputFileCallback}},
-		{`^.+\.([fF](|[0-9][0-9]|or|OR|pp|PP))$`, flagInfo{0, pr.inputFileCallback}},
-		//iam: it's a bit fragile as to what we recognize as an object file.
-		// this also shows up in the compile function attachBitcodePathToObject, so additions
-		// here, should also be additions there.
-		{`^.+\.(o|lo|So|so|po|a|dylib|pico|nossppico)$`, flagInfo{0, pr.objectFileCallback}}, //iam: pico and nossppico are FreeBSD
-		{`^.+\.dylib(\.\d)+$`, flagInfo{0, pr.objectFileCallback}},
-		{`^.+\.(So|so)(\.\d)+$`, flagInfo{0, pr.objectFileCallback}},
-
-		{`^--target=.+$`, flagInfo{0, pr.compileLinkUnaryCallback}},
-	}
+	// the compiler gets the @file arguments as they are, we need to see what is in them.
+	argList = expandResponseFiles(argList)
 
 	for len(argList) > 0 {
 		var elem = argList[0]
 
-		// Try to match the flag exactly
-		if fi, ok := argsExactMatches[elem]; ok {
-			fi.handler(elem, argList[1:1+fi.arity])
-			argList = argList[1+fi.arity:]
+		// After -x every file is an input in that language, whatever its extension
+		// (but not -, the standard input cannot be read a second time for the bitcode)
+		if pr.language != "" && !strings.HasPrefix(elem, "-") {
+			pr.languageInputCallback(elem, argList[1:1])
+			argList = argList[1:]
+			// Try to match the flag exactly
+		} else if entry, ok := flags.exact[elem]; ok && hasFlagArguments(elem, entry.Arity, argList) {
+			pr.handleFlag(entry, elem, argList[1:1+entry.Arity])
+			argList = argList[1+entry.Arity:]
 			// else it is more complicated, either a pattern or a group
 		} else {
 			var listShift = 0
@@ -426,21 +189,18 @@ func Parse(argList []string) ParserResult {
 					LogWarning("Failed to find '-Wl,--end-group' matching '-Wl,--start-group'\n")
 					pr.compileUnaryCallback(elem, argList[1:1])
 				}
+				//else try the flags with their argument joined to them, -ofile or --param=value say
+			} else if entry, value, ok := flags.matchJoined(elem); ok {
+				pr.handleJoinedFlag(entry, elem, value)
 				//else try to match a pattern
 			} else {
-				var matched = false
-				for _, argPat := range argPatterns {
-					pattern := argPat.pattern
-					fi := argPat.finfo
-					var regExp = regexp.MustCompile(pattern)
-					if regExp.MatchString(elem) {
-						fi.handler(elem, argList[1:1+fi.arity])
-						listShift = fi.arity
-						matched = true
-						break
-					}
-				}
-				if !matched {
+				entry, matched := flags.matchPattern(elem, func(entry FlagSpecEntry) bool {
+					return hasFlagArguments(elem, entry.Arity, argList)
+				})
+				if matched {
+					pr.handleFlag(entry, elem, argList[1:1+entry.Arity])
+					listShift = entry.Arity
+				} else {
 					ok, _ := IsObjectFileForOS(elem, runtime.GOOS)
 					if ok {
 						pr.objectFileCallback(elem, argList[1:1])
@@ -456,6 +216,15 @@ func Parse(argList []string) ParserResult {
 	return pr
 }
 
+// hasFlagArguments checks that the flag at the head of argList is followed by its arguments.
+func hasFlagArguments(flag string, arity int, argList []string) bool {
+	if len(argList) <= arity {
+		LogWarning("The compiler flag %v is missing its argument\n", flag)
+		return false
+	}
+	return true
+}
+
 func indexOf(value string, slice []string) int {
 	for p, v := range slice {
 		if v == value {
@@ -497,14 +266,56 @@ func getHashedPath(path string) string {
 	return hash
 }
 
+var assemblyFile = regexp.MustCompile(`\.(s|S)$`)
+
 func (pr *ParserResult) inputFileCallback(flag string, _ []string) {
-	var regExp = regexp.MustCompile(`\.(s|S)$`)
 	pr.InputFiles = append(pr.InputFiles, flag)
-	if regExp.MatchString(flag) {
+	pr.InputLanguages = append(pr.InputLanguages, pr.language)
+	switch pr.language {
+	case "":
+		if assemblyFile.MatchString(flag) {
+			pr.IsAssembly = true
+		}
+	case "assembler", "assembler-with-cpp":
 		pr.IsAssembly = true
 	}
 }
 
+// The -x flag is not one of the CompileArgs, since the inputs are compiled one at a time,
+// each with its own language.
+func (pr *ParserResult) languageCallback(_ string, args []string) {
+	if args[0] == "none" {
+		pr.language = ""
+	} else {
+		pr.language = args[0]
+	}
+}
+
+func (pr *ParserResult) languageInputCallback(flag string, _ []string) {
+	if strings.HasSuffix(pr.language, "-header") {
+		// a precompiled header has no object to record the bitcode in
+		LogDebug("The %v input %v is a header, and so has no bitcode\n", pr.language, flag)
+		pr.CompileArgs = append(pr.CompileArgs, flag)
+	} else {
+		pr.inputFileCallback(flag, nil)
+	}
+}
+
+// inputFileArgs are the arguments that give the compiler the i-th input file, in its language.
+func (pr *ParserResult) inputFileArgs(i int) []string {
+	if language := pr.inputLanguage(i); language != "" {
+		return []string{"-x", language, pr.InputFiles[i]}
+	}
+	return []string{pr.InputFiles[i]}
+}
+
+func (pr *ParserResult) inputLanguage(i int) string {
+	if i < len(pr.InputLanguages) {
+		return pr.InputLanguages[i]
+	}
+	return ""
+}
+
 func (pr *ParserResult) outputFileCallback(_ string, args []string) {
 	pr.OutputFilename = args[0]
 }
@@ -0,0 +1,138 @@
+//
+// OCCAM
+//
+// Copyright (c) 2017, SRI International
+//
+//  All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// * Neither the name of SRI International nor the names of its contributors may
+//   be used to endorse or promote products derived from this software without
+//   specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+//
+
+package shared
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+)
+
+// The layout of a bitcode record in our section (ELFSectionName or DarwinSectionName) is:
+//
+//	magic (4 bytes) | version (uint16) | length (uint32) | JSON encoded BitcodeRecord
+//
+// all integers being little endian. The linker concatenates the sections of the objects, perhaps with
+// some zero padding in between, and objects built by older versions of gllvm contribute plain
+// newline terminated paths, so readers must cope with all three.
+const bitcodeRecordMagic = "\x7fGBC"
+
+const bitcodeRecordHeaderSize = 4 + 2 + 4
+
+// BitcodeRecordVersion is the version of the records we write. Later versions may only add fields.
+const BitcodeRecordVersion = 1
+
+// BitcodeRecord describes the bitcode file that was compiled alongside an object.
+type BitcodeRecord struct {
+	Path     string   `json:"path"`               // the absolute path of the bitcode file
+	Hash     string   `json:"hash,omitempty"`     // the hex encoded SHA-256 of the bitcode file
+	Source   string   `json:"source,omitempty"`   // the absolute path of the source file
+	Compiler string   `json:"compiler,omitempty"` // the compiler that produced the bitcode
+	Flags    []string `json:"flags,omitempty"`    // the flags it was compiled with
+	Version  int      `json:"-"`                  // the version of the record, 0 for a plain path
+}
+
+// EncodeBitcodeRecord returns the record as it should be stored in our section.
+func EncodeBitcodeRecord(record BitcodeRecord) (encoded []byte, err error) {
+	payload, err := json.Marshal(record)
+	if err != nil {
+		return
+	}
+	header := make([]byte, bitcodeRecordHeaderSize)
+	copy(header, bitcodeRecordMagic)
+	binary.LittleEndian.PutUint16(header[4:], BitcodeRecordVersion)
+	binary.LittleEndian.PutUint32(header[6:], uint32(len(payload)))
+	encoded = append(header, payload...)
+	return
+}
+
+// DecodeBitcodeRecords returns the records stored in the contents of our section, be they records
+// or the plain paths of old.
+func DecodeBitcodeRecords(data []byte) (records []BitcodeRecord, err error) {
+	for offset := 0; offset < len(data); {
+		switch {
+		case data[offset] == 0 || data[offset] == '\n':
+			// padding between the sections of two objects
+			offset++
+		case bytes.HasPrefix(data[offset:], []byte(bitcodeRecordMagic)):
+			if len(data)-offset < bitcodeRecordHeaderSize {
+				err = fmt.Errorf("truncated bitcode record at offset %v", offset)
+				return
+			}
+			version := int(binary.LittleEndian.Uint16(data[offset+4:]))
+			length := int(binary.LittleEndian.Uint32(data[offset+6:]))
+			start := offset + bitcodeRecordHeaderSize
+			if version == 0 || length > len(data)-start {
+				err = fmt.Errorf("malformed bitcode record at offset %v", offset)
+				return
+			}
+			var record BitcodeRecord
+			if err = json.Unmarshal(data[start:start+length], &record); err != nil {
+				err = fmt.Errorf("malformed bitcode record at offset %v: %v", offset, err)
+				return
+			}
+			record.Version = version
+			records = append(records, record)
+			offset = start + length
+		default:
+			end := bytes.IndexByte(data[offset:], '\n')
+			if end < 0 {
+				end = len(data) - offset
+			}
+			records = append(records, BitcodeRecord{Path: string(data[offset : offset+end])})
+			offset += end
+		}
+	}
+	return
+}
+
+// BitcodeHash returns the hex encoded SHA-256 of the contents of the file at path.
+func BitcodeHash(path string) (hash string, err error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return
+	}
+	defer CheckDefer(func() error { return file.Close() })
+	hasher := sha256.New()
+	if _, err = io.Copy(hasher, file); err != nil {
+		return
+	}
+	hash = hex.EncodeToString(hasher.Sum(nil))
+	return
+}
@@ -0,0 +1,152 @@
+//
+// OCCAM
+//
+// Copyright (c) 2017, SRI International
+//
+//  All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// * Neither the name of SRI International nor the names of its contributors may
+//   be used to endorse or promote products derived from this software without
+//   specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+//
+
+package shared
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// How deeply response files may name other response files, which also stops cycles.
+const maxResponseFileDepth = 16
+
+// expandResponseFiles replaces every @file argument with the arguments in the file, the way clang does.
+// The response files a response file names are relative to its directory. An @file argument whose file
+// cannot be read is kept as it is, like the compiler would.
+func expandResponseFiles(args []string) []string {
+	return expandResponseFilesIn(args, "", 0)
+}
+
+func expandResponseFilesIn(args []string, dir string, depth int) (expanded []string) {
+	for _, arg := range args {
+		if !strings.HasPrefix(arg, "@") || len(arg) == 1 {
+			expanded = append(expanded, arg)
+			continue
+		}
+		rspFile := arg[1:]
+		if dir != "" && !filepath.IsAbs(rspFile) {
+			rspFile = filepath.Join(dir, rspFile)
+		}
+		if depth >= maxResponseFileDepth {
+			LogWarning("Not expanding the response file %v, they are nested too deeply\n", rspFile)
+			expanded = append(expanded, arg)
+			continue
+		}
+		contents, err := os.ReadFile(rspFile)
+		if err != nil {
+			LogDebug("expandResponseFiles: keeping %v because: %v\n", arg, err)
+			expanded = append(expanded, arg)
+			continue
+		}
+		LogDebug("expandResponseFiles: expanding %v\n", rspFile)
+		expanded = append(expanded, expandResponseFilesIn(splitResponseFile(string(contents)), filepath.Dir(rspFile), depth+1)...)
+	}
+	return
+}
+
+// splitResponseFile splits the contents of a response file into arguments, the GNU way: arguments are
+// separated by white space, which single or double quotes, or a backslash, protect.
+func splitResponseFile(contents string) (args []string) {
+	var arg strings.Builder
+	inArg := false
+	var quote rune
+	escaped := false
+	for _, c := range contents {
+		switch {
+		case escaped:
+			arg.WriteRune(c)
+			escaped = false
+		case c == '\\' && quote != '\'':
+			escaped, inArg = true, true
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			} else {
+				arg.WriteRune(c)
+			}
+		case c == '\'' || c == '"':
+			quote, inArg = c, true
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == '\f' || c == '\v':
+			if inArg {
+				args = append(args, arg.String())
+				arg.Reset()
+				inArg = false
+			}
+		default:
+			arg.WriteRune(c)
+			inArg = true
+		}
+	}
+	if inArg {
+		args = append(args, arg.String())
+	}
+	return
+}
+
+// quoteResponseArg quotes the argument so that splitResponseFile, and the LLVM tools, read it back as it is.
+func quoteResponseArg(arg string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(arg) + `"`
+}
+
+// writeResponseFile writes the arguments, one per line, to a new temporary response file.
+func writeResponseFile(args []string) (rspFile string, err error) {
+	file, err := os.CreateTemp("", "gllvm-*.rsp")
+	if err != nil {
+		return
+	}
+	rspFile = file.Name()
+	var sb strings.Builder
+	for _, arg := range args {
+		sb.WriteString(quoteResponseArg(arg))
+		sb.WriteString("\n")
+	}
+	if _, err = file.WriteString(sb.String()); err != nil {
+		CheckDefer(func() error { return file.Close() })
+		return
+	}
+	err = file.Close()
+	return
+}
+
+// execCmdWithResponseFile runs the tool with the arguments, passing the files in a response file.
+func execCmdWithResponseFile(tool string, args []string, files []string, workingDir string) (success bool, err error) {
+	rspFile, err := writeResponseFile(files)
+	if err != nil {
+		return
+	}
+	defer CheckDefer(func() error { return os.Remove(rspFile) })
+	LogInfo("Passing %v files to %v in the response file %v\n", len(files), tool, rspFile)
+	return execCmd(tool, append(args, "@"+rspFile), workingDir)
+}
@@ -0,0 +1,209 @@
+//
+// OCCAM
+//
+// Copyright (c) 2017, SRI International
+//
+//  All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// * Neither the name of SRI International nor the names of its contributors may
+//   be used to endorse or promote products derived from this software without
+//   specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+//
+
+package shared
+
+import (
+	"debug/elf"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// stringList is a flag that may be given more than once.
+type stringList []string
+
+func (sl *stringList) String() string {
+	return strings.Join(*sl, ",")
+}
+
+func (sl *stringList) Set(value string) error {
+	*sl = append(*sl, value)
+	return nil
+}
+
+// linkedArchives returns the static archives the input was linked against: those named by the link
+// of the input in the build log, and those named by the -L and -lib switches.
+func linkedArchives(ea ExtractionArgs) (archives []string, success bool) {
+	var libraries, libraryPaths []string
+	if ea.BuildLog != "" {
+		record, ok := recordedLink(ea.BuildLog, ea.InputFile)
+		if !ok {
+			LogError("The build log %s does not record the link of %s.\n", ea.BuildLog, ea.InputFile)
+			return
+		}
+		for _, object := range record.Objects {
+			if fileType, err := getFileType(object); err == nil && (fileType == fileTypeARCHIVE || fileType == fileTypeTHINARCHIVE) {
+				archives = append(archives, object)
+			}
+		}
+		libraries = append(libraries, record.Libraries...)
+		libraryPaths = append(libraryPaths, record.LibraryPaths...)
+	}
+	libraries = append(libraries, ea.Libraries...)
+	libraryPaths = append(libraryPaths, ea.LibraryPaths...)
+	for _, library := range libraries {
+		archive := findStaticLibrary(library, libraryPaths)
+		if archive == "" {
+			LogWarning("There is no static library for -l%s in %v.\n", library, libraryPaths)
+			continue
+		}
+		archives = append(archives, archive)
+	}
+	dedupeStrings(&archives)
+	LogInfo("linkedArchives: %s was linked against %v\n", ea.InputFile, archives)
+	success = true
+	return
+}
+
+// recordedLink returns the most recent link of the binary in the build log.
+func recordedLink(buildLog string, binary string) (link BuildRecord, ok bool) {
+	records, err := ReadBuildLog(buildLog)
+	if err != nil {
+		LogWarning("Could not read the build log %s because: %v.\n", buildLog, err)
+		return
+	}
+	for _, record := range records {
+		if record.Kind != buildRecordLink {
+			continue
+		}
+		if output, err := filepath.EvalSymlinks(record.Output); err == nil && output == binary {
+			link, ok = record, true
+		}
+	}
+	return
+}
+
+// findStaticLibrary looks for the library the way the linker would, only a shared library found first
+// means the linker did not use an archive at all (those are followed with -d).
+func findStaticLibrary(library string, libraryPaths []string) string {
+	for _, dir := range libraryPaths {
+		if _, err := os.Stat(filepath.Join(dir, "lib"+library+".so")); err == nil {
+			LogInfo("findStaticLibrary: -l%s is the shared library in %s\n", library, dir)
+			return ""
+		}
+		archive := filepath.Join(dir, "lib"+library+".a")
+		if _, err := os.Stat(archive); err == nil {
+			return archive
+		}
+	}
+	return ""
+}
+
+// archiveBitcode returns the bitcode of the objects in the archive, and the objects that have none.
+func archiveBitcode(ea ExtractionArgs, archivePath string) (records []BitcodeRecord, bcFiles []string, missing []string, success bool) {
+	archive, err := OpenArchive(archivePath)
+	if err != nil {
+		LogError("Failed to read the archive %s because: %v.\n", archivePath, err)
+		return
+	}
+	defer CheckDefer(func() error { return archive.Close() })
+	results := extractMembers(ea, archive, func(ea ExtractionArgs, r io.ReaderAt, member ArchiveMember) (result memberExtraction) {
+		fileType, err := fileTypeOf(r)
+		if err != nil || fileType != fileTypeELFOBJECT {
+			result.skipped, result.err = true, err
+			return
+		}
+		if !elfHasBitcode(r) {
+			ea.coverage.noSection(archive.MemberLabel(member))
+			return
+		}
+		result.records, result.bcFiles, result.success = extractFromReader(ea, r, memberSource(archive, member))
+		return
+	})
+	for i, member := range archive.Members {
+		label := archive.MemberLabel(member)
+		result := results[i]
+		if result.err != nil {
+			LogWarning("Could not read %v because: %v.\n", label, result.err)
+			continue
+		}
+		if result.skipped {
+			continue
+		}
+		if len(result.records) == 0 {
+			missing = append(missing, label)
+			continue
+		}
+		if !result.success && ea.StrictExtract {
+			LogError("Failed to extract %v", label)
+			return
+		}
+		records = append(records, result.records...)
+		bcFiles = append(bcFiles, result.bcFiles...)
+	}
+	success = true
+	return
+}
+
+func elfHasBitcode(r io.ReaderAt) bool {
+	elfFile, err := elf.NewFile(r)
+	if err != nil {
+		return false
+	}
+	return elfFile.Section(ELFSectionName) != nil || elfFile.Section(ELFBitcodeSectionName) != nil
+}
+
+// addArchiveBitcode adds the bitcode of the archives the input was linked against to what was found in
+// the input itself, unless it is already there, and reports the objects in them that have no bitcode.
+func addArchiveBitcode(ea ExtractionArgs, records []BitcodeRecord, bcFiles []string) ([]BitcodeRecord, []string, bool) {
+	seen := make(map[string]bool)
+	for _, record := range records {
+		seen[record.Path] = true
+	}
+	var missing []string
+	for _, archivePath := range ea.archives {
+		archiveRecords, archiveFiles, archiveMissing, ok := archiveBitcode(ea, archivePath)
+		if !ok {
+			return records, bcFiles, false
+		}
+		for i, record := range archiveRecords {
+			if seen[record.Path] {
+				continue
+			}
+			seen[record.Path] = true
+			records = append(records, record)
+			bcFiles = append(bcFiles, archiveFiles[i])
+		}
+		missing = append(missing, archiveMissing...)
+	}
+	if len(missing) > 0 {
+		informUser("These objects have no bitcode:\n\t%s\n", strings.Join(missing, "\n\t"))
+		if ea.StrictExtract {
+			LogError("Some of the objects linked into %s have no bitcode.\n", ea.InputFile)
+			return records, bcFiles, false
+		}
+	}
+	return records, bcFiles, true
+}
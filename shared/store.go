@@ -0,0 +1,183 @@
+//
+// OCCAM
+//
+// Copyright (c) 2017, SRI International
+//
+//  All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// * Neither the name of SRI International nor the names of its contributors may
+//   be used to endorse or promote products derived from this software without
+//   specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+//
+
+package shared
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// The bitcode store (WLLVM_BC_STORE) is content addressed. It is laid out as follows:
+//
+//	objects/ab/abcdef...   the bitcode file whose SHA-256 is abcdef...
+//	index/01/012345...     the hash of the latest bitcode file stored from the path whose SHA-256 is 012345...
+//
+// Both are sharded by the first two hex digits of the hash, and written by renaming a complete temporary
+// file into place, so that any number of builds can share a store. Identical bitcode is only stored once,
+// and rebuilding a file does not lose the bitcode an older object was built with. Stores written by older
+// versions of gllvm simply hold the bitcode files named by the hash of their path, we still read those.
+const (
+	storeObjectsDir = "objects"
+	storeIndexDir   = "index"
+	storeLockFile   = ".lock"
+)
+
+// lockStore takes the lock of the store, if the user asked for locking (GLLVM_STORE_LOCK). Writers share it,
+// garbage collection needs it to itself. The returned function releases it.
+func lockStore(store string, exclusive bool) (unlock func(), err error) {
+	if LLVMStoreLocking == "" {
+		unlock = func() {}
+		return
+	}
+	return lockPath(filepath.Join(store, storeLockFile), exclusive)
+}
+
+// lockPath takes a lock on the lock file at path, creating it if needs be. The returned function releases it.
+func lockPath(path string, exclusive bool) (unlock func(), err error) {
+	unlock = func() {}
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return
+	}
+	if err = flockFile(file, exclusive); err != nil {
+		_ = file.Close()
+		return
+	}
+	unlock = func() {
+		CheckDefer(func() error { return funlockFile(file) })
+		CheckDefer(func() error { return file.Close() })
+	}
+	return
+}
+
+// StoreBitcodeFile copies the bitcode file into the store, and records it as the latest version of its path.
+// It returns the hash of the bitcode, which is also its name in the store.
+func StoreBitcodeFile(store string, bcFile string) (hash string, err error) {
+	absBcFile, err := filepath.Abs(bcFile)
+	if err != nil {
+		return
+	}
+	bitcode, err := os.ReadFile(absBcFile)
+	if err != nil {
+		return
+	}
+	sum := sha256.Sum256(bitcode)
+	hash = hex.EncodeToString(sum[:])
+
+	unlock, err := lockStore(store, false)
+	if err != nil {
+		return
+	}
+	defer unlock()
+
+	objectFile := StoreObjectPath(store, hash)
+	// it is in use again, which is what garbage collection by age goes by; without the lock the
+	// collection may remove it, even after we have seen it, in which case we write it afresh
+	now := time.Now()
+	if err = os.Chtimes(objectFile, now, now); os.IsNotExist(err) {
+		if err = os.MkdirAll(filepath.Dir(objectFile), 0755); err != nil {
+			return
+		}
+		if err = writeFileAtomically(objectFile, bitcode, 0644); err != nil {
+			return
+		}
+	} else if err != nil {
+		return
+	}
+
+	indexFile := storeIndexPath(store, absBcFile)
+	if err = os.MkdirAll(filepath.Dir(indexFile), 0755); err != nil {
+		return
+	}
+	err = writeFileAtomically(indexFile, []byte(hash+" "+absBcFile+"\n"), 0644)
+	return
+}
+
+// StoreObjectPath returns the path of the bitcode file with the given hash in the store.
+func StoreObjectPath(store string, hash string) string {
+	return filepath.Join(store, storeObjectsDir, shard(hash), hash)
+}
+
+// storeIndexPath returns the path of the index entry of the bitcode path in the store.
+func storeIndexPath(store string, absBcFile string) string {
+	pathHash := getHashedPath(absBcFile)
+	return filepath.Join(store, storeIndexDir, shard(pathHash), pathHash)
+}
+
+func shard(hash string) string {
+	if len(hash) < 2 {
+		return "00"
+	}
+	return hash[:2]
+}
+
+// readStoreIndex returns the hash, and the path, recorded in an index entry.
+func readStoreIndex(indexFile string) (hash string, absBcFile string, err error) {
+	contents, err := os.ReadFile(indexFile)
+	if err != nil {
+		return
+	}
+	fields := strings.SplitN(strings.TrimSuffix(string(contents), "\n"), " ", 2)
+	if len(fields) != 2 || len(fields[0]) != sha256.Size*2 {
+		err = fmt.Errorf("malformed index entry %v", indexFile)
+		return
+	}
+	hash, absBcFile = fields[0], fields[1]
+	return
+}
+
+// storeCandidates returns the files in the store that may be the bitcode file of the record, best first:
+// the one with the recorded hash, the latest one stored from its path, and the one an older gllvm stored.
+func storeCandidates(store string, record BitcodeRecord) (candidates []string) {
+	absBcFile, _ := filepath.Abs(record.Path)
+	var paths []string
+	if record.Hash != "" {
+		paths = append(paths, StoreObjectPath(store, record.Hash))
+	}
+	if hash, _, err := readStoreIndex(storeIndexPath(store, absBcFile)); err == nil && hash != record.Hash {
+		paths = append(paths, StoreObjectPath(store, hash))
+	}
+	paths = append(paths, filepath.Join(store, getHashedPath(absBcFile)))
+	for _, p := range paths {
+		if _, err := os.Stat(p); err == nil {
+			candidates = append(candidates, p)
+		}
+	}
+	return
+}
@@ -0,0 +1,362 @@
+//
+// OCCAM
+//
+// Copyright (c) 2017, SRI International
+//
+//  All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// * Neither the name of SRI International nor the names of its contributors may
+//   be used to endorse or promote products derived from this software without
+//   specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+//
+
+package shared
+
+import (
+	"debug/macho"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// StoreEntry is a bitcode file in the store.
+type StoreEntry struct {
+	Hash    string    // the hash of the bitcode, or of its original path for entries from older versions of gllvm
+	File    string    // the path of the bitcode file in the store
+	Size    int64     // its size
+	ModTime time.Time // when it was last stored
+	Paths   []string  // the bitcode paths it is the latest version of
+	Legacy  bool      // whether it was stored by an older version of gllvm
+}
+
+// ReadStore returns the entries of the store, sorted by hash.
+func ReadStore(store string) (entries []StoreEntry, err error) {
+	paths := make(map[string][]string)
+	indexFiles, err := filepath.Glob(filepath.Join(store, storeIndexDir, "*", "*"))
+	if err != nil {
+		return
+	}
+	for _, indexFile := range indexFiles {
+		hash, absBcFile, indexErr := readStoreIndex(indexFile)
+		if indexErr != nil {
+			LogDebug("ReadStore: skipping %v: %v\n", indexFile, indexErr)
+			continue
+		}
+		paths[hash] = append(paths[hash], absBcFile)
+	}
+
+	objectFiles, err := filepath.Glob(filepath.Join(store, storeObjectsDir, "*", "*"))
+	if err != nil {
+		return
+	}
+	legacyFiles, err := filepath.Glob(filepath.Join(store, "*"))
+	if err != nil {
+		return
+	}
+	for _, file := range append(objectFiles, legacyFiles...) {
+		name := filepath.Base(file)
+		if !isHexHash(name) {
+			// our directories, and temporary files
+			continue
+		}
+		info, statErr := os.Stat(file)
+		if statErr != nil || !info.Mode().IsRegular() {
+			continue
+		}
+		sort.Strings(paths[name])
+		entries = append(entries, StoreEntry{
+			Hash:    name,
+			File:    file,
+			Size:    info.Size(),
+			ModTime: info.ModTime(),
+			Paths:   paths[name],
+			Legacy:  filepath.Dir(file) == filepath.Clean(store),
+		})
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Hash < entries[j].Hash })
+	return
+}
+
+func isHexHash(name string) bool {
+	if len(name) != 64 {
+		return false
+	}
+	for _, c := range name {
+		if !strings.ContainsRune("0123456789abcdef", c) {
+			return false
+		}
+	}
+	return true
+}
+
+// StoreReferences returns the records of the bitcode in the binary (an object, executable, library, or archive),
+// together with the files in the store each of them may be using.
+func StoreReferences(store string, binary string) (records []BitcodeRecord, references [][]string, err error) {
+	file, err := os.Open(binary)
+	if err != nil {
+		return
+	}
+	defer CheckDefer(func() error { return file.Close() })
+	if records, err = recordsOf(file, binary); err != nil {
+		return
+	}
+	for _, record := range records {
+		references = append(references, storeCandidates(store, record))
+	}
+	return
+}
+
+// recordsOf returns the bitcode records of whatever kind of binary r reads.
+func recordsOf(r io.ReaderAt, label string) (records []BitcodeRecord, err error) {
+	fileType, err := fileTypeOf(r)
+	if err != nil {
+		return
+	}
+	var ok bool
+	switch fileType {
+	case fileTypeELFEXECUTABLE, fileTypeELFSHARED, fileTypeELFOBJECT:
+		if records, ok = extractSectionUnix(r, label); !ok {
+			err = fmt.Errorf("no bitcode records in %v", label)
+		}
+	case fileTypeMACHEXECUTABLE, fileTypeMACHSHARED, fileTypeMACHOBJECT:
+		fatFile, fatErr := macho.NewFatFile(r)
+		if fatErr != nil {
+			if records, ok = extractSectionDarwin(r, label, ""); !ok {
+				err = fmt.Errorf("no bitcode records in %v", label)
+			}
+			return
+		}
+		for _, arch := range fatFile.Arches {
+			archRecords, archOk := extractSectionDarwin(r, label, machoArchName(arch.Cpu, arch.SubCpu))
+			if !archOk {
+				err = fmt.Errorf("no bitcode records in %v", label)
+				return
+			}
+			records = append(records, archRecords...)
+		}
+	case fileTypeARCHIVE, fileTypeTHINARCHIVE:
+		file, isFile := r.(*os.File)
+		if !isFile {
+			err = fmt.Errorf("nested archive %v", label)
+			return
+		}
+		var archive *Archive
+		if archive, err = OpenArchive(file.Name()); err != nil {
+			return
+		}
+		defer CheckDefer(func() error { return archive.Close() })
+		for _, member := range archive.Members {
+			memberLabel := archive.MemberLabel(member)
+			err = archive.WithMember(member, func(mr io.ReaderAt) error {
+				memberRecords, memberErr := recordsOf(mr, memberLabel)
+				records = append(records, memberRecords...)
+				return memberErr
+			})
+			if err != nil {
+				return
+			}
+		}
+	default:
+		err = fmt.Errorf("%v is not an object, executable, library, or archive", label)
+	}
+	return
+}
+
+// StoreTool implements the gllvm-store command, which inspects and garbage collects the bitcode store.
+func StoreTool(args []string) (exitCode int) {
+	exitCode = 1
+
+	flagSet := flag.NewFlagSet(args[0], flag.ContinueOnError)
+	store := flagSet.String("s", LLVMBitcodeStorePath, "the bitcode store (defaults to WLLVM_BC_STORE)")
+	flagSet.Usage = func() {
+		fmt.Fprintf(flagSet.Output(), "Usage: %s [-s store] list | refs <binary>... | gc [-n] [-days N] [<binary>...]\n", args[0])
+		flagSet.PrintDefaults()
+	}
+	if err := flagSet.Parse(args[1:]); err != nil {
+		return
+	}
+	if *store == "" || flagSet.NArg() == 0 {
+		flagSet.Usage()
+		return
+	}
+	if info, err := os.Stat(*store); err != nil || !info.IsDir() {
+		LogError("The bitcode store %s is not a directory.\n", *store)
+		return
+	}
+
+	command, commandArgs := flagSet.Arg(0), flagSet.Args()[1:]
+	var success bool
+	switch command {
+	case "list":
+		success = listStore(*store)
+	case "refs":
+		success = listReferences(*store, commandArgs)
+	case "gc":
+		success = collectStore(*store, args[0]+" gc", commandArgs)
+	default:
+		LogError("Unknown command %s.\n", command)
+		flagSet.Usage()
+	}
+	if success {
+		exitCode = 0
+	}
+	return
+}
+
+func listStore(store string) (success bool) {
+	entries, err := ReadStore(store)
+	if err != nil {
+		LogError("Failed to read the bitcode store %s because: %v.\n", store, err)
+		return
+	}
+	var total int64
+	now := time.Now()
+	for _, entry := range entries {
+		total += entry.Size
+		paths := strings.Join(entry.Paths, " ")
+		if entry.Legacy {
+			paths = "(stored by an older gllvm)"
+		}
+		informUser("%s %10d %6s %s\n", entry.Hash, entry.Size, formatAge(now.Sub(entry.ModTime)), paths)
+	}
+	informUser("%d entries, %d bytes.\n", len(entries), total)
+	success = true
+	return
+}
+
+func listReferences(store string, binaries []string) (success bool) {
+	if len(binaries) == 0 {
+		LogError("No binaries given.\n")
+		return
+	}
+	success = true
+	for _, binary := range binaries {
+		records, references, err := StoreReferences(store, binary)
+		if err != nil {
+			LogError("Failed to read the bitcode records of %s because: %v.\n", binary, err)
+			success = false
+			continue
+		}
+		informUser("%s:\n", binary)
+		for i, record := range records {
+			if len(references[i]) == 0 {
+				informUser("\t%s (not in the store)\n", record.Path)
+			} else {
+				informUser("\t%s %s\n", record.Path, references[i][0])
+			}
+		}
+	}
+	return
+}
+
+// collectStore removes the entries of the store that none of the binaries refer to and, if a
+// number of days is given, that have not been stored for that long.
+func collectStore(store string, name string, args []string) (success bool) {
+	flagSet := flag.NewFlagSet(name, flag.ContinueOnError)
+	dryRun := flagSet.Bool("n", false, "only show what would be removed")
+	days := flagSet.Int("days", -1, "only remove the entries stored more than this many days ago")
+	if err := flagSet.Parse(args); err != nil {
+		return
+	}
+	binaries := flagSet.Args()
+	if len(binaries) == 0 && *days < 0 {
+		LogError("Refusing to remove everything: give the binaries whose bitcode to keep, or a number of days.\n")
+		return
+	}
+
+	referenced := make(map[string]bool)
+	for _, binary := range binaries {
+		_, references, err := StoreReferences(store, binary)
+		if err != nil {
+			LogError("Failed to read the bitcode records of %s because: %v.\n", binary, err)
+			return
+		}
+		for _, candidates := range references {
+			for _, candidate := range candidates {
+				referenced[candidate] = true
+			}
+		}
+	}
+
+	unlock, err := lockStore(store, true)
+	if err != nil {
+		LogError("Failed to lock the bitcode store %s because: %v.\n", store, err)
+		return
+	}
+	defer unlock()
+
+	entries, err := ReadStore(store)
+	if err != nil {
+		LogError("Failed to read the bitcode store %s because: %v.\n", store, err)
+		return
+	}
+	cutoff := time.Now().AddDate(0, 0, -*days)
+	var count int
+	var freed int64
+	success = true
+	for _, entry := range entries {
+		if referenced[entry.File] || (*days >= 0 && entry.ModTime.After(cutoff)) {
+			continue
+		}
+		count++
+		freed += entry.Size
+		if *dryRun {
+			informUser("Would remove %s\n", entry.File)
+			continue
+		}
+		LogInfo("Removing %s\n", entry.File)
+		if err := os.Remove(entry.File); err != nil {
+			LogError("Failed to remove %s because: %v.\n", entry.File, err)
+			success = false
+			continue
+		}
+		for _, absBcFile := range entry.Paths {
+			if err := os.Remove(storeIndexPath(store, absBcFile)); err != nil && !os.IsNotExist(err) {
+				LogWarning("Failed to remove the index entry of %s because: %v.\n", absBcFile, err)
+			}
+		}
+	}
+	if *dryRun {
+		informUser("Would remove %d entries, %d bytes.\n", count, freed)
+	} else {
+		informUser("Removed %d entries, %d bytes.\n", count, freed)
+	}
+	return
+}
+
+func formatAge(age time.Duration) string {
+	switch {
+	case age >= 24*time.Hour:
+		return fmt.Sprintf("%dd", int(age.Hours()/24))
+	case age >= time.Hour:
+		return fmt.Sprintf("%dh", int(age.Hours()))
+	default:
+		return fmt.Sprintf("%dm", int(age.Minutes()))
+	}
+}
@@ -0,0 +1,199 @@
+//
+// OCCAM
+//
+// Copyright (c) 2017, SRI International
+//
+//  All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// * Neither the name of SRI International nor the names of its contributors may
+//   be used to endorse or promote products derived from this software without
+//   specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+//
+
+package shared
+
+import (
+	"debug/elf"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// The functions the C runtime, and the linker, put in every binary, which never have any bitcode.
+var runtimeFunctions = map[string]bool{
+	"_start":                  true,
+	"_init":                   true,
+	"_fini":                   true,
+	"__libc_csu_init":         true,
+	"__libc_csu_fini":         true,
+	"_dl_relocate_static_pie": true,
+	"frame_dummy":             true,
+	"register_tm_clones":      true,
+	"deregister_tm_clones":    true,
+	"__do_global_dtors_aux":   true,
+	"__do_global_ctors_aux":   true,
+	"call_weak_fn":            true,
+}
+
+var runtimeFunctionPrefixes = []string{"__x86.get_pc_thunk."}
+
+// The suffixes the compilers give to the clones, and the split off parts, of functions (e.g. foo.cold.1, foo.isra.0).
+var functionSuffix = regexp.MustCompile(`\.(cold|part|isra|constprop|lto_priv|localalias|llvm|__uniq)(\.|$)`)
+
+// normalizeFunction returns the name of the function in the source that the symbol is, or is part of.
+func normalizeFunction(name string) string {
+	if i := strings.Index(name, "@"); i > 0 {
+		name = name[:i]
+	}
+	if loc := functionSuffix.FindStringIndex(name); loc != nil && loc[0] > 0 {
+		name = name[:loc[0]]
+	}
+	return name
+}
+
+func isRuntimeFunction(name string) bool {
+	if runtimeFunctions[name] {
+		return true
+	}
+	for _, prefix := range runtimeFunctionPrefixes {
+		if strings.HasPrefix(name, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// nativeFunctions returns the functions defined in the symbol table of the ELF or Mach-O binary.
+func nativeFunctions(r io.ReaderAt, binary string, arch string) (functions []string, err error) {
+	if elfFile, elfErr := elf.NewFile(r); elfErr == nil {
+		symbols, symErr := elfFile.Symbols()
+		if symErr == elf.ErrNoSymbols {
+			// a stripped binary still has its dynamic symbols
+			symbols, symErr = elfFile.DynamicSymbols()
+		}
+		if symErr != nil {
+			err = fmt.Errorf("could not read the symbols of %s: %v", binary, symErr)
+			return
+		}
+		for _, symbol := range symbols {
+			if elf.ST_TYPE(symbol.Info) == elf.STT_FUNC && symbol.Section != elf.SHN_UNDEF {
+				functions = append(functions, symbol.Name)
+			}
+		}
+		return
+	}
+	machoFile, _ := openMachOSlice(r, arch)
+	if machoFile == nil {
+		err = fmt.Errorf("%s is neither ELF nor Mach-O", binary)
+		return
+	}
+	if machoFile.Symtab == nil {
+		err = fmt.Errorf("%s has no symbol table", binary)
+		return
+	}
+	const nStab, nType, nSect = 0xe0, 0x0e, 0x0e
+	for _, symbol := range machoFile.Symtab.Syms {
+		if symbol.Type&nStab != 0 || symbol.Type&nType != nSect || symbol.Sect == 0 || int(symbol.Sect) > len(machoFile.Sections) {
+			continue
+		}
+		if section := machoFile.Sections[symbol.Sect-1]; section.Seg == "__TEXT" && section.Name == "__text" {
+			functions = append(functions, symbol.Name)
+		}
+	}
+	return
+}
+
+// bitcodeFunctions returns the functions defined in the bitcode module, according to llvm-nm.
+func bitcodeFunctions(module string) (functions map[string]bool, err error) {
+	nm := resolveTool("llvm-nm", LLVMNMName, "llvm-nm")
+	output, err := runCmd(nm, []string{"--defined-only", module})
+	if err != nil {
+		err = fmt.Errorf("%s --defined-only %s failed: %v", nm, module, err)
+		return
+	}
+	functions = make(map[string]bool)
+	for _, line := range strings.Split(output, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+		if strings.Contains("TtWw", fields[len(fields)-2]) {
+			functions[normalizeFunction(fields[len(fields)-1])] = true
+		}
+	}
+	return
+}
+
+// NativeOnlyFunctions returns the functions defined in the binary (the arch slice of it, if it is a universal
+// binary) that the bitcode module does not define: those compiled from assembly, or by a compiler other than
+// gllvm's. The functions of the C runtime are left out, and clones such as foo.cold.1 count as foo.
+func NativeOnlyFunctions(binary string, arch string, module string) (functions []string, err error) {
+	file, err := os.Open(binary)
+	if err != nil {
+		return
+	}
+	defer CheckDefer(func() error { return file.Close() })
+	native, err := nativeFunctions(file, binary, arch)
+	if err != nil {
+		return
+	}
+	inBitcode, err := bitcodeFunctions(module)
+	if err != nil {
+		return
+	}
+	seen := make(map[string]bool)
+	for _, symbol := range native {
+		name := normalizeFunction(symbol)
+		if isRuntimeFunction(name) || inBitcode[name] || seen[name] {
+			continue
+		}
+		// Mach-O symbols carry a leading underscore, which llvm-nm may or may not print
+		if trimmed := strings.TrimPrefix(name, "_"); trimmed != name && (isRuntimeFunction(trimmed) || inBitcode[trimmed]) {
+			continue
+		}
+		seen[name] = true
+		functions = append(functions, name)
+	}
+	sort.Strings(functions)
+	return
+}
+
+// reportNativeFunctions tells the user which of the functions in the input have no bitcode.
+func reportNativeFunctions(ea ExtractionArgs) (success bool) {
+	functions, err := NativeOnlyFunctions(ea.InputFile, ea.Arch, ea.OutputFile)
+	if err != nil {
+		LogError("Could not compare the functions of %s with those of %s because: %v.\n", ea.InputFile, ea.OutputFile, err)
+		return
+	}
+	if len(functions) == 0 {
+		informUser("Every function in %s has bitcode.\n", ea.InputFile)
+	} else {
+		informUser("These functions in %s have no bitcode:\n\t%s\n", ea.InputFile, strings.Join(functions, "\n\t"))
+	}
+	success = true
+	return
+}
@@ -37,6 +37,8 @@ import (
 	"bytes"
 	"os"
 	"os/exec"
+	"path/filepath"
+	"strings"
 )
 
 // Executes a command then returns true for success, false if there was an error, err is either nil or the error.
@@ -89,3 +91,59 @@ func dedupeStrings(strings *[]string) {
 	}
 	*strings = (*strings)[:count]
 }
+
+// Writes the data to a new file, with a name of its own, in the directory. The file is written under a
+// name that does not end with the suffix, and then renamed, so that readers never see a partially written file.
+func writeNewFile(dir string, prefix string, suffix string, data []byte) (err error) {
+	tmpFile, err := os.CreateTemp(dir, "."+prefix+"-*.tmp")
+	if err != nil {
+		return
+	}
+	tmpName := tmpFile.Name()
+	defer func() {
+		if err != nil {
+			_ = os.Remove(tmpName)
+		}
+	}()
+	if _, err = tmpFile.Write(data); err != nil {
+		_ = tmpFile.Close()
+		return
+	}
+	if err = tmpFile.Close(); err != nil {
+		return
+	}
+	name := strings.TrimPrefix(strings.TrimSuffix(filepath.Base(tmpName), ".tmp"), ".")
+	err = os.Rename(tmpName, filepath.Join(dir, name+suffix))
+	return
+}
+
+// Writes the data to a temporary file next to path, and then renames it into place, so that
+// readers never see a partially written file.
+func writeFileAtomically(path string, data []byte, perm os.FileMode) (err error) {
+	tmpFile, err := os.CreateTemp(filepath.Dir(path), ".gllvm-tmp-")
+	if err != nil {
+		return
+	}
+	tmpName := tmpFile.Name()
+	defer func() {
+		if err != nil {
+			_ = os.Remove(tmpName)
+		}
+	}()
+	if _, err = tmpFile.Write(data); err != nil {
+		_ = tmpFile.Close()
+		return
+	}
+	if err = tmpFile.Sync(); err != nil {
+		_ = tmpFile.Close()
+		return
+	}
+	if err = tmpFile.Close(); err != nil {
+		return
+	}
+	if err = os.Chmod(tmpName, perm); err != nil {
+		return
+	}
+	err = os.Rename(tmpName, path)
+	return
+}
@@ -0,0 +1,157 @@
+package test
+
+import (
+	"fmt"
+	"github.com/SRI-CSL/gllvm/shared"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+type arEntry struct {
+	header string
+	data   string
+}
+
+func arHeader(name string, size int) string {
+	return fmt.Sprintf("%-16s%-12s%-6s%-6s%-8s%-10d`\n", name, "0", "0", "0", "644", size)
+}
+
+// writeArchive lays out an archive by hand, thin archive members carry no data.
+func writeArchive(t *testing.T, path string, magic string, entries []arEntry) {
+	var sb strings.Builder
+	sb.WriteString(magic)
+	for _, e := range entries {
+		sb.WriteString(e.header)
+		sb.WriteString(e.data)
+		if len(e.data)%2 == 1 {
+			sb.WriteString("\n")
+		}
+	}
+	if err := os.WriteFile(path, []byte(sb.String()), 0644); err != nil {
+		t.Fatalf("Could not write %v: %v\n", path, err)
+	}
+}
+
+type expectedMember struct {
+	name     string
+	instance int
+	contents string
+}
+
+func checkArchive(t *testing.T, path string, thin bool, expected []expectedMember) {
+	archive, err := shared.OpenArchive(path)
+	if err != nil {
+		t.Fatalf("OpenArchive(%v) failed: %v\n", path, err)
+	}
+	defer archive.Close()
+	if archive.Thin != thin {
+		t.Errorf("OpenArchive(%v).Thin = %v\n", path, archive.Thin)
+	}
+	if len(archive.Members) != len(expected) {
+		t.Fatalf("OpenArchive(%v) has members %v, expected %v\n", path, archive.Members, expected)
+	}
+	for i, m := range archive.Members {
+		if m.Name != expected[i].name || m.Instance != expected[i].instance {
+			t.Errorf("Member %v of %v is %v #%v, expected %v #%v\n", i, path, m.Name, m.Instance, expected[i].name, expected[i].instance)
+		}
+		var contents []byte
+		err = archive.WithMember(m, func(r io.ReaderAt) error {
+			contents, err = io.ReadAll(io.NewSectionReader(r, 0, m.Size))
+			return err
+		})
+		if err != nil {
+			t.Errorf("Reading %v failed: %v\n", archive.MemberLabel(m), err)
+		} else if string(contents) != expected[i].contents {
+			t.Errorf("Contents of %v are %q, expected %q\n", archive.MemberLabel(m), contents, expected[i].contents)
+		}
+	}
+}
+
+func Test_gnu_archive(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "libgnu.a")
+	longNames := "a_rather_long_object_name.o/\n"
+	writeArchive(t, path, "!<arch>\n", []arEntry{
+		{arHeader("/", 4), "\x00\x00\x00\x00"},
+		{arHeader("//", len(longNames)), longNames},
+		{arHeader("dup.o/", 3), "one"},
+		{arHeader("/0", 5), "three"},
+		{arHeader("dup.o/", 3), "two"},
+	})
+	checkArchive(t, path, false, []expectedMember{
+		{"dup.o", 1, "one"},
+		{"a_rather_long_object_name.o", 1, "three"},
+		{"dup.o", 2, "two"},
+	})
+}
+
+func Test_bsd_archive(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "libbsd.a")
+	symdef := "__.SYMDEF SORTED\x00\x00\x00\x00"
+	longName := "a_rather_long_object_name.o\x00"
+	writeArchive(t, path, "!<arch>\n", []arEntry{
+		{arHeader("#1/20", len(symdef)+8), symdef + "\x00\x00\x00\x00\x00\x00\x00\x00"},
+		{arHeader("#1/28", len(longName)+5), longName + "three"},
+		{arHeader("dup.o", 3), "one"},
+		{arHeader("dup.o", 3), "two"},
+	})
+	checkArchive(t, path, false, []expectedMember{
+		{"a_rather_long_object_name.o", 1, "three"},
+		{"dup.o", 1, "one"},
+		{"dup.o", 2, "two"},
+	})
+}
+
+func Test_thin_archive(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.Mkdir(filepath.Join(dir, "sub"), 0755); err != nil {
+		t.Fatalf("Could not create the sub directory: %v\n", err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "sub", "a_rather_long_object_name.o"), []byte("three"), 0644); err != nil {
+		t.Fatalf("Could not write a member: %v\n", err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "b.o"), []byte("four"), 0644); err != nil {
+		t.Fatalf("Could not write a member: %v\n", err)
+	}
+	path := filepath.Join(dir, "libthin.a")
+	longNames := "sub/a_rather_long_object_name.o/\n"
+	writeArchive(t, path, "!<thin>\n", []arEntry{
+		{arHeader("/", 4), "\x00\x00\x00\x00"},
+		{arHeader("//", len(longNames)), longNames},
+		{arHeader("/0", 5), ""},
+		{arHeader("b.o/", 4), ""},
+	})
+	checkArchive(t, path, true, []expectedMember{
+		{"sub/a_rather_long_object_name.o", 1, "three"},
+		{"b.o", 1, "four"},
+	})
+}
+
+func Test_not_an_archive(t *testing.T) {
+	if _, err := shared.OpenArchive("../data/helloworld.c"); err == nil {
+		t.Errorf("OpenArchive(../data/helloworld.c) did not fail\n")
+	}
+}
+
+func Test_malformed_archive(t *testing.T) {
+	dir := t.TempDir()
+	longNames := "a_rather_long_object_name.o/\n"
+	malformed := map[string][]arEntry{
+		"negative-long-name": {{arHeader("//", len(longNames)), longNames}, {arHeader("/-5", 3), "one"}},
+		"long-name-too-far":  {{arHeader("//", len(longNames)), longNames}, {arHeader("/99", 3), "one"}},
+		"negative-bsd-name":  {{arHeader("#1/-3", 3), "one"}},
+		"bsd-name-too-long":  {{arHeader("#1/8", 3), "one"}},
+	}
+	for name, entries := range malformed {
+		path := filepath.Join(dir, name+".a")
+		writeArchive(t, path, "!<arch>\n", entries)
+		if archive, err := shared.OpenArchive(path); err == nil {
+			t.Errorf("OpenArchive(%v) did not fail\n", path)
+			archive.Close()
+		}
+	}
+}
@@ -0,0 +1,90 @@
+package test
+
+import (
+	"debug/elf"
+	"encoding/binary"
+	"github.com/SRI-CSL/gllvm/shared"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func Test_build_graph(t *testing.T) {
+	dir := t.TempDir()
+	buildLog := t.TempDir()
+	path := func(name string) string { return filepath.Join(dir, name) }
+
+	// b.o only makes it into the program by way of libb.a
+	bRecord, err := shared.EncodeBitcodeRecord(shared.BitcodeRecord{Path: path(".b.o.bc")})
+	if err != nil {
+		t.Fatalf("EncodeBitcodeRecord failed: %v\n", err)
+	}
+	if err = os.WriteFile(path("b.o"), minimalELF(t, elf.ELFCLASS64, binary.LittleEndian, elf.ET_REL), 0644); err != nil {
+		t.Fatalf("Could not write b.o: %v\n", err)
+	}
+	if err = shared.InjectELFSection(path("b.o"), shared.ELFSectionName, bRecord); err != nil {
+		t.Fatalf("InjectELFSection failed: %v\n", err)
+	}
+	bObject, err := os.ReadFile(path("b.o"))
+	if err != nil {
+		t.Fatalf("Could not read b.o: %v\n", err)
+	}
+	writeArchive(t, path("libb.a"), "!<arch>\n", []arEntry{{arHeader("b.o/", len(bObject)), string(bObject)}})
+
+	records := []shared.BuildRecord{
+		{Kind: "compile", Directory: dir, Output: path("a.o"), Source: path("a.c"), Bitcode: path(".a.o.bc")},
+		{Kind: "compile", Directory: dir, Output: path("b.o"), Source: path("b.c"), Bitcode: path(".b.o.bc")},
+		{Kind: "link", Directory: dir, Output: path("prog"), Objects: []string{path("a.o")},
+			Libraries: []string{"b", "m"}, LibraryPaths: []string{dir}},
+	}
+	for _, record := range records {
+		if err = shared.WriteBuildRecord(buildLog, record); err != nil {
+			t.Fatalf("WriteBuildRecord failed: %v\n", err)
+		}
+	}
+	read, err := shared.ReadBuildLog(buildLog)
+	if err != nil || len(read) != len(records) {
+		t.Fatalf("ReadBuildLog returned %v, %v\n", read, err)
+	}
+
+	graph := shared.NewBuildGraph(read)
+	kinds := make(map[string]string)
+	for _, node := range graph.Nodes {
+		kinds[node.ID] = node.Kind
+	}
+	expectedKinds := map[string]string{
+		path("prog"): "executable", path("libb.a"): "archive", "-lm": "external",
+		path("a.o"): "object", path("b.o"): "object", path("a.c"): "source", path("b.c"): "source",
+		path(".a.o.bc"): "bitcode", path(".b.o.bc"): "bitcode",
+	}
+	for id, kind := range expectedKinds {
+		if kinds[id] != kind {
+			t.Errorf("The node %v is a %q, not a %q\n", id, kinds[id], kind)
+		}
+	}
+	if len(kinds) != len(expectedKinds) {
+		t.Errorf("The graph has the nodes %v\n", graph.Nodes)
+	}
+	edges := make(map[string]bool)
+	for _, edge := range graph.Edges {
+		edges[edge.From+" -> "+edge.To] = true
+	}
+	for _, edge := range []string{
+		path("prog") + " -> " + path("a.o"), path("prog") + " -> " + path("libb.a"), path("prog") + " -> -lm",
+		path("libb.a") + " -> " + path("b.o"), path("b.o") + " -> " + path("b.c"), path("b.o") + " -> " + path(".b.o.bc"),
+	} {
+		if !edges[edge] {
+			t.Errorf("The graph is missing the edge %v\n", edge)
+		}
+	}
+
+	dot := filepath.Join(dir, "build.dot")
+	args := []string{"gllvm-graph", "-o", dot, buildLog}
+	if exitCode := shared.GraphTool(args); exitCode != 0 {
+		t.Errorf("%v returned %v\n", args, exitCode)
+	}
+	if contents, err := os.ReadFile(dot); err != nil || !strings.HasPrefix(string(contents), "digraph build {") {
+		t.Errorf("%v wrote %q (err = %v)\n", args, contents, err)
+	}
+}
@@ -0,0 +1,141 @@
+package test
+
+import (
+	"fmt"
+	"github.com/SRI-CSL/gllvm/shared"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+)
+
+func compileCommand(i int) shared.CompileCommand {
+	return shared.CompileCommand{
+		Directory: "/src",
+		File:      fmt.Sprintf("file%d.c", i),
+		Arguments: []string{"clang", "-c", fmt.Sprintf("file%d.c", i)},
+		Output:    fmt.Sprintf("file%d.o", i),
+		Bitcode:   fmt.Sprintf("/src/.file%d.o.bc", i),
+	}
+}
+
+func Test_compile_commands(t *testing.T) {
+	dir := t.TempDir()
+	database := filepath.Join(dir, "compile_commands.json")
+	fragments := filepath.Join(dir, "fragments")
+	if err := os.Mkdir(fragments, 0755); err != nil {
+		t.Fatalf("Could not create %v: %v\n", fragments, err)
+	}
+
+	// parallel jobs, each compiling a couple of files, some of them twice
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			commands := []shared.CompileCommand{compileCommand(i % 10), compileCommand(10 + i)}
+			for _, target := range []string{database, fragments} {
+				if err := shared.AppendCompileCommands(target, commands); err != nil {
+					t.Errorf("AppendCompileCommands(%v) failed: %v\n", target, err)
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	commands, err := shared.ReadCompileCommands(database)
+	if err != nil || len(commands) != 30 {
+		t.Errorf("The compilation database holds %v commands (err = %v), not 30\n", len(commands), err)
+	}
+	if found, _ := filepath.Glob(filepath.Join(fragments, "*.json")); len(found) != 20 {
+		t.Errorf("There are %v fragments, not 20\n", len(found))
+	}
+
+	merged := filepath.Join(dir, "merged.json")
+	args := []string{"gllvm-compdb", "-o", merged, "-rm", fragments}
+	if exitCode := shared.CompileDatabaseTool(args); exitCode != 0 {
+		t.Fatalf("%v returned %v\n", args, exitCode)
+	}
+	if commands, err = shared.ReadCompileCommands(merged); err != nil || len(commands) != 30 {
+		t.Errorf("The merged compilation database holds %v commands (err = %v), not 30\n", len(commands), err)
+	}
+	if found, _ := filepath.Glob(filepath.Join(fragments, "*")); len(found) != 0 {
+		t.Errorf("-rm left the fragments %v\n", found)
+	}
+
+	// a later command for the same file replaces the earlier one
+	recompiled := compileCommand(3)
+	recompiled.Arguments = append(recompiled.Arguments, "-O2")
+	if err = shared.AppendCompileCommands(database, []shared.CompileCommand{recompiled}); err != nil {
+		t.Fatalf("AppendCompileCommands(%v) failed: %v\n", database, err)
+	}
+	commands, err = shared.MergeCompileCommands([]string{merged, database})
+	if err != nil || len(commands) != 30 || len(commands[29].Arguments) != 4 {
+		t.Errorf("MergeCompileCommands returned %v, %v\n", commands, err)
+	}
+}
+
+func Test_compile_command_arguments(t *testing.T) {
+	defer restoreEnvironment([]string{"LLVM_COMPILER_PATH", "LLVM_CC_NAME", "GLLVM_COMPILE_COMMANDS", "WLLVM_BC_STORE", "WLLVM_CONFIGURE_ONLY"})()
+	dir := t.TempDir()
+	// a compiler that just makes its output, empty
+	script := "#!/bin/sh\nwhile [ $# -gt 0 ]; do if [ \"$1\" = -o ]; then : > \"$2\"; fi; shift; done\n"
+	if err := os.WriteFile(filepath.Join(dir, "clang"), []byte(script), 0755); err != nil {
+		t.Fatalf("Could not write the compiler: %v\n", err)
+	}
+	if err := os.Mkdir(filepath.Join(dir, "out"), 0755); err != nil {
+		t.Fatalf("Could not create the output directory: %v\n", err)
+	}
+	database := filepath.Join(dir, "compile_commands.json")
+	os.Setenv("LLVM_COMPILER_PATH", dir)
+	os.Unsetenv("LLVM_CC_NAME")
+	os.Unsetenv("WLLVM_BC_STORE")
+	os.Unsetenv("WLLVM_CONFIGURE_ONLY")
+	os.Setenv("GLLVM_COMPILE_COMMANDS", database)
+	shared.FetchEnvironment()
+
+	wd, _ := os.Getwd()
+	if err := os.Chdir(dir); err != nil {
+		t.Fatalf("Could not change to %v: %v\n", dir, err)
+	}
+	defer func() { _ = os.Chdir(wd) }()
+
+	// compile and link: each file gets the command that compiles it alone, to the object it would make
+	shared.Compile([]string{"-O2", "-DX", "foo.c", "-x", "c", "bar.inc", "-lm", "-o", "prog"}, "clang")
+	// compile only: the object is the one asked for
+	shared.Compile([]string{"-O2", "-c", "baz.c", "-o", "out/baz.o"}, "clang")
+	// no bitcode of ours, but compiles all the same
+	shared.Compile([]string{"-c", "start.S"}, "clang")
+	shared.Compile([]string{"-O2", "-S", "qux.c"}, "clang")
+	shared.Compile([]string{"-c", "-flto=thin", "lto.c", "-o", "lto.o"}, "clang")
+	// not compiles
+	shared.Compile([]string{"-E", "pre.c"}, "clang")
+	shared.Compile([]string{"-M", "deps.c"}, "clang")
+	os.Setenv("WLLVM_CONFIGURE_ONLY", "1")
+	shared.FetchEnvironment()
+	shared.Compile([]string{"-c", "conftest.c"}, "clang")
+
+	commands, err := shared.ReadCompileCommands(database)
+	if err != nil {
+		t.Fatalf("Could not read %v: %v\n", database, err)
+	}
+	expected := map[string][]string{
+		"foo.c":      {filepath.Join(dir, "clang"), "-O2", "-DX", "-c", "foo.c", "-o", "foo.o"},
+		"bar.inc":    {filepath.Join(dir, "clang"), "-O2", "-DX", "-c", "-x", "c", "bar.inc", "-o", "bar.o"},
+		"baz.c":      {filepath.Join(dir, "clang"), "-O2", "-c", "baz.c", "-o", "out/baz.o"},
+		"start.S":    {filepath.Join(dir, "clang"), "-c", "start.S", "-o", "start.o"},
+		"qux.c":      {filepath.Join(dir, "clang"), "-O2", "-S", "qux.c", "-o", "qux.s"},
+		"lto.c":      {filepath.Join(dir, "clang"), "-flto=thin", "-c", "lto.c", "-o", "lto.o"},
+		"conftest.c": {filepath.Join(dir, "clang"), "-c", "conftest.c", "-o", "conftest.o"},
+	}
+	if len(commands) != len(expected) {
+		t.Errorf("The compilation database has %v commands, expected %v\n", len(commands), len(expected))
+	}
+	for _, command := range commands {
+		arguments := expected[command.File]
+		if !reflect.DeepEqual(command.Arguments, arguments) || command.Output != arguments[len(arguments)-1] {
+			t.Errorf("The command of %v is %v with the output %v, expected %v\n", command.File, command.Arguments, command.Output, arguments)
+		}
+	}
+}
@@ -0,0 +1,106 @@
+package test
+
+import (
+	"debug/elf"
+	"encoding/binary"
+	"encoding/json"
+	"github.com/SRI-CSL/gllvm/shared"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// objectWithRecord returns an ELF object whose bitcode section records the path.
+func objectWithRecord(t *testing.T, dir string, name string, bcFile string) string {
+	objFile := filepath.Join(dir, name)
+	if err := os.WriteFile(objFile, minimalELF(t, elf.ELFCLASS64, binary.LittleEndian, elf.ET_REL), 0644); err != nil {
+		t.Fatalf("Could not write %v: %v\n", objFile, err)
+	}
+	if bcFile == "" {
+		return objFile
+	}
+	record, err := shared.EncodeBitcodeRecord(shared.BitcodeRecord{Path: bcFile})
+	if err != nil {
+		t.Fatalf("EncodeBitcodeRecord failed: %v\n", err)
+	}
+	if err = shared.InjectELFSection(objFile, shared.ELFSectionName, record); err != nil {
+		t.Fatalf("InjectELFSection(%v) failed: %v\n", objFile, err)
+	}
+	return objFile
+}
+
+func Test_coverage_report(t *testing.T) {
+	dir := t.TempDir()
+	found := filepath.Join(dir, ".found.o.bc")
+	assemble(t, "define i32 @found() {\n  ret i32 0\n}\n", found)
+	missing := filepath.Join(dir, ".missing.o.bc")
+
+	var entries []arEntry
+	for _, object := range []struct{ name, bcFile string }{
+		{"found.o", found}, {"missing.o", missing}, {"none.o", ""},
+	} {
+		contents, err := os.ReadFile(objectWithRecord(t, dir, object.name, object.bcFile))
+		if err != nil {
+			t.Fatalf("Could not read %v: %v\n", object.name, err)
+		}
+		entries = append(entries, arEntry{arHeader(object.name+"/", len(contents)), string(contents)})
+	}
+	archive := filepath.Join(dir, "libcov.a")
+	writeArchive(t, archive, "!<arch>\n", entries)
+
+	output := filepath.Join(dir, "libcov.bc")
+	jsonReport := filepath.Join(dir, "coverage.json")
+	args := []string{"get-bc", "-b", "-coverage", jsonReport, "-o", output, archive}
+	if exitCode := shared.Extract(args); exitCode != 0 {
+		t.Fatalf("Extraction of %v returned %v\n", args, exitCode)
+	}
+	contents, err := os.ReadFile(jsonReport)
+	if err != nil {
+		t.Fatalf("Could not read the coverage report: %v\n", err)
+	}
+	var report shared.CoverageReport
+	if err = json.Unmarshal(contents, &report); err != nil {
+		t.Fatalf("The coverage report is not JSON: %v\n%s\n", err, contents)
+	}
+	expected := []shared.CoverageEntry{
+		{Object: archive + "(found.o)", Section: true, Bitcode: found, Found: true, Location: found},
+		{Object: archive + "(missing.o)", Section: true, Bitcode: missing},
+		{Object: archive + "(none.o)"},
+	}
+	if len(report.Entries) != len(expected) {
+		t.Fatalf("The coverage report has %v entries, expected %v:\n%s\n", len(report.Entries), len(expected), contents)
+	}
+	for i, entry := range report.Entries {
+		if entry != expected[i] {
+			t.Errorf("Coverage entry %v is %+v, expected %+v\n", i, entry, expected[i])
+		}
+	}
+	if report.Found != 1 || report.Total != 3 || report.Coverage < 33.3 || report.Coverage > 33.4 {
+		t.Errorf("The coverage is %v of %v (%v%%), expected 1 of 3\n", report.Found, report.Total, report.Coverage)
+	}
+
+	textReport := filepath.Join(dir, "coverage.txt")
+	args = []string{"get-bc", "-b", "-coverage", textReport, "-min-coverage", "30", "-o", output, archive}
+	if exitCode := shared.Extract(args); exitCode != 0 {
+		t.Errorf("Extraction of %v returned %v\n", args, exitCode)
+	}
+	if contents, err = os.ReadFile(textReport); err != nil {
+		t.Fatalf("Could not read the coverage report: %v\n", err)
+	}
+	for _, line := range []string{
+		archive + "(found.o): " + found + " found\n",
+		archive + "(missing.o): " + missing + " missing\n",
+		archive + "(none.o): no bitcode section\n",
+		"Coverage: 1 of 3 (33.3%)\n",
+	} {
+		if !strings.Contains(string(contents), line) {
+			t.Errorf("The coverage report lacks %q:\n%s\n", line, contents)
+		}
+	}
+
+	args = []string{"get-bc", "-b", "-min-coverage", "50", "-o", output, archive}
+	if exitCode := shared.Extract(args); exitCode == 0 {
+		t.Errorf("Extraction of %v should fail below the minimum coverage\n", args)
+	}
+}
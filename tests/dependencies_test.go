@@ -0,0 +1,115 @@
+package test
+
+import (
+	"github.com/SRI-CSL/gllvm/shared"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// compileWithBitcode compiles the C source with gcc, and injects a record for the bitcode module into the object.
+func compileWithBitcode(t *testing.T, dir string, name string, cSource string, llSource string) string {
+	cFile := filepath.Join(dir, name+".c")
+	objFile := filepath.Join(dir, name+".o")
+	bcFile := filepath.Join(dir, "."+name+".o.bc")
+	if err := os.WriteFile(cFile, []byte(cSource), 0644); err != nil {
+		t.Fatalf("Could not write %v: %v\n", cFile, err)
+	}
+	if out, err := exec.Command("gcc", "-fPIC", "-c", cFile, "-o", objFile).CombinedOutput(); err != nil {
+		t.Fatalf("gcc failed: %v %s\n", err, out)
+	}
+	assemble(t, llSource, bcFile)
+	record, err := shared.EncodeBitcodeRecord(shared.BitcodeRecord{Path: bcFile})
+	if err != nil {
+		t.Fatalf("EncodeBitcodeRecord failed: %v\n", err)
+	}
+	if err = shared.InjectELFSection(objFile, shared.ELFSectionName, record); err != nil {
+		t.Fatalf("InjectELFSection(%v) failed: %v\n", objFile, err)
+	}
+	return objFile
+}
+
+func checkModuleDefines(t *testing.T, bcFile string, defined []string, undefined []string) {
+	out, err := exec.Command("llvm-dis", bcFile, "-o", "-").CombinedOutput()
+	if err != nil {
+		t.Fatalf("llvm-dis %v failed: %v %s\n", bcFile, err, out)
+	}
+	for _, name := range defined {
+		if !strings.Contains(string(out), "define i32 @"+name+"()") {
+			t.Errorf("%v should define %v:\n%s\n", bcFile, name, out)
+		}
+	}
+	for _, name := range undefined {
+		if strings.Contains(string(out), "define i32 @"+name+"()") {
+			t.Errorf("%v should not define %v:\n%s\n", bcFile, name, out)
+		}
+	}
+}
+
+func Test_dependency_extraction(t *testing.T) {
+	if _, err := exec.LookPath("gcc"); err != nil {
+		t.Skip("gcc is not installed")
+	}
+	defer restoreEnvironment([]string{"LD_LIBRARY_PATH"})()
+	os.Unsetenv("LD_LIBRARY_PATH")
+	dir := t.TempDir()
+
+	fooObj := compileWithBitcode(t, dir, "foo", "int foo(void) { return 0; }\n",
+		"define i32 @foo() {\n  ret i32 0\n}\n")
+	mainObj := compileWithBitcode(t, dir, "main", "int foo(void);\nint main(void) { return foo(); }\n",
+		"declare i32 @foo()\n\ndefine i32 @main() {\n  %r = call i32 @foo()\n  ret i32 %r\n}\n")
+
+	libDir := filepath.Join(dir, "lib")
+	if err := os.Mkdir(libDir, 0755); err != nil {
+		t.Fatalf("Could not create %v: %v\n", libDir, err)
+	}
+	library := filepath.Join(libDir, "libfoo.so")
+	if out, err := exec.Command("gcc", "-shared", fooObj, "-o", library).CombinedOutput(); err != nil {
+		t.Fatalf("gcc -shared failed: %v %s\n", err, out)
+	}
+	program := filepath.Join(dir, "prog")
+	if out, err := exec.Command("gcc", mainObj, "-L", libDir, "-lfoo", "-Wl,-rpath,$ORIGIN/lib", "-o", program).CombinedOutput(); err != nil {
+		t.Fatalf("gcc failed to link %v: %v %s\n", program, err, out)
+	}
+
+	// without following the dependencies only main is there
+	output := filepath.Join(dir, "prog.bc")
+	args := []string{"get-bc", "-o", output, program}
+	if exitCode := shared.Extract(args); exitCode != 0 {
+		t.Fatalf("Extraction of %v returned %v\n", args, exitCode)
+	}
+	checkModuleDefines(t, output, []string{"main"}, []string{"foo"})
+
+	// following them links foo in too
+	args = []string{"get-bc", "-d", "-o", output, program}
+	if exitCode := shared.Extract(args); exitCode != 0 {
+		t.Fatalf("Extraction of %v returned %v\n", args, exitCode)
+	}
+	checkModuleDefines(t, output, []string{"main", "foo"}, nil)
+
+	// or it gets a module of its own
+	split := filepath.Join(dir, "split")
+	if err := os.Mkdir(split, 0755); err != nil {
+		t.Fatalf("Could not create %v: %v\n", split, err)
+	}
+	output = filepath.Join(split, "prog.bc")
+	args = []string{"get-bc", "-D", "-o", output, program}
+	if exitCode := shared.Extract(args); exitCode != 0 {
+		t.Fatalf("Extraction of %v returned %v\n", args, exitCode)
+	}
+	checkModuleDefines(t, output, []string{"main"}, []string{"foo"})
+	libraryModule := filepath.Join(split, "libfoo.so.bc")
+	checkModuleDefines(t, libraryModule, []string{"foo"}, []string{"main"})
+
+	manifest, err := os.ReadFile(output + ".deps.manifest")
+	if err != nil {
+		t.Fatalf("Could not read the dependency manifest: %v\n", err)
+	}
+	realLibrary, _ := filepath.EvalSymlinks(library)
+	expected := program + "\t" + output + "\n" + realLibrary + "\t" + libraryModule + "\n"
+	if string(manifest) != expected {
+		t.Errorf("The dependency manifest is %q, expected %q\n", manifest, expected)
+	}
+}
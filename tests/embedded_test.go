@@ -0,0 +1,82 @@
+package test
+
+import (
+	"bytes"
+	"debug/elf"
+	"encoding/binary"
+	"github.com/SRI-CSL/gllvm/shared"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
+
+func Test_embedded_bitcode_records(t *testing.T) {
+	first, err := shared.EncodeEmbeddedBitcode("/tmp/first.bc", []byte("BC\xc0\xde first"))
+	if err != nil {
+		t.Fatalf("EncodeEmbeddedBitcode failed: %v\n", err)
+	}
+	second, err := shared.EncodeEmbeddedBitcode("/tmp/second.bc", bytes.Repeat([]byte("second"), 1000))
+	if err != nil {
+		t.Fatalf("EncodeEmbeddedBitcode failed: %v\n", err)
+	}
+	// what the linker makes of two objects' sections
+	section := append(append(append([]byte{}, first...), 0, 0, 0), second...)
+	modules, err := shared.DecodeEmbeddedBitcode(section)
+	if err != nil {
+		t.Fatalf("DecodeEmbeddedBitcode failed: %v\n", err)
+	}
+	if len(modules) != 2 || modules[0].Path != "/tmp/first.bc" || string(modules[0].Bitcode) != "BC\xc0\xde first" ||
+		modules[1].Path != "/tmp/second.bc" || !bytes.Equal(modules[1].Bitcode, bytes.Repeat([]byte("second"), 1000)) {
+		t.Errorf("DecodeEmbeddedBitcode returned %v\n", modules)
+	}
+	if _, err = shared.DecodeEmbeddedBitcode(first[:len(first)-1]); err == nil {
+		t.Errorf("DecodeEmbeddedBitcode should reject a truncated record\n")
+	}
+	// lengths whose sum overflows
+	overflow := append([]byte{}, first[:16]...)
+	binary.LittleEndian.PutUint32(overflow[4:], 1)
+	binary.LittleEndian.PutUint64(overflow[8:], 0xFFFFFFFFFFFFFFFF)
+	if _, err = shared.DecodeEmbeddedBitcode(append(overflow, "abcd"...)); err == nil {
+		t.Errorf("DecodeEmbeddedBitcode should reject a record whose lengths overflow\n")
+	}
+	if _, err = shared.DecodeEmbeddedBitcode([]byte("/tmp/first.bc\n")); err == nil {
+		t.Errorf("DecodeEmbeddedBitcode should reject a section of paths\n")
+	}
+}
+
+func Test_embedded_bitcode_extraction(t *testing.T) {
+	dir := t.TempDir()
+	bcFile := filepath.Join(dir, "hello.bc")
+	if out, err := exec.Command("llvm-as", "../data/macho/hello.ll", "-o", bcFile).CombinedOutput(); err != nil {
+		t.Fatalf("llvm-as failed: %v %s\n", err, out)
+	}
+	bitcode, err := os.ReadFile(bcFile)
+	if err != nil {
+		t.Fatalf("Could not read %v: %v\n", bcFile, err)
+	}
+	record, err := shared.EncodeEmbeddedBitcode(bcFile, bitcode)
+	if err != nil {
+		t.Fatalf("EncodeEmbeddedBitcode failed: %v\n", err)
+	}
+	objFile := filepath.Join(dir, "hello.o")
+	if err = os.WriteFile(objFile, minimalELF(t, elf.ELFCLASS64, binary.LittleEndian, elf.ET_REL), 0644); err != nil {
+		t.Fatalf("Could not write %v: %v\n", objFile, err)
+	}
+	if err = shared.InjectELFSection(objFile, shared.ELFSectionName, []byte(bcFile+"\n")); err != nil {
+		t.Fatalf("InjectELFSection(%v) failed: %v\n", objFile, err)
+	}
+	if err = shared.InjectELFSection(objFile, shared.ELFBitcodeSectionName, record); err != nil {
+		t.Fatalf("InjectELFSection(%v) failed: %v\n", objFile, err)
+	}
+
+	// the object should no longer depend on the bitcode file
+	if err = os.Remove(bcFile); err != nil {
+		t.Fatalf("Could not remove %v: %v\n", bcFile, err)
+	}
+	output := filepath.Join(dir, "extracted.bc")
+	args := []string{"get-bc", "-S", "-o", output, objFile}
+	if exitCode := shared.Extract(args); exitCode != 0 || !shared.IsPlainFile(output) {
+		t.Errorf("Extraction of %v returned %v\n", args, exitCode)
+	}
+}
@@ -46,6 +46,7 @@ func Test_env_and_args(t *testing.T) {
 	}
 
 	shared.ResetEnvironment()
+	defer restoreEnvironment([]string{"LLVM_COMPILER_PATH", "LLVM_CC_NAME", "LLVM_CXX_NAME", "LLVM_LINK_NAME", "LLVM_AR_NAME"})()
 
 	ea := shared.ParseSwitches(args)
 	if !ea.Verbose {
@@ -89,3 +90,26 @@ func Test_env_and_args(t *testing.T) {
 		"/the_future_is_here/clang-666",
 		"/the_future_is_here/clang++-666")
 }
+
+// restoreEnvironment returns a function that puts the variables back the way they are now, so
+// that the tests that follow do not see our fictional toolchain.
+func restoreEnvironment(vars []string) func() {
+	saved := make(map[string]*string)
+	for _, v := range vars {
+		if val, ok := os.LookupEnv(v); ok {
+			saved[v] = &val
+		} else {
+			saved[v] = nil
+		}
+	}
+	return func() {
+		for v, val := range saved {
+			if val != nil {
+				os.Setenv(v, *val)
+			} else {
+				os.Unsetenv(v)
+			}
+		}
+		shared.FetchEnvironment()
+	}
+}
@@ -0,0 +1,94 @@
+package test
+
+import (
+	"bytes"
+	"debug/macho"
+	"encoding/binary"
+	"github.com/SRI-CSL/gllvm/shared"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
+
+// writeFat glues (little endian) Mach-O files into a universal binary.
+func writeFat(t *testing.T, path string, slices [][]byte) {
+	var buf bytes.Buffer
+	const align = 1 << 12
+	err := binary.Write(&buf, binary.BigEndian, []uint32{macho.MagicFat, uint32(len(slices))})
+	offset := uint32(align)
+	var offsets []uint32
+	for _, slice := range slices {
+		cpu := binary.LittleEndian.Uint32(slice[4:8])
+		subCpu := binary.LittleEndian.Uint32(slice[8:12])
+		if err == nil {
+			err = binary.Write(&buf, binary.BigEndian, []uint32{cpu, subCpu, offset, uint32(len(slice)), 12})
+		}
+		offsets = append(offsets, offset)
+		offset = (offset + uint32(len(slice)) + align - 1) &^ (align - 1)
+	}
+	if err != nil {
+		t.Fatalf("Could not lay out %v: %v\n", path, err)
+	}
+	for i, slice := range slices {
+		buf.Write(make([]byte, int(offsets[i])-buf.Len()))
+		buf.Write(slice)
+	}
+	if err = os.WriteFile(path, buf.Bytes(), 0644); err != nil {
+		t.Fatalf("Could not write %v: %v\n", path, err)
+	}
+}
+
+func Test_fat_extraction(t *testing.T) {
+	dir := t.TempDir()
+	var slices [][]byte
+	for _, arch := range []string{"x86_64", "arm64"} {
+		bcFile := filepath.Join(dir, arch+".bc")
+		if out, err := exec.Command("llvm-as", "../data/macho/hello.ll", "-o", bcFile).CombinedOutput(); err != nil {
+			t.Fatalf("llvm-as failed: %v %s\n", err, out)
+		}
+		fixture, err := os.ReadFile("../data/macho/hello_" + arch + ".o")
+		if err != nil {
+			t.Fatalf("Could not read the %v fixture: %v\n", arch, err)
+		}
+		objFile := filepath.Join(dir, arch+".o")
+		if err = os.WriteFile(objFile, fixture, 0644); err != nil {
+			t.Fatalf("Could not write %v: %v\n", objFile, err)
+		}
+		if err = shared.InjectMachOSection(objFile, shared.DarwinSegmentName, shared.DarwinSectionName, []byte(bcFile+"\n")); err != nil {
+			t.Fatalf("InjectMachOSection(%v) failed: %v\n", objFile, err)
+		}
+		slice, err := os.ReadFile(objFile)
+		if err != nil {
+			t.Fatalf("Could not read %v: %v\n", objFile, err)
+		}
+		slices = append(slices, slice)
+	}
+	fatFile := filepath.Join(dir, "fat.o")
+	writeFat(t, fatFile, slices)
+
+	if bt := shared.GetBinaryType(fatFile); bt != shared.BinaryObject {
+		t.Errorf("GetBinaryType(%v) = %v\n", fatFile, bt)
+	}
+
+	output := filepath.Join(dir, "fat.bc")
+	args := []string{"get-bc", "-o", output, fatFile}
+	if exitCode := shared.Extract(args); exitCode != 0 {
+		t.Errorf("Extraction of %v returned %v\n", args, exitCode)
+	}
+	for _, arch := range []string{"x86_64", "arm64"} {
+		if module := filepath.Join(dir, "fat."+arch+".bc"); !shared.IsPlainFile(module) {
+			t.Errorf("Extraction of %v did not produce %v\n", args, module)
+		}
+	}
+
+	output = filepath.Join(dir, "arm64.only.bc")
+	args = []string{"get-bc", "-arch", "arm64", "-o", output, fatFile}
+	if exitCode := shared.Extract(args); exitCode != 0 || !shared.IsPlainFile(output) {
+		t.Errorf("Extraction of %v returned %v\n", args, exitCode)
+	}
+	args = []string{"get-bc", "-arch", "ppc", "-o", output, fatFile}
+	if exitCode := shared.Extract(args); exitCode == 0 {
+		t.Errorf("Extraction of %v should fail\n", args)
+	}
+}
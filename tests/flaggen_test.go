@@ -0,0 +1,157 @@
+package test
+
+import (
+	"github.com/SRI-CSL/gllvm/shared"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const clangHelp = `OVERVIEW: clang LLVM compiler
+
+USAGE: clang [options] file...
+
+OPTIONS:
+  -c                      Only run preprocess, compile, and assemble steps
+  -fprofile-use[=<pathname>]
+                          Use instrumentation data for profile-guided optimization
+  -fsanitize=<check>      Turn on runtime checks for various forms of undefined or suspicious behavior.
+  -I <dir>                Add directory to include search path.
+  -MF <file>              Write depfile output from -MMD, -MD, -MM, or -M to <file>
+  -o <file>               Write output to <file>
+  -sectalign <a> <b> <c>  Align a section
+  -shared-libsan          Dynamically link the sanitizer runtime
+  -Wl,<arg>               Pass the comma separated arguments in <arg> to the linker
+  -Xopenmp-target=<triple> <arg>
+                          Pass <arg> to the target offloading toolchain identified by <triple>.
+  -z <arg>                Pass -z <arg> to the linker
+`
+
+// generateFlags runs gllvm-flags on the input, and returns the flag specification and the report.
+func generateFlags(t *testing.T, dir string, input string) (spec shared.FlagSpec, report string) {
+	output := filepath.Join(dir, "flags.json")
+	reportFile := filepath.Join(dir, "report.txt")
+	args := []string{"gllvm-flags", "-o", output, "-report", reportFile, input}
+	if exitCode := shared.FlagsTool(args); exitCode != 0 {
+		t.Fatalf("%v returned %v\n", args, exitCode)
+	}
+	spec, err := shared.LoadFlagSpec(output)
+	if err != nil {
+		t.Fatalf("The generated flags are not valid: %v\n", err)
+	}
+	contents, err := os.ReadFile(reportFile)
+	if err != nil {
+		t.Fatalf("Could not read the report: %v\n", err)
+	}
+	return spec, string(contents)
+}
+
+func Test_generate_flags_from_help(t *testing.T) {
+	dir := t.TempDir()
+	defer restoreEnvironment([]string{"GLLVM_FLAGS_FILE"})()
+	os.Unsetenv("GLLVM_FLAGS_FILE")
+	shared.FetchEnvironment()
+
+	input := filepath.Join(dir, "help.txt")
+	if err := os.WriteFile(input, []byte(clangHelp), 0644); err != nil {
+		t.Fatalf("Could not write %v: %v\n", input, err)
+	}
+	spec, report := generateFlags(t, dir, input)
+
+	separateOrJoined := func(flag string) []string {
+		return []string{flag + " <arg>", flag + "<arg>"}
+	}
+	expectedExact := []shared.FlagSpecEntry{
+		{Flag: "-c", Arity: 0, Action: "compileOnly"},
+		{Flag: "-fprofile-use", Arity: 0, Action: "compile"},
+		{Flag: "-fprofile-use=", Arity: 1, Action: "compile", Spellings: []string{"-fprofile-use=<arg>"}},
+		{Flag: "-fsanitize=", Arity: 1, Action: "compile", Spellings: []string{"-fsanitize=<arg>"}},
+		{Flag: "-I", Arity: 1, Action: "compile", Spellings: separateOrJoined("-I")},
+		{Flag: "-MF", Arity: 1, Action: "dependency", Spellings: separateOrJoined("-MF")},
+		{Flag: "-o", Arity: 1, Action: "output", Spellings: separateOrJoined("-o")},
+		{Flag: "-shared-libsan", Arity: 0, Action: "link"},
+		{Flag: "-Wl,", Arity: 1, Action: "link", Spellings: []string{"-Wl,<arg>"}},
+		{Flag: "-z", Arity: 1, Action: "link", Spellings: separateOrJoined("-z")},
+	}
+	if !reflect.DeepEqual(spec.Exact, expectedExact) {
+		t.Errorf("The exact flags are\n%+v\nexpected\n%+v\n", spec.Exact, expectedExact)
+	}
+	expectedPatterns := []shared.FlagSpecEntry{
+		{Pattern: "^-Xopenmp-target=.+$", Arity: 1, Action: "compile"},
+	}
+	if !reflect.DeepEqual(spec.Patterns, expectedPatterns) {
+		t.Errorf("The patterns are\n%+v\nexpected\n%+v\n", spec.Patterns, expectedPatterns)
+	}
+
+	for _, line := range []string{
+		"-shared-libsan\tunrecognized\t\tlink",
+		"-z <arg>\tunrecognized\t\tlink",
+		"-z<arg>\tunrecognized\t\tlink",
+		"-Xopenmp-target=<arg> <arg>\tunrecognized\t\tcompile",
+		"-sectalign\tskipped\t\tit takes 3 arguments",
+	} {
+		if !strings.Contains(report, line+"\n") {
+			t.Errorf("The report lacks %q:\n%v\n", line, report)
+		}
+	}
+	for _, flag := range []string{"-fsanitize=", "-I", "-MF", "-o"} {
+		if strings.Contains(report, "\n"+flag) {
+			t.Errorf("The report has %v, which is classified correctly:\n%v\n", flag, report)
+		}
+	}
+}
+
+func Test_generate_flags_from_tblgen(t *testing.T) {
+	tblgen, err := exec.LookPath("llvm-tblgen")
+	if err != nil {
+		t.Skip("llvm-tblgen is not installed")
+	}
+	includeDir, err := exec.Command("llvm-config", "--includedir").Output()
+	if err != nil {
+		t.Skip("llvm-config is not installed")
+	}
+	dir := t.TempDir()
+	td := filepath.Join(dir, "Options.td")
+	options := `include "llvm/Option/OptParser.td"
+def LinkerInput : OptionFlag;
+def NoDriverOption : OptionFlag;
+def Link_Group : OptionGroup<"<T/e/s/t/u group>">;
+def CompileOnly_Group : OptionGroup<"<CompileOnly group>">;
+def M_Group : OptionGroup<"<M group>">, Group<CompileOnly_Group>;
+def I : JoinedOrSeparate<["-"], "I">;
+def MF : JoinedOrSeparate<["-"], "MF">, Group<M_Group>;
+def shared : Flag<["-", "--"], "shared">, Group<Link_Group>;
+def Wl_COMMA : CommaJoined<["-"], "Wl,">, Flags<[LinkerInput]>;
+def cc1_only : Flag<["-"], "cc1-only">, Flags<[NoDriverOption]>;
+def segaddr : MultiArg<["-"], "segaddr", 2>;
+`
+	if err = os.WriteFile(td, []byte(options), 0644); err != nil {
+		t.Fatalf("Could not write %v: %v\n", td, err)
+	}
+	input := filepath.Join(dir, "options.json")
+	out, err := exec.Command(tblgen, "-dump-json", "-I", strings.TrimSpace(string(includeDir)), "-o", input, td).CombinedOutput()
+	if err != nil {
+		t.Skipf("llvm-tblgen failed: %v %s", err, out)
+	}
+
+	spec, report := generateFlags(t, dir, input)
+	expectedExact := []shared.FlagSpecEntry{
+		{Flag: "-I", Arity: 1, Action: "compile", Spellings: []string{"-I <arg>", "-I<arg>"}},
+		{Flag: "-MF", Arity: 1, Action: "dependency", Spellings: []string{"-MF <arg>", "-MF<arg>"}},
+		{Flag: "-Wl,", Arity: 1, Action: "link", Spellings: []string{"-Wl,<arg>"}},
+		{Flag: "-shared", Arity: 0, Action: "link"},
+		{Flag: "--shared", Arity: 0, Action: "link"},
+	}
+	if !reflect.DeepEqual(spec.Exact, expectedExact) {
+		t.Errorf("The exact flags are\n%+v\nexpected\n%+v\n", spec.Exact, expectedExact)
+	}
+	if len(spec.Patterns) != 0 {
+		t.Errorf("There should be no patterns: %+v\n", spec.Patterns)
+	}
+	if !strings.Contains(report, "-segaddr\tskipped\t\tit takes 2 arguments\n") || !strings.Contains(report, "--shared\tunrecognized") {
+		t.Errorf("The report is wrong:\n%v\n", report)
+	}
+}
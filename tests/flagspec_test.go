@@ -0,0 +1,267 @@
+package test
+
+import (
+	"encoding/json"
+	"github.com/SRI-CSL/gllvm/shared"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// checkFlagAction checks that the parse of a flag, and its arguments, did what the action says.
+// A flag with its argument joined to it goes on as it is.
+func checkFlagAction(t *testing.T, action string, flag string, args []string, pr shared.ParserResult) {
+	all := append([]string{flag}, args...)
+	if strings.HasSuffix(flag, "argument") {
+		args = []string{"argument"}
+	}
+	var ok bool
+	switch action {
+	case "input":
+		ok = reflect.DeepEqual(pr.InputFiles, all)
+	case "object":
+		ok = reflect.DeepEqual(pr.ObjectFiles, all) && reflect.DeepEqual(pr.LinkArgs, all)
+	case "output":
+		ok = pr.OutputFilename == args[0]
+	case "language":
+		ok = len(pr.CompileArgs) == 0 && len(pr.LinkArgs) == 0
+	case "printOnly":
+		ok = pr.IsPrintOnly
+	case "compileOnly":
+		ok = pr.IsCompileOnly
+	case "preprocessOnly":
+		ok = pr.IsPreprocessOnly
+	case "assembleOnly":
+		ok = pr.IsAssembleOnly
+	case "verbose":
+		ok = pr.IsVerbose
+	case "emitLLVM":
+		ok = pr.IsEmitLLVM && pr.IsCompileOnly
+	case "lto":
+		ok = pr.IsLTO
+	case "dependency":
+		ok = pr.IsDependencyOnly && reflect.DeepEqual(pr.CompileArgs, all)
+	case "compile":
+		ok = reflect.DeepEqual(pr.CompileArgs, all) && len(pr.LinkArgs) == 0
+	case "link":
+		ok = reflect.DeepEqual(pr.LinkArgs, all) && len(pr.CompileArgs) == 0
+	case "compileLink":
+		ok = reflect.DeepEqual(pr.CompileArgs, all) && reflect.DeepEqual(pr.LinkArgs, all)
+	case "ignore":
+		ok = len(pr.CompileArgs) == 0 && len(pr.LinkArgs) == 0
+	case "forbidden":
+		ok = reflect.DeepEqual(pr.ForbiddenFlags, all)
+	}
+	if !ok {
+		t.Errorf("The parse of %v is not that of a %v flag: %v\n", all, action, &pr)
+	}
+}
+
+func Test_builtin_flag_spec(t *testing.T) {
+	spec, err := shared.BuiltinFlagSpec()
+	if err != nil {
+		t.Fatalf("The built-in flags are not valid: %v\n", err)
+	}
+	if len(spec.Exact) == 0 || len(spec.Patterns) == 0 {
+		t.Fatalf("The built-in flags are missing: %+v\n", spec)
+	}
+
+	contents, err := json.Marshal(spec)
+	if err != nil {
+		t.Fatalf("Could not marshal the built-in flags: %v\n", err)
+	}
+	var roundTrip shared.FlagSpec
+	if err = json.Unmarshal(contents, &roundTrip); err != nil {
+		t.Fatalf("Could not unmarshal the built-in flags: %v\n", err)
+	}
+	if !reflect.DeepEqual(spec, roundTrip) {
+		t.Errorf("The built-in flags do not round trip:\n%+v\n%+v\n", spec, roundTrip)
+	}
+
+	for _, entry := range spec.Exact {
+		spellings := entry.Spellings
+		if len(spellings) == 0 {
+			spellings = []string{entry.Flag}
+			if entry.Arity > 0 {
+				spellings[0] += " <arg>"
+			}
+		}
+		for _, spelling := range spellings {
+			var flag string
+			var args []string
+			if strings.HasSuffix(spelling, " <arg>") {
+				flag, args = strings.TrimSuffix(spelling, " <arg>"), []string{"argument"}
+			} else {
+				flag = strings.Replace(spelling, "<arg>", "argument", 1)
+			}
+			pr := shared.Parse(append([]string{flag}, args...))
+			checkFlagAction(t, entry.Action, flag, args, pr)
+		}
+	}
+}
+
+func Test_preprocessor_flags(t *testing.T) {
+	// -P and -C take no argument, the file that follows them is an input, not their argument
+	pr := shared.Parse([]string{"-E", "-P", "vmlinux.lds.c", "-C", "-o", "vmlinux.lds", "extra.c"})
+	if !reflect.DeepEqual(pr.InputFiles, []string{"vmlinux.lds.c", "extra.c"}) {
+		t.Errorf("The input files are %v, expected [vmlinux.lds.c extra.c]\n", pr.InputFiles)
+	}
+	if !reflect.DeepEqual(pr.CompileArgs, []string{"-P", "-C"}) {
+		t.Errorf("The compile arguments are %v, expected [-P -C]\n", pr.CompileArgs)
+	}
+	if !pr.IsPreprocessOnly || pr.OutputFilename != "vmlinux.lds" {
+		t.Errorf("The -o after -C is lost: %v\n", &pr)
+	}
+}
+
+func Test_flag_spellings(t *testing.T) {
+	type parse struct {
+		output     string
+		dependency bool
+		compile    []string
+		link       []string
+		languages  []string
+	}
+	output := parse{output: "foo.o"}
+	dependency := func(args ...string) parse { return parse{dependency: true, compile: args} }
+	compile := func(args ...string) parse { return parse{compile: args} }
+	link := func(args ...string) parse { return parse{link: args} }
+	both := func(args ...string) parse { return parse{compile: args, link: args} }
+	language := func(languages ...string) parse { return parse{languages: languages} }
+	spellings := []struct {
+		args     []string
+		expected parse
+	}{
+		{[]string{"-o", "foo.o"}, output},
+		{[]string{"-ofoo.o"}, output},
+		{[]string{"--output", "foo.o"}, output},
+		{[]string{"--output=foo.o"}, output},
+		// flags that start with -o are not -o with their argument joined to it
+		{[]string{"-order_file", "syms.txt", "main.o"}, link("-order_file", "syms.txt", "main.o")},
+		{[]string{"-c", "-objcmt-migrate-literals", "foo.c"}, parse{compile: []string{"-objcmt-migrate-literals"}, languages: []string{""}}},
+		{[]string{"-object", "-o", "foo.o"}, parse{output: "foo.o", link: []string{"-object"}}},
+		{[]string{"-MF", "foo.d"}, dependency("-MF", "foo.d")},
+		{[]string{"-MFfoo.d"}, dependency("-MFfoo.d")},
+		{[]string{"-MT", "foo.o"}, dependency("-MT", "foo.o")},
+		{[]string{"-MTfoo.o"}, dependency("-MTfoo.o")},
+		{[]string{"-MQ", "foo.o"}, dependency("-MQ", "foo.o")},
+		{[]string{"-MQfoo.o"}, dependency("-MQfoo.o")},
+		{[]string{"-MJ", "foo.json"}, dependency("-MJ", "foo.json")},
+		{[]string{"-MJfoo.json"}, dependency("-MJfoo.json")},
+		{[]string{"-x", "c++", "foo.inc"}, language("c++")},
+		{[]string{"-xc++", "foo.inc"}, language("c++")},
+		{[]string{"--param", "inline-unit-growth=20"}, compile("--param", "inline-unit-growth=20")},
+		{[]string{"--param=inline-unit-growth=20"}, compile("--param=inline-unit-growth=20")},
+		{[]string{"-include", "config.h"}, compile("-include", "config.h")},
+		{[]string{"-include-pch", "foo.pch"}, compile("-include-pch", "foo.pch")},
+		{[]string{"-isystem-after", "include"}, compile("-isystem-after", "include")},
+		{[]string{"-isystem-afterinclude"}, compile("-isystem-afterinclude")},
+		{[]string{"-includeconfig.h"}, compile("-includeconfig.h")},
+		{[]string{"-I", "include"}, compile("-I", "include")},
+		{[]string{"-Iinclude"}, compile("-Iinclude")},
+		{[]string{"-isystem", "include"}, compile("-isystem", "include")},
+		{[]string{"-isysteminclude"}, compile("-isysteminclude")},
+		{[]string{"-isysroot", "root"}, compile("-isysroot", "root")},
+		{[]string{"-isysrootroot"}, compile("-isysrootroot")},
+		{[]string{"-D", "NDEBUG"}, compile("-D", "NDEBUG")},
+		{[]string{"-DNDEBUG"}, compile("-DNDEBUG")},
+		{[]string{"-l", "m"}, link("-l", "m")},
+		{[]string{"-lm"}, link("-lm")},
+		{[]string{"-L", "lib"}, link("-L", "lib")},
+		{[]string{"-Llib"}, link("-Llib")},
+		{[]string{"-lazy_library", "libfoo.dylib"}, link("-lazy_library", "libfoo.dylib")},
+		{[]string{"-Ttext", "0x0"}, link("-Ttext", "0x0")},
+		{[]string{"-Ttext0x0"}, link("-Ttext0x0")},
+		{[]string{"-target", "x86_64-linux-gnu"}, both("-target", "x86_64-linux-gnu")},
+		{[]string{"--target", "x86_64-linux-gnu"}, both("--target", "x86_64-linux-gnu")},
+		{[]string{"--target=x86_64-linux-gnu"}, both("--target=x86_64-linux-gnu")},
+		{[]string{"--sysroot", "root"}, both("--sysroot", "root")},
+		{[]string{"--sysroot=root"}, both("--sysroot=root")},
+		{[]string{"-B", "bin"}, both("-B", "bin")},
+		{[]string{"-Bbin"}, both("-Bbin")},
+	}
+	for _, spelling := range spellings {
+		pr := shared.Parse(spelling.args)
+		parsed := parse{pr.OutputFilename, pr.IsDependencyOnly, pr.CompileArgs, pr.LinkArgs, pr.InputLanguages}
+		if !reflect.DeepEqual(parsed, spelling.expected) {
+			t.Errorf("The parse of %v is %+v, expected %+v\n", spelling.args, parsed, spelling.expected)
+		}
+	}
+}
+
+func Test_flag_spec_file(t *testing.T) {
+	dir := t.TempDir()
+	defer restoreEnvironment([]string{"GLLVM_FLAGS_FILE"})()
+
+	// the flags of a file are only loaded once, so each use has its own file
+	useFlags := func(name string, contents string) {
+		file := filepath.Join(dir, name+".json")
+		if err := os.WriteFile(file, []byte(contents), 0644); err != nil {
+			t.Fatalf("Could not write %v: %v\n", file, err)
+		}
+		os.Setenv("GLLVM_FLAGS_FILE", file)
+		shared.FetchEnvironment()
+	}
+
+	// the user's flags override and extend the built-in ones
+	useFlags("extend", `{
+  "exact": [
+    {"flag": "-P", "arity": 1, "action": "compile"},
+    {"flag": "-mylink", "arity": 1, "action": "link"}
+  ],
+  "patterns": [
+    {"pattern": "^-flink-.+$", "arity": 0, "action": "link"}
+  ]
+}`)
+	pr := shared.Parse([]string{"-P", "a", "-mylink", "b", "-flink-this", "-fPIC", "-c", "x.c"})
+	if !reflect.DeepEqual(pr.CompileArgs, []string{"-P", "a", "-fPIC"}) {
+		t.Errorf("The compile arguments are %v\n", pr.CompileArgs)
+	}
+	if !reflect.DeepEqual(pr.LinkArgs, []string{"-mylink", "b", "-flink-this"}) {
+		t.Errorf("The link arguments are %v\n", pr.LinkArgs)
+	}
+	if !pr.IsCompileOnly || !reflect.DeepEqual(pr.InputFiles, []string{"x.c"}) {
+		t.Errorf("The built-in flags are lost: %v\n", &pr)
+	}
+
+	// or replace them
+	useFlags("replace", `{"replace": true, "exact": [{"flag": "-c", "arity": 0, "action": "link"}], "patterns": []}`)
+	pr = shared.Parse([]string{"-c", "-O2"})
+	if pr.IsCompileOnly || !reflect.DeepEqual(pr.LinkArgs, []string{"-c"}) || !reflect.DeepEqual(pr.CompileArgs, []string{"-O2"}) {
+		t.Errorf("The built-in flags were not replaced: %v\n", &pr)
+	}
+
+	// a broken file leaves the built-in flags
+	useFlags("broken", `{"exact": [{"flag": "-c", "arity": 2, "action": "link"}]}`)
+	pr = shared.Parse([]string{"-c", "-O2"})
+	if !pr.IsCompileOnly || !reflect.DeepEqual(pr.CompileArgs, []string{"-O2"}) {
+		t.Errorf("The built-in flags were not used: %v\n", &pr)
+	}
+}
+
+func Test_flag_spec_validation(t *testing.T) {
+	dir := t.TempDir()
+	invalid := map[string]string{
+		"action":    `{"exact": [{"flag": "-c", "arity": 0, "action": "explode"}]}`,
+		"arity":     `{"exact": [{"flag": "-o", "arity": 0, "action": "output"}]}`,
+		"regexp":    `{"patterns": [{"pattern": "^-f(.+$", "arity": 0, "action": "compile"}]}`,
+		"duplicate": `{"exact": [{"flag": "-g", "arity": 0, "action": "compile"}, {"flag": "-g", "arity": 0, "action": "link"}]}`,
+		"empty":     `{"exact": [{"pattern": "^-g$", "arity": 0, "action": "compile"}]}`,
+		"field":     `{"exact": [{"flag": "-g", "arity": 0, "action": "compile", "when": "always"}]}`,
+		"syntax":    `{"exact": [`,
+	}
+	for name, contents := range invalid {
+		file := filepath.Join(dir, name+".json")
+		if err := os.WriteFile(file, []byte(contents), 0644); err != nil {
+			t.Fatalf("Could not write %v: %v\n", file, err)
+		}
+		if _, err := shared.LoadFlagSpec(file); err == nil {
+			t.Errorf("The flags with a bad %v were accepted\n", name)
+		}
+	}
+	if _, err := shared.LoadFlagSpec(filepath.Join(dir, "missing.json")); err == nil {
+		t.Errorf("A missing flags file was accepted\n")
+	}
+}
@@ -0,0 +1,210 @@
+package test
+
+import (
+	"bytes"
+	"debug/elf"
+	"debug/macho"
+	"encoding/binary"
+	"github.com/SRI-CSL/gllvm/shared"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// minimalELF lays out an ELF file with a .text section and a section name table.
+func minimalELF(t *testing.T, class elf.Class, order binary.ByteOrder, fileType elf.Type) []byte {
+	names := "\x00.text\x00.shstrtab\x00"
+	text := "\x90\x90\x90\x90"
+	var ident [elf.EI_NIDENT]byte
+	copy(ident[:], elf.ELFMAG)
+	ident[elf.EI_CLASS] = byte(class)
+	if order == binary.LittleEndian {
+		ident[elf.EI_DATA] = byte(elf.ELFDATA2LSB)
+	} else {
+		ident[elf.EI_DATA] = byte(elf.ELFDATA2MSB)
+	}
+	ident[elf.EI_VERSION] = byte(elf.EV_CURRENT)
+
+	var buf bytes.Buffer
+	var err error
+	if class == elf.ELFCLASS64 {
+		headerSize := binary.Size(elf.Header64{})
+		textOff := uint64(headerSize)
+		namesOff := textOff + uint64(len(text))
+		shoff := (namesOff + uint64(len(names)) + 7) &^ 7
+		err = binary.Write(&buf, order, elf.Header64{Ident: ident, Type: uint16(fileType), Machine: uint16(elf.EM_X86_64),
+			Version: uint32(elf.EV_CURRENT), Shoff: shoff, Ehsize: uint16(headerSize),
+			Shentsize: uint16(binary.Size(elf.Section64{})), Shnum: 3, Shstrndx: 2})
+		buf.WriteString(text)
+		buf.WriteString(names)
+		buf.Write(make([]byte, shoff-uint64(buf.Len())))
+		sections := []elf.Section64{
+			{},
+			{Name: 1, Type: uint32(elf.SHT_PROGBITS), Flags: uint64(elf.SHF_ALLOC | elf.SHF_EXECINSTR), Off: textOff, Size: uint64(len(text)), Addralign: 1},
+			{Name: 7, Type: uint32(elf.SHT_STRTAB), Off: namesOff, Size: uint64(len(names)), Addralign: 1},
+		}
+		for _, s := range sections {
+			if err == nil {
+				err = binary.Write(&buf, order, s)
+			}
+		}
+	} else {
+		headerSize := binary.Size(elf.Header32{})
+		textOff := uint32(headerSize)
+		namesOff := textOff + uint32(len(text))
+		shoff := (namesOff + uint32(len(names)) + 3) &^ 3
+		err = binary.Write(&buf, order, elf.Header32{Ident: ident, Type: uint16(fileType), Machine: uint16(elf.EM_386),
+			Version: uint32(elf.EV_CURRENT), Shoff: shoff, Ehsize: uint16(headerSize),
+			Shentsize: uint16(binary.Size(elf.Section32{})), Shnum: 3, Shstrndx: 2})
+		buf.WriteString(text)
+		buf.WriteString(names)
+		buf.Write(make([]byte, shoff-uint32(buf.Len())))
+		sections := []elf.Section32{
+			{},
+			{Name: 1, Type: uint32(elf.SHT_PROGBITS), Flags: uint32(elf.SHF_ALLOC | elf.SHF_EXECINSTR), Off: textOff, Size: uint32(len(text)), Addralign: 1},
+			{Name: 7, Type: uint32(elf.SHT_STRTAB), Off: namesOff, Size: uint32(len(names)), Addralign: 1},
+		}
+		for _, s := range sections {
+			if err == nil {
+				err = binary.Write(&buf, order, s)
+			}
+		}
+	}
+	if err != nil {
+		t.Fatalf("Could not lay out the ELF file: %v\n", err)
+	}
+	return buf.Bytes()
+}
+
+func checkELFSection(t *testing.T, objFile string, name string, expected string) {
+	elfFile, err := elf.Open(objFile)
+	if err != nil {
+		t.Fatalf("elf.Open(%v) failed after injection: %v\n", objFile, err)
+	}
+	defer elfFile.Close()
+	section := elfFile.Section(name)
+	if section == nil {
+		t.Fatalf("%v has no %v section\n", objFile, name)
+	}
+	contents, err := section.Data()
+	if err != nil || string(contents) != expected {
+		t.Errorf("%v section of %v is %q (err = %v), expected %q\n", name, objFile, contents, err, expected)
+	}
+	text, err := elfFile.Section(".text").Data()
+	if err != nil || string(text) != "\x90\x90\x90\x90" {
+		t.Errorf(".text section of %v is %q (err = %v)\n", objFile, text, err)
+	}
+}
+
+func Test_elf_injection(t *testing.T) {
+	dir := t.TempDir()
+	flavors := []struct {
+		name  string
+		class elf.Class
+		order binary.ByteOrder
+	}{
+		{"elf64le.o", elf.ELFCLASS64, binary.LittleEndian},
+		{"elf64be.o", elf.ELFCLASS64, binary.BigEndian},
+		{"elf32le.o", elf.ELFCLASS32, binary.LittleEndian},
+		{"elf32be.o", elf.ELFCLASS32, binary.BigEndian},
+	}
+	for _, flavor := range flavors {
+		objFile := filepath.Join(dir, flavor.name)
+		if err := os.WriteFile(objFile, minimalELF(t, flavor.class, flavor.order, elf.ET_REL), 0644); err != nil {
+			t.Fatalf("Could not write %v: %v\n", objFile, err)
+		}
+		if err := shared.InjectELFSection(objFile, shared.ELFSectionName, []byte("/tmp/a.bc\n")); err != nil {
+			t.Errorf("InjectELFSection(%v) failed: %v\n", objFile, err)
+			continue
+		}
+		checkELFSection(t, objFile, shared.ELFSectionName, "/tmp/a.bc\n")
+		// a second injection appends to the section, like the linker does.
+		if err := shared.InjectELFSection(objFile, shared.ELFSectionName, []byte("/tmp/b.bc\n")); err != nil {
+			t.Errorf("InjectELFSection(%v) failed the second time: %v\n", objFile, err)
+			continue
+		}
+		checkELFSection(t, objFile, shared.ELFSectionName, "/tmp/a.bc\n/tmp/b.bc\n")
+	}
+
+	exeFile := filepath.Join(dir, "elf64.exe")
+	if err := os.WriteFile(exeFile, minimalELF(t, elf.ELFCLASS64, binary.LittleEndian, elf.ET_EXEC), 0755); err != nil {
+		t.Fatalf("Could not write %v: %v\n", exeFile, err)
+	}
+	if err := shared.InjectELFSection(exeFile, shared.ELFSectionName, []byte("/tmp/a.bc\n")); err == nil {
+		t.Errorf("InjectELFSection(%v) should refuse an executable\n", exeFile)
+	}
+}
+
+func Test_macho_injection(t *testing.T) {
+	dir := t.TempDir()
+	for _, fixture := range []string{"hello_x86_64.o", "hello_arm64.o", "hello_i386.o"} {
+		original := filepath.Join("../data/macho", fixture)
+		contents, err := os.ReadFile(original)
+		if err != nil {
+			t.Fatalf("Could not read %v: %v\n", original, err)
+		}
+		objFile := filepath.Join(dir, fixture)
+		if err = os.WriteFile(objFile, contents, 0644); err != nil {
+			t.Fatalf("Could not write %v: %v\n", objFile, err)
+		}
+		if err = shared.InjectMachOSection(objFile, shared.DarwinSegmentName, shared.DarwinSectionName, []byte("/tmp/a.bc\n")); err != nil {
+			t.Errorf("InjectMachOSection(%v) failed: %v\n", objFile, err)
+			continue
+		}
+		checkMachOInjection(t, original, objFile, "/tmp/a.bc\n")
+		if err = shared.InjectMachOSection(objFile, shared.DarwinSegmentName, shared.DarwinSectionName, []byte("/tmp/b.bc\n")); err == nil {
+			t.Errorf("InjectMachOSection(%v) should refuse to add the section twice\n", objFile)
+		}
+	}
+}
+
+func checkMachOInjection(t *testing.T, original string, objFile string, expected string) {
+	before, err := macho.Open(original)
+	if err != nil {
+		t.Fatalf("macho.Open(%v) failed: %v\n", original, err)
+	}
+	defer before.Close()
+	after, err := macho.Open(objFile)
+	if err != nil {
+		t.Fatalf("macho.Open(%v) failed after injection: %v\n", objFile, err)
+	}
+	defer after.Close()
+
+	section := after.Section(shared.DarwinSectionName)
+	if section == nil || section.Seg != shared.DarwinSegmentName {
+		t.Fatalf("%v has no %v,%v section\n", objFile, shared.DarwinSegmentName, shared.DarwinSectionName)
+	}
+	contents, err := section.Data()
+	if err != nil || string(contents) != expected {
+		t.Errorf("%v section of %v is %q (err = %v), expected %q\n", shared.DarwinSectionName, objFile, contents, err, expected)
+	}
+	if len(after.Sections) != len(before.Sections)+1 || after.Sections[len(before.Sections)] != section {
+		t.Errorf("%v should have gained exactly one section, at the end\n", objFile)
+	}
+	// the existing sections, their relocations, and the symbols must be unharmed.
+	for i, old := range before.Sections {
+		moved := after.Sections[i]
+		if old.Name != moved.Name || old.Addr != moved.Addr || old.Size != moved.Size || len(old.Relocs) != len(moved.Relocs) {
+			t.Errorf("Section %v of %v changed\n", old.Name, objFile)
+			continue
+		}
+		for j := range old.Relocs {
+			if old.Relocs[j] != moved.Relocs[j] {
+				t.Errorf("Relocation %v of section %v of %v changed\n", j, old.Name, objFile)
+			}
+		}
+		oldData, _ := old.Data()
+		movedData, _ := moved.Data()
+		if !bytes.Equal(oldData, movedData) {
+			t.Errorf("Contents of section %v of %v changed\n", old.Name, objFile)
+		}
+	}
+	if before.Symtab == nil || after.Symtab == nil || len(before.Symtab.Syms) != len(after.Symtab.Syms) {
+		t.Fatalf("Symbol table of %v changed\n", objFile)
+	}
+	for i := range before.Symtab.Syms {
+		if before.Symtab.Syms[i] != after.Symtab.Syms[i] {
+			t.Errorf("Symbol %v of %v changed: %v\n", i, objFile, after.Symtab.Syms[i])
+		}
+	}
+}
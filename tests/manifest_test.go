@@ -0,0 +1,121 @@
+package test
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"github.com/SRI-CSL/gllvm/shared"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"testing"
+)
+
+func Test_structured_manifest(t *testing.T) {
+	dir := t.TempDir()
+	store := t.TempDir()
+	defer restoreEnvironment([]string{"WLLVM_BC_STORE"})()
+
+	first := filepath.Join(dir, "first", ".a.o.bc")
+	second := filepath.Join(dir, "second", ".a.o.bc")
+	stored := filepath.Join(dir, ".stored.o.bc")
+	missing := filepath.Join(dir, ".missing.o.bc")
+	for _, bcFile := range []string{first, second, stored} {
+		if err := os.MkdirAll(filepath.Dir(bcFile), 0755); err != nil {
+			t.Fatalf("Could not create the directory of %v: %v\n", bcFile, err)
+		}
+		assemble(t, "define i32 @f"+strconv.Itoa(len(bcFile))+"() {\n  ret i32 0\n}\n", bcFile)
+	}
+	hashes := make(map[string]string)
+	sizes := make(map[string]int64)
+	for _, bcFile := range []string{first, second, stored} {
+		hash, err := shared.BitcodeHash(bcFile)
+		if err != nil {
+			t.Fatalf("BitcodeHash(%v) failed: %v\n", bcFile, err)
+		}
+		info, _ := os.Stat(bcFile)
+		hashes[bcFile], sizes[bcFile] = hash, info.Size()
+	}
+	// the bitcode of stored.o is only left in the store
+	if _, err := shared.StoreBitcodeFile(store, stored); err != nil {
+		t.Fatalf("StoreBitcodeFile(%v) failed: %v\n", stored, err)
+	}
+	if err := os.Remove(stored); err != nil {
+		t.Fatalf("Could not remove %v: %v\n", stored, err)
+	}
+	os.Setenv("WLLVM_BC_STORE", store)
+	shared.FetchEnvironment()
+
+	var entries []arEntry
+	for _, object := range []struct{ name, bcFile string }{
+		{"a.o", first}, {"a.o", second}, {"stored.o", stored}, {"missing.o", missing},
+	} {
+		contents, err := os.ReadFile(objectWithRecord(t, dir, object.name, object.bcFile))
+		if err != nil {
+			t.Fatalf("Could not read %v: %v\n", object.name, err)
+		}
+		entries = append(entries, arEntry{arHeader(object.name+"/", len(contents)), string(contents)})
+	}
+	archive := filepath.Join(dir, "libman.a")
+	writeArchive(t, archive, "!<arch>\n", entries)
+
+	output := filepath.Join(dir, "libman.bc")
+	args := []string{"get-bc", "-b", "-manifest-format", "json,csv", "-o", output, archive}
+	if exitCode := shared.Extract(args); exitCode != 0 {
+		t.Fatalf("Extraction of %v returned %v\n", args, exitCode)
+	}
+	if _, err := os.Stat(output + ".llvm.manifest"); err == nil {
+		t.Errorf("Only the json and csv manifests were asked for\n")
+	}
+
+	storeCopy := shared.StoreObjectPath(store, hashes[stored])
+	expected := []shared.ManifestEntry{
+		{Artifact: first, Physical: first, Object: archive, Member: "a.o", Instance: 1, Hash: hashes[first], Size: sizes[first], Origin: "recorded"},
+		{Artifact: second, Physical: second, Object: archive, Member: "a.o", Instance: 2, Hash: hashes[second], Size: sizes[second], Origin: "recorded"},
+		{Artifact: stored, Physical: storeCopy, Object: archive, Member: "stored.o", Instance: 1, Hash: hashes[stored], Size: sizes[stored], Origin: "store"},
+		{Artifact: missing, Object: archive, Member: "missing.o", Instance: 1, Origin: "missing"},
+	}
+
+	contents, err := os.ReadFile(output + ".llvm.manifest.json")
+	if err != nil {
+		t.Fatalf("Could not read the JSON manifest: %v\n", err)
+	}
+	var manifest shared.Manifest
+	if err = json.Unmarshal(contents, &manifest); err != nil {
+		t.Fatalf("The manifest is not JSON: %v\n%s\n", err, contents)
+	}
+	if manifest.Input != archive || manifest.Output != output {
+		t.Errorf("The manifest is of %v into %v, expected %v into %v\n", manifest.Input, manifest.Output, archive, output)
+	}
+	if !reflect.DeepEqual(manifest.Entries, expected) {
+		t.Errorf("The manifest entries are\n%+v\nexpected\n%+v\n", manifest.Entries, expected)
+	}
+
+	file, err := os.Open(output + ".llvm.manifest.csv")
+	if err != nil {
+		t.Fatalf("Could not open the CSV manifest: %v\n", err)
+	}
+	defer file.Close()
+	rows, err := csv.NewReader(file).ReadAll()
+	if err != nil {
+		t.Fatalf("The manifest is not CSV: %v\n", err)
+	}
+	if len(rows) != len(expected)+1 {
+		t.Fatalf("The CSV manifest has %v rows, expected %v\n", len(rows), len(expected)+1)
+	}
+	if header := []string{"artifact", "physical", "object", "member", "instance", "hash", "size", "origin"}; !reflect.DeepEqual(rows[0], header) {
+		t.Errorf("The CSV header is %v, expected %v\n", rows[0], header)
+	}
+	for i, entry := range expected {
+		row := []string{entry.Artifact, entry.Physical, entry.Object, entry.Member, strconv.Itoa(entry.Instance),
+			entry.Hash, strconv.FormatInt(entry.Size, 10), entry.Origin}
+		if !reflect.DeepEqual(rows[i+1], row) {
+			t.Errorf("CSV row %v is %v, expected %v\n", i+1, rows[i+1], row)
+		}
+	}
+
+	args = []string{"get-bc", "-manifest-format", "yaml", "-o", output, archive}
+	if exitCode := shared.Extract(args); exitCode == 0 {
+		t.Errorf("Extraction of %v should reject the unknown format\n", args)
+	}
+}
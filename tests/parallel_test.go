@@ -0,0 +1,69 @@
+package test
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/SRI-CSL/gllvm/shared"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+func Test_parallel_extraction(t *testing.T) {
+	dir := t.TempDir()
+	var entries []arEntry
+	var functions []string
+	for i := 0; i < 40; i++ {
+		name := fmt.Sprintf("f%02d", i)
+		bcFile := filepath.Join(dir, "."+name+".o.bc")
+		assemble(t, "define i32 @"+name+"() {\n  ret i32 "+strconv.Itoa(i)+"\n}\n", bcFile)
+		contents, err := os.ReadFile(objectWithRecord(t, dir, name+".o", bcFile))
+		if err != nil {
+			t.Fatalf("Could not read %v.o: %v\n", name, err)
+		}
+		entries = append(entries, arEntry{arHeader(name+".o/", len(contents)), string(contents)})
+		functions = append(functions, name)
+	}
+	archive := filepath.Join(dir, "libmany.a")
+	writeArchive(t, archive, "!<arch>\n", entries)
+
+	extract := func(jobs string, argMax string, output string) (module []byte, manifest []byte) {
+		args := []string{"get-bc", "-b", "-j", jobs, "-n", argMax, "-manifest-format", "json", "-o", output, archive}
+		if exitCode := shared.Extract(args); exitCode != 0 {
+			t.Fatalf("Extraction of %v returned %v\n", args, exitCode)
+		}
+		module, err := os.ReadFile(output)
+		if err != nil {
+			t.Fatalf("Could not read %v: %v\n", output, err)
+		}
+		if manifest, err = os.ReadFile(output + ".llvm.manifest.json"); err != nil {
+			t.Fatalf("Could not read the manifest of %v: %v\n", output, err)
+		}
+		return module, bytes.Replace(manifest, []byte(output), nil, -1)
+	}
+
+	sequential := filepath.Join(dir, "sequential.bc")
+	_, sequentialManifest := extract("1", "0", sequential)
+	checkModuleDefines(t, sequential, functions, nil)
+
+	// a small command line makes for several rounds of linking
+	for _, argMax := range []string{"0", "100"} {
+		first := filepath.Join(dir, "first"+argMax+".bc")
+		second := filepath.Join(dir, "second"+argMax+".bc")
+		firstModule, firstManifest := extract("8", argMax, first)
+		checkModuleDefines(t, first, functions, nil)
+		for i := 0; i < 3; i++ {
+			secondModule, secondManifest := extract("8", argMax, second)
+			if !bytes.Equal(firstModule, secondModule) {
+				t.Errorf("Parallel extraction with -n %v is not deterministic\n", argMax)
+			}
+			if !bytes.Equal(firstManifest, secondManifest) {
+				t.Errorf("The manifest of the parallel extraction with -n %v is not deterministic\n", argMax)
+			}
+		}
+		if !bytes.Equal(firstManifest, sequentialManifest) {
+			t.Errorf("The manifests of the sequential and parallel extractions differ:\n%s\n%s\n", sequentialManifest, firstManifest)
+		}
+	}
+}
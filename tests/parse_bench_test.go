@@ -0,0 +1,135 @@
+package test
+
+import (
+	"fmt"
+	"github.com/SRI-CSL/gllvm/shared"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// a compilation of the linux kernel, as in examples/linux-kernel
+const kernelCommand = `-Wp,-MMD,fs/ext4/.inode.o.d -nostdinc -isystem /usr/lib/llvm-14/lib/clang/14.0.6/include
+-I./arch/x86/include -I./arch/x86/include/generated -I./include -I./arch/x86/include/uapi
+-I./arch/x86/include/generated/uapi -I./include/uapi -I./include/generated/uapi
+-include ./include/linux/compiler-version.h -include ./include/linux/kconfig.h
+-include ./include/linux/compiler_types.h -D__KERNEL__ -Qunused-arguments -fmacro-prefix-map=./=
+-Wall -Wundef -Werror=strict-prototypes -Wno-trigraphs -fno-strict-aliasing -fno-common -fshort-wchar
+-fno-PIE -Werror=implicit-function-declaration -Werror=implicit-int -Werror=return-type
+-Wno-format-security -std=gnu89 -no-integrated-as -Werror=unknown-warning-option -mno-sse -mno-mmx
+-mno-sse2 -mno-3dnow -mno-avx -m64 -mno-80387 -mstack-alignment=8 -mtune=generic -mno-red-zone
+-mcmodel=kernel -DCONFIG_X86_X32_ABI -Wno-sign-compare -fno-asynchronous-unwind-tables
+-mretpoline-external-thunk -fno-delete-null-pointer-checks -Wno-frame-address
+-Wno-address-of-packed-member -O2 -Wframe-larger-than=2048 -fstack-protector-strong
+-Wno-format-invalid-specifier -Wno-gnu -mno-global-merge -Wno-unused-const-variable
+-fno-omit-frame-pointer -fno-optimize-sibling-calls -g -gdwarf-4 -pg -mfentry -DCC_USING_FENTRY
+-Wdeclaration-after-statement -Wvla -Wno-pointer-sign -Wno-array-bounds -fno-strict-overflow
+-fno-stack-check -Werror=date-time -Werror=incompatible-pointer-types -Wno-initializer-overrides
+-Wno-format -Wno-sign-compare -Wno-format-zero-length -Wno-pointer-to-enum-cast
+-Wno-tautological-constant-out-of-range-compare -DKBUILD_MODFILE="fs/ext4/ext4"
+-DKBUILD_BASENAME="inode" -DKBUILD_MODNAME="ext4" -D__KBUILD_MODNAME=kmod_ext4
+-c -o fs/ext4/inode.o fs/ext4/inode.c`
+
+// a compilation of nodejs, as in examples/nodejs
+const nodejsCommand = `-DV8_DEPRECATION_WARNINGS -DV8_IMMINENT_DEPRECATION_WARNINGS -D__POSIX__ -DNODE_HAVE_I18N_SUPPORT=1
+-DNODE_ARCH="x64" -DNODE_PLATFORM="linux" -DNODE_WANT_INTERNALS=1 -DHAVE_OPENSSL=1 -DHAVE_INSPECTOR=1
+-D_LARGEFILE_SOURCE -D_FILE_OFFSET_BITS=64 -DNODE_USE_V8_PLATFORM=1 -DUCONFIG_NO_SERVICE=1
+-DU_ENABLE_DYLOAD=0 -DU_STATIC_IMPLEMENTATION=1 -DU_HAVE_STD_STRING=1 -DUCONFIG_NO_BREAK_ITERATION=0
+-I../src -I../deps/v8/include -I../deps/uv/include -I../deps/icu-small/source/i18n
+-I../deps/icu-small/source/common -I../deps/zlib -I../deps/http_parser -I../deps/cares/include
+-I../deps/nghttp2/lib/includes -I../deps/brotli/c/include -I../deps/openssl/openssl/include
+-I../deps/openssl/config -I../deps/openssl/config/archs/linux-x86_64/no-asm/include
+-I../deps/openssl/openssl/crypto/include -I../deps/llhttp/include -pthread -Wall -Wextra
+-Wno-unused-parameter -m64 -O3 -fno-omit-frame-pointer -fno-rtti -fno-exceptions -std=gnu++1y
+-MMD -MF ./Release/.deps/Release/obj.target/node_lib/src/node.o.d.raw -c
+-o Release/obj.target/node_lib/src/node.o ../src/node.cc`
+
+// the link of nodejs, with its archives in a group
+const nodejsLink = `-pthread -rdynamic -m64 -Wl,-z,noexecstack -Wl,-z,relro -Wl,-z,now
+-Wl,--whole-archive Release/obj.target/libnode.a -Wl,--no-whole-archive
+-Wl,--whole-archive Release/obj.target/deps/v8/gypfiles/libv8_base.a -Wl,--no-whole-archive
+-o Release/node -Wl,--start-group Release/obj.target/node/src/node_main.o
+Release/obj.target/deps/zlib/libzlib.a Release/obj.target/deps/uv/libuv.a
+Release/obj.target/deps/http_parser/libhttp_parser.a Release/obj.target/deps/cares/libcares.a
+Release/obj.target/deps/nghttp2/libnghttp2.a Release/obj.target/deps/brotli/libbrotli.a
+Release/obj.target/deps/openssl/libopenssl.a -ldl -lrt -lm -Wl,--end-group`
+
+// a chromium style compilation, with hundreds of include directories and macros
+func chromiumCommand() string {
+	var command strings.Builder
+	command.WriteString("-MMD -MF obj/content/browser/browser/render_frame_host_impl.o.d ")
+	for i := 0; i < 150; i++ {
+		fmt.Fprintf(&command, "-DFEATURE_%d=1 -I../../third_party/library%d/include ", i, i)
+	}
+	for i := 0; i < 40; i++ {
+		fmt.Fprintf(&command, "-isystem ../../build/linux/debian_sid_amd64-sysroot/usr/include/package%d ", i)
+	}
+	command.WriteString("-fno-delete-null-pointer-checks -fno-ident -fno-strict-aliasing -fstack-protector " +
+		"-funwind-tables -fPIC -pthread -fcolor-diagnostics -fmerge-all-constants -fcrash-diagnostics-dir=../../tools/clang/crashreports " +
+		"-mllvm -instcombine-lower-dbg-declare=0 -ffp-contract=off -m64 -msse3 -Wall -Werror -Wextra -Wimplicit-fallthrough " +
+		"-Wthread-safety -Wno-missing-field-initializers -Wno-unused-parameter -O2 -fdata-sections -ffunction-sections " +
+		"-fno-omit-frame-pointer -g0 -fvisibility=hidden -Xclang -add-plugin -Xclang find-bad-constructs " +
+		"-Wexit-time-destructors -std=c++17 -fno-trigraphs -Wno-trigraphs -fno-exceptions -fno-rtti -nostdinc++ " +
+		"-isystem../../buildtools/third_party/libc++/trunk/include --sysroot=../../build/linux/debian_sid_amd64-sysroot " +
+		"-fvisibility-inlines-hidden -c ../../content/browser/renderer_host/render_frame_host_impl.cc " +
+		"-o obj/content/browser/browser/render_frame_host_impl.o")
+	return command.String()
+}
+
+func benchmarkParse(b *testing.B, command string) {
+	args := strings.Fields(command)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		shared.Parse(args)
+	}
+}
+
+func Benchmark_parse_linux_kernel(b *testing.B) {
+	benchmarkParse(b, kernelCommand)
+}
+
+func Benchmark_parse_chromium(b *testing.B) {
+	benchmarkParse(b, chromiumCommand())
+}
+
+func Benchmark_parse_nodejs(b *testing.B) {
+	benchmarkParse(b, nodejsCommand)
+}
+
+func Benchmark_parse_nodejs_link(b *testing.B) {
+	benchmarkParse(b, nodejsLink)
+}
+
+func Test_parse_command_lines(t *testing.T) {
+	kernel := shared.Parse(strings.Fields(kernelCommand))
+	if !kernel.IsCompileOnly || kernel.OutputFilename != "fs/ext4/inode.o" || len(kernel.InputFiles) != 1 || !reflect.DeepEqual(kernel.LinkArgs, []string{"-m64"}) {
+		t.Errorf("The kernel command line was not parsed right: %v %v %v\n", kernel.OutputFilename, kernel.InputFiles, kernel.LinkArgs)
+	}
+	chromium := shared.Parse(strings.Fields(chromiumCommand()))
+	// -pthread, -m64 and --sysroot= also go to the linker
+	if !chromium.IsCompileOnly || len(chromium.InputFiles) != 1 || len(chromium.LinkArgs) != 3 {
+		t.Errorf("The chromium command line was not parsed right: %v %v\n", chromium.InputFiles, chromium.LinkArgs)
+	}
+	link := shared.Parse(strings.Fields(nodejsLink))
+	if link.OutputFilename != "Release/node" || len(link.InputFiles) != 0 || len(link.ObjectFiles) != 2 {
+		t.Errorf("The nodejs link was not parsed right: %v %v %v\n", link.OutputFilename, link.InputFiles, link.ObjectFiles)
+	}
+
+	// patterns that are not anchored at the start are still tried, and in order
+	dir := t.TempDir()
+	defer restoreEnvironment([]string{"GLLVM_FLAGS_FILE"})()
+	file := filepath.Join(dir, "unanchored.json")
+	contents := `{"patterns": [{"pattern": "link-me$", "arity": 0, "action": "link"}, {"pattern": "^-flink-.*$", "arity": 0, "action": "compileLink"}]}`
+	if err := os.WriteFile(file, []byte(contents), 0644); err != nil {
+		t.Fatalf("Could not write %v: %v\n", file, err)
+	}
+	os.Setenv("GLLVM_FLAGS_FILE", file)
+	shared.FetchEnvironment()
+	pr := shared.Parse([]string{"-flink-me", "-flink-you", "-fother"})
+	if !reflect.DeepEqual(pr.LinkArgs, []string{"-flink-me", "-flink-you"}) || !reflect.DeepEqual(pr.CompileArgs, []string{"-flink-you", "-fother"}) {
+		t.Errorf("The user's patterns were not matched in order: %v %v\n", pr.LinkArgs, pr.CompileArgs)
+	}
+}
@@ -2,6 +2,7 @@ package test
 
 import (
 	"github.com/SRI-CSL/gllvm/shared"
+	"reflect"
 	"strings"
 	"testing"
 )
@@ -39,3 +40,50 @@ func Test_parsing(t *testing.T) {
 	pl(input2, t, 32)
 	pl(input3, t, 5)
 }
+
+func Test_input_languages(t *testing.T) {
+	type parse struct {
+		inputs     []string
+		languages  []string
+		objects    []string
+		isAssembly bool
+	}
+	commands := []struct {
+		args     []string
+		expected parse
+	}{
+		// the extension decides, without -x
+		{[]string{"-c", "foo.c", "bar.s"}, parse{[]string{"foo.c", "bar.s"}, []string{"", ""}, nil, true}},
+		{[]string{"-c", "-x", "c", "foo.inc"}, parse{[]string{"foo.inc"}, []string{"c"}, nil, false}},
+		{[]string{"-c", "-xc", "foo.s"}, parse{[]string{"foo.s"}, []string{"c"}, nil, false}},
+		{[]string{"-c", "-x", "assembler-with-cpp", "foo.asm"}, parse{[]string{"foo.asm"}, []string{"assembler-with-cpp"}, nil, true}},
+		{[]string{"-c", "-x", "assembler", "foo.c"}, parse{[]string{"foo.c"}, []string{"assembler"}, nil, true}},
+		// the language holds for all the inputs that follow, until -x none
+		{[]string{"-x", "c++", "foo.inc", "-O2", "bar.o", "-x", "none", "baz.c", "qux.o"},
+			parse{[]string{"foo.inc", "bar.o", "baz.c"}, []string{"c++", "c++", ""}, []string{"qux.o"}, false}},
+		// the argument of a flag is not an input
+		{[]string{"-x", "c", "-o", "foo.o", "-I", "include", "-c", "foo.inc"}, parse{[]string{"foo.inc"}, []string{"c"}, nil, false}},
+		// nor is a header, which has no object to record the bitcode in
+		{[]string{"-x", "c-header", "foo.h", "-o", "foo.pch"}, parse{nil, nil, nil, false}},
+	}
+	for _, command := range commands {
+		pr := shared.Parse(command.args)
+		parsed := parse{pr.InputFiles, pr.InputLanguages, pr.ObjectFiles, pr.IsAssembly}
+		if !reflect.DeepEqual(parsed, command.expected) {
+			t.Errorf("The parse of %v is %+v, expected %+v\n", command.args, parsed, command.expected)
+		}
+	}
+
+	pr := shared.Parse([]string{"-c", "-x", "c", "foo.inc"})
+	if pr.SkipBitcodeGeneration() {
+		t.Errorf("A C input with an unknown extension should have bitcode\n")
+	}
+	pr = shared.Parse([]string{"-c", "-x", "assembler-with-cpp", "foo.asm"})
+	if !pr.SkipBitcodeGeneration() {
+		t.Errorf("An assembly input should not have bitcode\n")
+	}
+	pr = shared.Parse([]string{"-x", "c-header", "foo.h", "-o", "foo.pch"})
+	if !pr.SkipBitcodeGeneration() {
+		t.Errorf("A precompiled header should not have bitcode\n")
+	}
+}
@@ -0,0 +1,45 @@
+package test
+
+import (
+	"github.com/SRI-CSL/gllvm/shared"
+	"reflect"
+	"testing"
+)
+
+func Test_bitcode_records(t *testing.T) {
+	record := shared.BitcodeRecord{
+		Path:     "/tmp/.foo.c.o.bc",
+		Hash:     "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855",
+		Source:   "/tmp/foo.c",
+		Compiler: "clang",
+		Flags:    []string{"-O2", "-g"},
+		Version:  shared.BitcodeRecordVersion,
+	}
+	encoded, err := shared.EncodeBitcodeRecord(record)
+	if err != nil {
+		t.Fatalf("EncodeBitcodeRecord failed: %v\n", err)
+	}
+
+	// what the linker makes of objects built by old and new versions of gllvm
+	var section []byte
+	section = append(section, "/tmp/.old.c.o.bc\n"...)
+	section = append(section, encoded...)
+	section = append(section, 0, 0, 0)
+	section = append(section, encoded...)
+	section = append(section, "/tmp/.older.c.o.bc\n"...)
+	records, err := shared.DecodeBitcodeRecords(section)
+	if err != nil {
+		t.Fatalf("DecodeBitcodeRecords failed: %v\n", err)
+	}
+	expected := []shared.BitcodeRecord{{Path: "/tmp/.old.c.o.bc"}, record, record, {Path: "/tmp/.older.c.o.bc"}}
+	if !reflect.DeepEqual(records, expected) {
+		t.Errorf("DecodeBitcodeRecords returned %v, expected %v\n", records, expected)
+	}
+
+	if _, err = shared.DecodeBitcodeRecords(encoded[:len(encoded)-1]); err == nil {
+		t.Errorf("DecodeBitcodeRecords should reject a truncated record\n")
+	}
+	if records, err = shared.DecodeBitcodeRecords(nil); err != nil || len(records) != 0 {
+		t.Errorf("DecodeBitcodeRecords of an empty section returned %v, %v\n", records, err)
+	}
+}
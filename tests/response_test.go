@@ -0,0 +1,117 @@
+package test
+
+import (
+	"fmt"
+	"github.com/SRI-CSL/gllvm/shared"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func Test_parse_response_files(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.Mkdir(filepath.Join(dir, "nested"), 0755); err != nil {
+		t.Fatalf("Could not create the nested directory: %v\n", err)
+	}
+	rspFile := filepath.Join(dir, "args.rsp")
+	// the nested response file is relative to the one naming it
+	rspContents := "-c \"my file.c\"\n-o 'my file.o' @nested/more.rsp\n"
+	moreContents := `-DQUOTED=\"yes\" -I'include dir'` + "\n"
+	if err := os.WriteFile(rspFile, []byte(rspContents), 0644); err != nil {
+		t.Fatalf("Could not write %v: %v\n", rspFile, err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "nested", "more.rsp"), []byte(moreContents), 0644); err != nil {
+		t.Fatalf("Could not write the nested response file: %v\n", err)
+	}
+
+	args := []string{"-O2", "@" + rspFile, "@" + filepath.Join(dir, "missing.rsp")}
+	parsed := shared.Parse(args)
+	if !reflect.DeepEqual(parsed.InputList, args) {
+		t.Errorf("The input list %v should be the arguments as given, %v\n", parsed.InputList, args)
+	}
+	if !reflect.DeepEqual(parsed.InputFiles, []string{"my file.c"}) {
+		t.Errorf("The input files are %v, expected [my file.c]\n", parsed.InputFiles)
+	}
+	if parsed.OutputFilename != "my file.o" || !parsed.IsCompileOnly {
+		t.Errorf("The response file was not expanded: %v\n", &parsed)
+	}
+	for _, arg := range []string{"-DQUOTED=\"yes\"", "-Iinclude dir", "@" + filepath.Join(dir, "missing.rsp")} {
+		found := false
+		for _, compileArg := range parsed.CompileArgs {
+			found = found || compileArg == arg
+		}
+		if !found {
+			t.Errorf("The compile arguments %v lack %q\n", parsed.CompileArgs, arg)
+		}
+	}
+
+	// a response file naming itself does not go on forever
+	loop := filepath.Join(dir, "loop.rsp")
+	if err := os.WriteFile(loop, []byte("-g @loop.rsp\n"), 0644); err != nil {
+		t.Fatalf("Could not write %v: %v\n", loop, err)
+	}
+	shared.Parse([]string{"@" + loop})
+}
+
+func Test_response_file_linking(t *testing.T) {
+	dir := t.TempDir()
+	var entries []arEntry
+	var functions []string
+	for i := 0; i < 12; i++ {
+		name := fmt.Sprintf("g%02d", i)
+		bcFile := filepath.Join(dir, "."+name+".o.bc")
+		assemble(t, "define i32 @"+name+"() {\n  ret i32 0\n}\n", bcFile)
+		contents, err := os.ReadFile(objectWithRecord(t, dir, name+".o", bcFile))
+		if err != nil {
+			t.Fatalf("Could not read %v.o: %v\n", name, err)
+		}
+		entries = append(entries, arEntry{arHeader(name+".o/", len(contents)), string(contents)})
+		functions = append(functions, name)
+	}
+	archive := filepath.Join(dir, "librsp.a")
+	writeArchive(t, archive, "!<arch>\n", entries)
+
+	// the command line is always too long, so the files go through a response file
+	module := filepath.Join(dir, "module.bc")
+	args := []string{"get-bc", "-b", "-n", "20", "-o", module, archive}
+	if exitCode := shared.Extract(args); exitCode != 0 {
+		t.Fatalf("Extraction of %v returned %v\n", args, exitCode)
+	}
+	checkModuleDefines(t, module, functions, nil)
+
+	bcArchive := filepath.Join(dir, "bitcode.a")
+	args = []string{"get-bc", "-n", "20", "-o", bcArchive, archive}
+	if exitCode := shared.Extract(args); exitCode != 0 {
+		t.Fatalf("Extraction of %v returned %v\n", args, exitCode)
+	}
+	out, err := exec.Command("llvm-ar", "t", bcArchive).CombinedOutput()
+	if err != nil {
+		t.Fatalf("llvm-ar t %v failed: %v %s\n", bcArchive, err, out)
+	}
+	members := strings.Fields(string(out))
+	sort.Strings(members)
+	var expected []string
+	for _, name := range functions {
+		expected = append(expected, "."+name+".o.bc")
+	}
+	if !reflect.DeepEqual(members, expected) {
+		t.Errorf("The bitcode archive has %v, expected %v\n", members, expected)
+	}
+
+	// a linker that does not understand response files gets the files a chunk at a time
+	linker := filepath.Join(dir, "no-rsp-link")
+	script := "#!/bin/sh\nfor arg in \"$@\"; do case \"$arg\" in @*) exit 1;; esac; done\nexec llvm-link \"$@\"\n"
+	if err = os.WriteFile(linker, []byte(script), 0755); err != nil {
+		t.Fatalf("Could not write %v: %v\n", linker, err)
+	}
+	fallback := filepath.Join(dir, "fallback.bc")
+	args = []string{"get-bc", "-b", "-n", "20", "-l", linker, "-o", fallback, archive}
+	if exitCode := shared.Extract(args); exitCode != 0 {
+		t.Fatalf("Extraction of %v returned %v\n", args, exitCode)
+	}
+	checkModuleDefines(t, fallback, functions, nil)
+}
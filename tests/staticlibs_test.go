@@ -0,0 +1,92 @@
+package test
+
+import (
+	"github.com/SRI-CSL/gllvm/shared"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
+
+func Test_static_library_extraction(t *testing.T) {
+	if _, err := exec.LookPath("gcc"); err != nil {
+		t.Skip("gcc is not installed")
+	}
+	dir := t.TempDir()
+
+	fooObj := compileWithBitcode(t, dir, "foo", "int foo(void) { return 0; }\n",
+		"define i32 @foo() {\n  ret i32 0\n}\n")
+	mainObj := compileWithBitcode(t, dir, "main", "int foo(void);\nint main(void) { return foo(); }\n",
+		"declare i32 @foo()\n\ndefine i32 @main() {\n  %r = call i32 @foo()\n  ret i32 %r\n}\n")
+	// an object from some other toolchain
+	barFile := filepath.Join(dir, "bar.c")
+	barObj := filepath.Join(dir, "bar.o")
+	if err := os.WriteFile(barFile, []byte("int bar(void) { return 1; }\n"), 0644); err != nil {
+		t.Fatalf("Could not write %v: %v\n", barFile, err)
+	}
+	if out, err := exec.Command("gcc", "-c", barFile, "-o", barObj).CombinedOutput(); err != nil {
+		t.Fatalf("gcc failed: %v %s\n", err, out)
+	}
+
+	libDir := filepath.Join(dir, "lib")
+	if err := os.Mkdir(libDir, 0755); err != nil {
+		t.Fatalf("Could not create %v: %v\n", libDir, err)
+	}
+	archive := filepath.Join(libDir, "libfoo.a")
+	if out, err := exec.Command("ar", "rcs", archive, fooObj, barObj).CombinedOutput(); err != nil {
+		t.Fatalf("ar failed: %v %s\n", err, out)
+	}
+	program := filepath.Join(dir, "prog")
+	if out, err := exec.Command("gcc", mainObj, "-L", libDir, "-lfoo", "-o", program).CombinedOutput(); err != nil {
+		t.Fatalf("gcc failed to link %v: %v %s\n", program, err, out)
+	}
+
+	// the bitcode of foo is in the program already, and does not get linked in twice
+	output := filepath.Join(dir, "prog.bc")
+	args := []string{"get-bc", "-L", libDir, "-lib", "foo", "-o", output, program}
+	if exitCode := shared.Extract(args); exitCode != 0 {
+		t.Fatalf("Extraction of %v returned %v\n", args, exitCode)
+	}
+	checkModuleDefines(t, output, []string{"main", "foo"}, nil)
+
+	// the linker may have dropped the section, as --gc-sections can
+	if out, err := exec.Command("objcopy", "--remove-section", shared.ELFSectionName, program).CombinedOutput(); err != nil {
+		t.Fatalf("objcopy failed: %v %s\n", err, out)
+	}
+	if exitCode := shared.Extract(args); exitCode != 0 {
+		t.Fatalf("Extraction of %v returned %v\n", args, exitCode)
+	}
+	checkModuleDefines(t, output, []string{"foo"}, []string{"main"})
+
+	// bar.o has no bitcode
+	strict := []string{"get-bc", "-S", "-L", libDir, "-lib", "foo", "-o", output, program}
+	if exitCode := shared.Extract(strict); exitCode == 0 {
+		t.Errorf("Extraction of %v should fail, bar.o has no bitcode\n", strict)
+	}
+
+	// the link in the build log names the archive
+	buildLog := t.TempDir()
+	record := shared.BuildRecord{Kind: "link", Directory: dir, Output: program, Objects: []string{mainObj, archive}}
+	if err := shared.WriteBuildRecord(buildLog, record); err != nil {
+		t.Fatalf("WriteBuildRecord failed: %v\n", err)
+	}
+	args = []string{"get-bc", "-log", buildLog, "-o", output, program}
+	if exitCode := shared.Extract(args); exitCode != 0 {
+		t.Fatalf("Extraction of %v returned %v\n", args, exitCode)
+	}
+	checkModuleDefines(t, output, []string{"foo"}, []string{"main"})
+
+	// but not the link of some other binary
+	args = []string{"get-bc", "-log", buildLog, "-o", output, mainObj}
+	if exitCode := shared.Extract(args); exitCode != 0 {
+		t.Errorf("Extraction of the object %v returned %v\n", mainObj, exitCode)
+	}
+	other := filepath.Join(dir, "other")
+	if out, err := exec.Command("cp", program, other).CombinedOutput(); err != nil {
+		t.Fatalf("cp failed: %v %s\n", err, out)
+	}
+	args = []string{"get-bc", "-log", buildLog, "-o", output, other}
+	if exitCode := shared.Extract(args); exitCode == 0 {
+		t.Errorf("Extraction of %v should fail, its link is not in the build log\n", args)
+	}
+}
@@ -0,0 +1,128 @@
+package test
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"github.com/SRI-CSL/gllvm/shared"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// checkStoreIntegrity checks that every entry of the store is named by its hash, and that
+// every index entry leads to one.
+func checkStoreIntegrity(t *testing.T, store string) {
+	entries, err := shared.ReadStore(store)
+	if err != nil {
+		t.Fatalf("ReadStore(%v) failed: %v\n", store, err)
+	}
+	stored := make(map[string]bool)
+	for _, entry := range entries {
+		hash, err := shared.BitcodeHash(entry.File)
+		if err != nil || hash != entry.Hash {
+			t.Errorf("The store entry %v has the hash %v (err = %v)\n", entry.File, hash, err)
+		}
+		stored[entry.File] = true
+	}
+	indexFiles, _ := filepath.Glob(filepath.Join(store, "index", "*", "*"))
+	for _, indexFile := range indexFiles {
+		contents, err := os.ReadFile(indexFile)
+		fields := strings.Fields(string(contents))
+		if err != nil || len(fields) != 2 || !stored[shared.StoreObjectPath(store, fields[0])] {
+			t.Errorf("The index entry %v is %q (err = %v)\n", indexFile, contents, err)
+		}
+	}
+	leftovers, _ := filepath.Glob(filepath.Join(store, "*", "*", ".gllvm-tmp-*"))
+	if len(leftovers) != 0 {
+		t.Errorf("The store has leftover temporary files %v\n", leftovers)
+	}
+}
+
+func Test_store_stress(t *testing.T) {
+	defer restoreEnvironment([]string{"GLLVM_STORE_LOCK"})()
+	for _, locking := range []string{"", "1"} {
+		os.Setenv("GLLVM_STORE_LOCK", locking)
+		shared.FetchEnvironment()
+		dir := t.TempDir()
+		store := t.TempDir()
+		contents := make(map[string]bool)
+		for k := 0; k < 3; k++ {
+			sum := sha256.Sum256([]byte(strings.Repeat(fmt.Sprintf("bitcode %d ", k), 10000)))
+			contents[hex.EncodeToString(sum[:])] = true
+		}
+		var wg sync.WaitGroup
+		for i := 0; i < 32; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				// everyone rebuilds the same few paths, with a few different contents, so the
+				// writers fight over both the objects and the index entries of those paths
+				bcFile := filepath.Join(dir, fmt.Sprintf(".foo%d.o.bc", i%4))
+				bitcode := []byte(strings.Repeat(fmt.Sprintf("bitcode %d ", i%3), 10000))
+				tmpFile := fmt.Sprintf("%s.%d", bcFile, i)
+				for j := 0; j < 10; j++ {
+					if err := os.WriteFile(tmpFile, bitcode, 0644); err != nil {
+						t.Errorf("Could not write %v: %v\n", tmpFile, err)
+						return
+					}
+					if err := os.Rename(tmpFile, bcFile); err != nil {
+						t.Errorf("Could not rename %v: %v\n", tmpFile, err)
+						return
+					}
+					if _, err := shared.StoreBitcodeFile(store, bcFile); err != nil {
+						t.Errorf("StoreBitcodeFile(%v) failed: %v\n", bcFile, err)
+					}
+				}
+			}(i)
+		}
+		wg.Wait()
+		checkStoreIntegrity(t, store)
+		if entries, _ := shared.ReadStore(store); len(entries) != 3 {
+			t.Errorf("The store should hold 3 entries, not %v\n", len(entries))
+		}
+		indexFiles, _ := filepath.Glob(filepath.Join(store, "index", "*", "*"))
+		if len(indexFiles) != 4 {
+			t.Errorf("The store should index 4 paths, not %v\n", len(indexFiles))
+		}
+		for _, indexFile := range indexFiles {
+			index, _ := os.ReadFile(indexFile)
+			fields := strings.Fields(string(index))
+			if len(fields) != 2 || !contents[fields[0]] || filepath.Dir(fields[1]) != dir {
+				t.Errorf("The index entry %v is %q, not one of the contents stored\n", indexFile, index)
+			}
+		}
+	}
+}
+
+func Test_store_concurrent_compiles(t *testing.T) {
+	if _, err := exec.LookPath("clang"); err != nil {
+		t.Skip("clang is not installed")
+	}
+	defer restoreEnvironment([]string{"WLLVM_BC_STORE", "GLLVM_STORE_LOCK"})()
+	store := t.TempDir()
+	os.Setenv("WLLVM_BC_STORE", store)
+	os.Setenv("GLLVM_STORE_LOCK", "1")
+	shared.FetchEnvironment()
+
+	dir := t.TempDir()
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			args := []string{"../data/helloworld.c", "-c", "-o", filepath.Join(dir, fmt.Sprintf("hello%d.o", i))}
+			if exitCode := shared.Compile(args, "clang"); exitCode != 0 {
+				t.Errorf("Compile of %v returned %v\n", args, exitCode)
+			}
+		}(i)
+	}
+	wg.Wait()
+	checkStoreIntegrity(t, store)
+	if entries, _ := shared.ReadStore(store); len(entries) != 1 {
+		t.Errorf("The identical bitcode should be stored once, not %v times\n", len(entries))
+	}
+}
@@ -0,0 +1,92 @@
+package test
+
+import (
+	"debug/elf"
+	"encoding/binary"
+	"github.com/SRI-CSL/gllvm/shared"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func Test_store_deduplication(t *testing.T) {
+	dir := t.TempDir()
+	store := t.TempDir()
+	first := filepath.Join(dir, ".first.o.bc")
+	second := filepath.Join(dir, ".second.o.bc")
+	for _, bcFile := range []string{first, second} {
+		if err := os.WriteFile(bcFile, []byte("the same bitcode"), 0644); err != nil {
+			t.Fatalf("Could not write %v: %v\n", bcFile, err)
+		}
+	}
+	firstHash, err := shared.StoreBitcodeFile(store, first)
+	if err != nil {
+		t.Fatalf("StoreBitcodeFile(%v) failed: %v\n", first, err)
+	}
+	secondHash, err := shared.StoreBitcodeFile(store, second)
+	if err != nil {
+		t.Fatalf("StoreBitcodeFile(%v) failed: %v\n", second, err)
+	}
+	if firstHash != secondHash {
+		t.Errorf("Identical bitcode was stored as %v and %v\n", firstHash, secondHash)
+	}
+	objects, _ := filepath.Glob(filepath.Join(store, "objects", "*", "*"))
+	if len(objects) != 1 || objects[0] != shared.StoreObjectPath(store, firstHash) {
+		t.Errorf("The store holds the objects %v\n", objects)
+	}
+
+	// rebuilding keeps the older bitcode around
+	if err = os.WriteFile(first, []byte("some other bitcode"), 0644); err != nil {
+		t.Fatalf("Could not write %v: %v\n", first, err)
+	}
+	rebuiltHash, err := shared.StoreBitcodeFile(store, first)
+	if err != nil {
+		t.Fatalf("StoreBitcodeFile(%v) failed: %v\n", first, err)
+	}
+	for _, hash := range []string{firstHash, rebuiltHash} {
+		if !shared.IsPlainFile(shared.StoreObjectPath(store, hash)) {
+			t.Errorf("The store lost the bitcode %v\n", hash)
+		}
+	}
+	if leftovers, _ := filepath.Glob(filepath.Join(store, "*", "*", ".gllvm-tmp-*")); len(leftovers) != 0 {
+		t.Errorf("The store has leftover temporary files %v\n", leftovers)
+	}
+}
+
+func Test_store_extraction(t *testing.T) {
+	dir := t.TempDir()
+	store := t.TempDir()
+	defer restoreEnvironment([]string{"WLLVM_BC_STORE"})()
+	os.Setenv("WLLVM_BC_STORE", store)
+	shared.FetchEnvironment()
+
+	bcFile := filepath.Join(dir, ".foo.o.bc")
+	assemble(t, "define i32 @foo() {\n  ret i32 0\n}\n", bcFile)
+	hash, err := shared.StoreBitcodeFile(store, bcFile)
+	if err != nil {
+		t.Fatalf("StoreBitcodeFile(%v) failed: %v\n", bcFile, err)
+	}
+	record, err := shared.EncodeBitcodeRecord(shared.BitcodeRecord{Path: bcFile, Hash: hash})
+	if err != nil {
+		t.Fatalf("EncodeBitcodeRecord failed: %v\n", err)
+	}
+	objFile := filepath.Join(dir, "foo.o")
+	if err = os.WriteFile(objFile, minimalELF(t, elf.ELFCLASS64, binary.LittleEndian, elf.ET_REL), 0644); err != nil {
+		t.Fatalf("Could not write %v: %v\n", objFile, err)
+	}
+	if err = shared.InjectELFSection(objFile, shared.ELFSectionName, record); err != nil {
+		t.Fatalf("InjectELFSection(%v) failed: %v\n", objFile, err)
+	}
+
+	// a later build of the same file, which also makes its way into the store
+	assemble(t, "define i32 @foo() {\n  ret i32 1\n}\n", bcFile)
+	if _, err = shared.StoreBitcodeFile(store, bcFile); err != nil {
+		t.Fatalf("StoreBitcodeFile(%v) failed: %v\n", bcFile, err)
+	}
+
+	output := filepath.Join(dir, "foo.bc")
+	args := []string{"get-bc", "-S", "-o", output, objFile}
+	if exitCode := shared.Extract(args); exitCode != 0 {
+		t.Errorf("Extraction of %v should use the bitcode %v in the store, but returned %v\n", args, hash, exitCode)
+	}
+}
@@ -0,0 +1,83 @@
+package test
+
+import (
+	"debug/elf"
+	"encoding/binary"
+	"github.com/SRI-CSL/gllvm/shared"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func Test_store_tool(t *testing.T) {
+	dir := t.TempDir()
+	store := t.TempDir()
+	var hashes []string
+	for _, name := range []string{"kept", "unreferenced", "old"} {
+		bcFile := filepath.Join(dir, "."+name+".o.bc")
+		if err := os.WriteFile(bcFile, []byte(name+" bitcode"), 0644); err != nil {
+			t.Fatalf("Could not write %v: %v\n", bcFile, err)
+		}
+		hash, err := shared.StoreBitcodeFile(store, bcFile)
+		if err != nil {
+			t.Fatalf("StoreBitcodeFile(%v) failed: %v\n", bcFile, err)
+		}
+		hashes = append(hashes, hash)
+	}
+	kept, unreferenced, old := hashes[0], hashes[1], hashes[2]
+	longAgo := time.Now().AddDate(0, 0, -100)
+	if err := os.Chtimes(shared.StoreObjectPath(store, old), longAgo, longAgo); err != nil {
+		t.Fatalf("Could not age %v: %v\n", old, err)
+	}
+
+	record, err := shared.EncodeBitcodeRecord(shared.BitcodeRecord{Path: filepath.Join(dir, ".kept.o.bc"), Hash: kept})
+	if err != nil {
+		t.Fatalf("EncodeBitcodeRecord failed: %v\n", err)
+	}
+	objFile := filepath.Join(dir, "kept.o")
+	if err = os.WriteFile(objFile, minimalELF(t, elf.ELFCLASS64, binary.LittleEndian, elf.ET_REL), 0644); err != nil {
+		t.Fatalf("Could not write %v: %v\n", objFile, err)
+	}
+	if err = shared.InjectELFSection(objFile, shared.ELFSectionName, record); err != nil {
+		t.Fatalf("InjectELFSection(%v) failed: %v\n", objFile, err)
+	}
+
+	entries, err := shared.ReadStore(store)
+	if err != nil || len(entries) != 3 {
+		t.Fatalf("ReadStore returned %v, %v\n", entries, err)
+	}
+	_, references, err := shared.StoreReferences(store, objFile)
+	if err != nil || len(references) != 1 || len(references[0]) != 1 || references[0][0] != shared.StoreObjectPath(store, kept) {
+		t.Errorf("StoreReferences returned %v, %v\n", references, err)
+	}
+
+	present := func(hash string) bool { return shared.IsPlainFile(shared.StoreObjectPath(store, hash)) }
+	gc := func(args ...string) {
+		args = append([]string{"gllvm-store", "-s", store, "gc"}, args...)
+		if exitCode := shared.StoreTool(args); exitCode != 0 {
+			t.Errorf("%v returned %v\n", args, exitCode)
+		}
+	}
+	if exitCode := shared.StoreTool([]string{"gllvm-store", "-s", store, "gc"}); exitCode == 0 {
+		t.Errorf("gc without binaries or days should refuse to run\n")
+	}
+	gc("-n", objFile)
+	if !present(kept) || !present(unreferenced) || !present(old) {
+		t.Errorf("gc -n removed entries\n")
+	}
+	gc("-days", "30")
+	if !present(kept) || !present(unreferenced) || present(old) {
+		t.Errorf("gc -days 30 should only remove the old entry\n")
+	}
+	gc(objFile)
+	if !present(kept) || present(unreferenced) {
+		t.Errorf("gc should only keep the referenced entry\n")
+	}
+	if entries, err = shared.ReadStore(store); err != nil || len(entries) != 1 || entries[0].Hash != kept {
+		t.Errorf("ReadStore after gc returned %v, %v\n", entries, err)
+	}
+	if indexFiles, _ := filepath.Glob(filepath.Join(store, "index", "*", "*")); len(indexFiles) != 1 {
+		t.Errorf("gc left the index entries %v\n", indexFiles)
+	}
+}
@@ -0,0 +1,50 @@
+package test
+
+import (
+	"github.com/SRI-CSL/gllvm/shared"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func Test_native_only_functions(t *testing.T) {
+	if _, err := exec.LookPath("gcc"); err != nil {
+		t.Skip("gcc is not installed")
+	}
+	dir := t.TempDir()
+
+	mainObj := compileWithBitcode(t, dir, "main",
+		"int asm_fn(void);\nint helper(void) { return asm_fn(); }\nint main(void) { return helper(); }\n",
+		"declare i32 @asm_fn()\n\ndefine i32 @helper() {\n  %r = call i32 @asm_fn()\n  ret i32 %r\n}\n\n"+
+			"define i32 @main() {\n  %r = call i32 @helper()\n  ret i32 %r\n}\n")
+	// assembly never has any bitcode, helper.cold stands for the part gcc splits off helper
+	asmFile := filepath.Join(dir, "asm.s")
+	asmObj := filepath.Join(dir, "asm.o")
+	asmSource := "\t.text\n\t.globl asm_fn\n\t.type asm_fn, @function\nasm_fn:\n\tret\n" +
+		"\t.type helper.cold, @function\nhelper.cold:\n\tret\n"
+	if err := os.WriteFile(asmFile, []byte(asmSource), 0644); err != nil {
+		t.Fatalf("Could not write %v: %v\n", asmFile, err)
+	}
+	if out, err := exec.Command("gcc", "-c", asmFile, "-o", asmObj).CombinedOutput(); err != nil {
+		t.Fatalf("gcc failed to assemble %v: %v %s\n", asmFile, err, out)
+	}
+	program := filepath.Join(dir, "prog")
+	if out, err := exec.Command("gcc", mainObj, asmObj, "-o", program).CombinedOutput(); err != nil {
+		t.Fatalf("gcc failed to link %v: %v %s\n", program, err, out)
+	}
+
+	output := filepath.Join(dir, "prog.bc")
+	args := []string{"get-bc", "-native", "-o", output, program}
+	if exitCode := shared.Extract(args); exitCode != 0 {
+		t.Fatalf("Extraction of %v returned %v\n", args, exitCode)
+	}
+	functions, err := shared.NativeOnlyFunctions(program, "", output)
+	if err != nil {
+		t.Fatalf("NativeOnlyFunctions(%v) failed: %v\n", program, err)
+	}
+	if expected := []string{"asm_fn"}; !reflect.DeepEqual(functions, expected) {
+		t.Errorf("The functions of %v without bitcode are %v, expected %v\n", program, functions, expected)
+	}
+}
@@ -0,0 +1,79 @@
+package test
+
+import (
+	"crypto/sha256"
+	"debug/elf"
+	"encoding/binary"
+	"encoding/hex"
+	"github.com/SRI-CSL/gllvm/shared"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
+
+func assemble(t *testing.T, source string, bcFile string) {
+	llFile := bcFile + ".ll"
+	if err := os.WriteFile(llFile, []byte(source), 0644); err != nil {
+		t.Fatalf("Could not write %v: %v\n", llFile, err)
+	}
+	if out, err := exec.Command("llvm-as", llFile, "-o", bcFile).CombinedOutput(); err != nil {
+		t.Fatalf("llvm-as failed: %v %s\n", err, out)
+	}
+}
+
+func Test_bitcode_verification(t *testing.T) {
+	dir := t.TempDir()
+	store := t.TempDir()
+	defer restoreEnvironment([]string{"WLLVM_BC_STORE"})()
+
+	bcFile := filepath.Join(dir, ".foo.o.bc")
+	assemble(t, "define i32 @foo() {\n  ret i32 0\n}\n", bcFile)
+	hash, err := shared.BitcodeHash(bcFile)
+	if err != nil {
+		t.Fatalf("BitcodeHash(%v) failed: %v\n", bcFile, err)
+	}
+	record, err := shared.EncodeBitcodeRecord(shared.BitcodeRecord{Path: bcFile, Hash: hash})
+	if err != nil {
+		t.Fatalf("EncodeBitcodeRecord failed: %v\n", err)
+	}
+	objFile := filepath.Join(dir, "foo.o")
+	if err = os.WriteFile(objFile, minimalELF(t, elf.ELFCLASS64, binary.LittleEndian, elf.ET_REL), 0644); err != nil {
+		t.Fatalf("Could not write %v: %v\n", objFile, err)
+	}
+	if err = shared.InjectELFSection(objFile, shared.ELFSectionName, record); err != nil {
+		t.Fatalf("InjectELFSection(%v) failed: %v\n", objFile, err)
+	}
+	// what the compiler would have left in the store
+	pathHash := sha256.Sum256([]byte(bcFile))
+	storeFile := filepath.Join(store, hex.EncodeToString(pathHash[:]))
+	original, err := os.ReadFile(bcFile)
+	if err != nil {
+		t.Fatalf("Could not read %v: %v\n", bcFile, err)
+	}
+	if err = os.WriteFile(storeFile, original, 0644); err != nil {
+		t.Fatalf("Could not write %v: %v\n", storeFile, err)
+	}
+
+	output := filepath.Join(dir, "foo.bc")
+	strict := []string{"get-bc", "-S", "-o", output, objFile}
+	lax := []string{"get-bc", "-o", output, objFile}
+	if exitCode := shared.Extract(strict); exitCode != 0 {
+		t.Errorf("Extraction of %v returned %v\n", strict, exitCode)
+	}
+
+	// a later build leaves a different bitcode file behind
+	assemble(t, "define i32 @foo() {\n  ret i32 1\n}\n", bcFile)
+	if exitCode := shared.Extract(strict); exitCode == 0 {
+		t.Errorf("Extraction of %v should fail on a stale bitcode file\n", strict)
+	}
+	if exitCode := shared.Extract(lax); exitCode != 0 {
+		t.Errorf("Extraction of %v returned %v\n", lax, exitCode)
+	}
+
+	os.Setenv("WLLVM_BC_STORE", store)
+	shared.FetchEnvironment()
+	if exitCode := shared.Extract(strict); exitCode != 0 {
+		t.Errorf("Extraction of %v should use the store copy, but returned %v\n", strict, exitCode)
+	}
+}